@@ -0,0 +1,218 @@
+package database
+
+import (
+	"github.com/alexbostock/alder/sql"
+)
+
+// An aggregator computes the aggregates of groups of records by hashing them
+// on their GROUP BY keys. The partial state of each group is a record of the
+// group's keys and the aggregates of the records added so far. When the
+// estimated size of the states exceeds the memory budget, they are moved to a
+// sorter, which orders them by the group keys and spills them to disk, so that
+// the partial states of each group can be combined when they are merged.
+type aggregator struct {
+	groupBy    []string
+	aggregates []sql.Aggregate
+	budget     int
+	size       int
+	groups     map[string]map[string]sql.Val
+	sorted     *sorter
+
+	group    map[string]sql.Val // Partial state of the group being read from the sorter
+	returned bool               // Whether any group has been returned by next
+}
+
+func newAggregator(groupBy []string, aggregates []sql.Aggregate, budget int) *aggregator {
+	keys := make([]sql.SortKey, len(groupBy))
+	for i, key := range groupBy {
+		keys[i].Key = key
+	}
+
+	return &aggregator{
+		groupBy:    groupBy,
+		aggregates: aggregates,
+		budget:     budget,
+		groups:     make(map[string]map[string]sql.Val),
+		sorted:     newSorter(keys, budget),
+	}
+}
+
+// avgCount is the key of the number of values summed by an AVG aggregate in a
+// partial state.
+func avgCount(a sql.Aggregate) string {
+	return a.Name + " count"
+}
+
+// add adds a record to its group.
+func (g *aggregator) add(record map[string]sql.Val) error {
+	id := recordId(record, g.groupBy)
+	state, found := g.groups[id]
+	if !found {
+		state = g.newState(record)
+		g.groups[id] = state
+	}
+
+	for _, a := range g.aggregates {
+		v, ok := record[a.Key]
+		if a.Key == "*" {
+			v, ok = sql.Val{IsNum: true}, true
+		}
+		if !ok {
+			continue
+		}
+
+		switch a.Function {
+		case sql.Count:
+			addInt(state, a.Name, 1)
+		case sql.Sum:
+			addInt(state, a.Name, v.Num)
+		case sql.Avg:
+			addInt(state, a.Name, v.Num)
+			addInt(state, avgCount(a), 1)
+		case sql.Min, sql.Max:
+			extreme(state, a, v)
+		}
+	}
+
+	if !found {
+		g.size += recordSize(state)
+		if g.size > g.budget {
+			return g.flush()
+		}
+	}
+
+	return nil
+}
+
+// newState returns the partial state of the group of a record, to which no
+// records have been added.
+func (g *aggregator) newState(record map[string]sql.Val) map[string]sql.Val {
+	state := make(map[string]sql.Val, len(g.groupBy)+len(g.aggregates))
+	for _, key := range g.groupBy {
+		if v, ok := record[key]; ok {
+			state[key] = v
+		}
+	}
+
+	for _, a := range g.aggregates {
+		switch a.Function {
+		case sql.Count:
+			state[a.Name] = sql.Val{IsNum: true}
+		case sql.Avg:
+			state[avgCount(a)] = sql.Val{IsNum: true}
+		}
+	}
+
+	return state
+}
+
+// flush moves the partial states to the sorter.
+func (g *aggregator) flush() error {
+	for _, state := range g.groups {
+		if err := g.sorted.add(state); err != nil {
+			return err
+		}
+	}
+
+	g.groups = make(map[string]map[string]sql.Val)
+	g.size = 0
+
+	return nil
+}
+
+// combine adds the partial state of a group, from another, to state.
+func (g *aggregator) combine(state, other map[string]sql.Val) {
+	for _, a := range g.aggregates {
+		v, ok := other[a.Name]
+		if !ok {
+			continue
+		}
+
+		switch a.Function {
+		case sql.Count, sql.Sum:
+			addInt(state, a.Name, v.Num)
+		case sql.Avg:
+			addInt(state, a.Name, v.Num)
+			addInt(state, avgCount(a), other[avgCount(a)].Num)
+		case sql.Min, sql.Max:
+			extreme(state, a, v)
+		}
+	}
+}
+
+// finish computes the aggregates of a group from its partial state.
+func (g *aggregator) finish(state map[string]sql.Val) map[string]sql.Val {
+	for _, a := range g.aggregates {
+		if a.Function != sql.Avg {
+			continue
+		}
+
+		if sum, ok := state[a.Name]; ok {
+			state[a.Name] = sql.Val{IsNum: true, Num: sum.Num / state[avgCount(a)].Num}
+		}
+		delete(state, avgCount(a))
+	}
+
+	return state
+}
+
+// sort moves the partial states to the sorter, after which no more records
+// can be added, and the groups can be read by next.
+func (g *aggregator) sort() error {
+	if err := g.flush(); err != nil {
+		return err
+	}
+
+	return g.sorted.sort()
+}
+
+// next returns the record of the next group, in order of the group keys, or
+// nil after the last. Without GROUP BY keys, there is exactly one group, even
+// if no records were added.
+func (g *aggregator) next() (map[string]sql.Val, error) {
+	for {
+		state, err := g.sorted.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if state == nil {
+			group := g.group
+			g.group = nil
+			if group == nil && len(g.groupBy) == 0 && !g.returned {
+				group = g.newState(nil)
+			}
+			if group == nil {
+				return nil, nil
+			}
+
+			g.returned = true
+			return g.finish(group), nil
+		}
+
+		if g.group != nil && compareRecords(g.group, state, g.sorted.keys) == 0 {
+			g.combine(g.group, state)
+			continue
+		}
+
+		group := g.group
+		g.group = state
+		if group != nil {
+			g.returned = true
+			return g.finish(group), nil
+		}
+	}
+}
+
+// addInt adds n to the int value of a key of a record, which may be missing.
+func addInt(record map[string]sql.Val, key string, n int) {
+	record[key] = sql.Val{IsNum: true, Num: record[key].Num + n}
+}
+
+// extreme updates a MIN or MAX aggregate of a partial state with a value.
+func extreme(state map[string]sql.Val, a sql.Aggregate, v sql.Val) {
+	old, ok := state[a.Name]
+	if !ok || (a.Function == sql.Min && v.Compare(old) < 0) || (a.Function == sql.Max && v.Compare(old) > 0) {
+		state[a.Name] = v
+	}
+}
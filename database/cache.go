@@ -0,0 +1,113 @@
+package database
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/alexbostock/alder/sql"
+)
+
+// defaultCacheSize is the number of prepared statements kept by the plan cache
+// of a new database.
+const defaultCacheSize = 256
+
+// CacheStats reports the use of a database's plan cache since it was created.
+type CacheStats struct {
+	Size          int // Number of statements in the cache
+	Hits          int // Lookups which found a statement
+	Misses        int // Lookups which did not, so the query was compiled
+	Evictions     int // Statements discarded to keep the cache within its size
+	Invalidations int // Times the cache was cleared because the schema changed
+}
+
+// A planCache maps query fingerprints to prepared statements, discarding the
+// least recently used statements when it is full. It is safe for concurrent
+// use.
+type planCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List // Entries, most recently used first
+	stats    CacheStats
+}
+
+type cacheEntry struct {
+	fingerprint string
+	st          *sql.Statement
+}
+
+func newPlanCache(capacity int) *planCache {
+	return &planCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (c *planCache) get(fingerprint string) (*sql.Statement, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[fingerprint]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).st, true
+}
+
+func (c *planCache) put(fingerprint string, st *sql.Statement) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[fingerprint]; ok {
+		e.Value.(*cacheEntry).st = st
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[fingerprint] = c.lru.PushFront(&cacheEntry{fingerprint, st})
+	c.evict()
+}
+
+// evict discards the least recently used statements until the cache is within
+// its capacity. The caller must hold mu.
+func (c *planCache) evict() {
+	for c.lru.Len() > c.capacity {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*cacheEntry).fingerprint)
+		c.stats.Evictions++
+	}
+}
+
+func (c *planCache) resize(capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity = capacity
+	c.evict()
+}
+
+// invalidate discards every statement, since they were compiled against a
+// schema which has changed.
+func (c *planCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.stats.Invalidations++
+}
+
+func (c *planCache) statistics() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Size = c.lru.Len()
+	return stats
+}
@@ -0,0 +1,222 @@
+package database
+
+import (
+	"reflect"
+	"sync/atomic"
+
+	"github.com/alexbostock/alder/schema"
+	"github.com/alexbostock/alder/sql"
+)
+
+// A catalog is the on-disk description of the tables of a database, which is
+// kept in its data directory, so that a database can be reopened without its
+// schema file.
+type catalog struct {
+	Tables []catalogTable
+}
+
+// A catalogTable describes a table, its primary key sequence and its storage.
+type catalogTable struct {
+	Name            string
+	Fields          []schema.Field // The primary key first
+	NextPrimaryKey  int            // Next key of the primary key sequence
+	Indexes         []schema.Index // Secondary indexes
+	BranchingFactor int            // Branching factor of the table's B+ tree
+
+	// Alterations made to the table, by which records are migrated, and the
+	// fields stored in the records of each version
+	History []sql.Alteration
+	Layouts [][]schema.Field
+	Format  int // Form of the table's records, gobRows or compactRows
+
+	Statistics *tableStats // Collected by the last ANALYZE of the table, or nil
+}
+
+// catalog describes the database's tables as they are now.
+func (db *Db) catalog() catalog {
+	var c catalog
+	stats := db.statistics()
+
+	for _, table := range db.schema.Tables {
+		t := db.tables[table.Name]
+		c.Tables = append(c.Tables, catalogTable{
+			Name:            table.Name,
+			Fields:          table.Fields,
+			NextPrimaryKey:  int(atomic.LoadInt64(&t.nextPrimaryKey)),
+			Indexes:         table.Indexes,
+			BranchingFactor: t.branchingFactor,
+			History:         t.history,
+			Layouts:         t.layouts,
+			Format:          compactRows,
+			Statistics:      stats[table.Name],
+		})
+	}
+
+	return c
+}
+
+// schema returns the schema of the tables in the catalog.
+func (c catalog) schema() schema.Schema {
+	s := schema.Schema{Tables: make([]schema.Table, len(c.Tables))}
+	for i, t := range c.Tables {
+		s.Tables[i] = schema.Table{Name: t.Name, Fields: t.Fields, Indexes: t.Indexes}
+	}
+
+	return s
+}
+
+// merge adds the tables of a schema which are not in the catalog, giving their
+// B+ trees the given branching factor, and the indexes of the schema which are
+// not in the catalog. It returns a *schema.Error if a table in both does not
+// have the same fields, or an index in both does not have the same fields.
+func (c *catalog) merge(s schema.Schema, branchingFactor int) error {
+	for _, table := range s.Tables {
+		found := false
+		for i, t := range c.Tables {
+			if t.Name != table.Name {
+				continue
+			}
+
+			found = true
+			if !reflect.DeepEqual(t.Fields, table.Fields) {
+				return &schema.Error{Table: table.Name, Msg: "table does not match the catalog of the database"}
+			}
+			if err := c.Tables[i].mergeIndexes(table.Indexes); err != nil {
+				return err
+			}
+		}
+
+		if !found {
+			c.Tables = append(c.Tables, catalogTable{
+				Name:            table.Name,
+				Fields:          table.Fields,
+				Indexes:         table.Indexes,
+				BranchingFactor: branchingFactor,
+				Layouts:         [][]schema.Field{layout(table.Fields)},
+				Format:          compactRows,
+			})
+		}
+	}
+
+	return nil
+}
+
+// mergeIndexes adds the indexes of a table in a schema which are not in the
+// catalog.
+func (t *catalogTable) mergeIndexes(indexes []schema.Index) error {
+	for _, i := range indexes {
+		found := false
+		for _, existing := range t.Indexes {
+			if existing.Name != i.Name {
+				continue
+			}
+
+			found = true
+			if !reflect.DeepEqual(existing.Fields, i.Fields) {
+				return &schema.Error{Table: t.Name, Msg: "index " + i.Name + " does not match the catalog of the database"}
+			}
+		}
+
+		if !found {
+			t.Indexes = append(t.Indexes, i)
+		}
+	}
+
+	return nil
+}
+
+// alter executes a CREATE TABLE, CREATE INDEX, DROP TABLE or ALTER TABLE
+// statement. Schema changes are not part of any transaction: they are applied
+// immediately, and seen by the transactions which begin afterwards. Prepared
+// statements are compiled again when they are next executed.
+//
+// ALTER TABLE does not rewrite the table's records. The alteration is added to
+// the table's history, and records are migrated as they are read, so those
+// written by transactions which began before it can still be committed.
+//
+// CREATE INDEX builds the index from every version of the table's records, so
+// it can be used by transactions which began before it.
+func (db *Db) alter(s *Stmt, args []interface{}) (res *Result, err error) {
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+
+	defer recoverStorageError(&err)
+
+	// The schema cannot change while commitMu is held, so the statement is
+	// checked against the schema to which it is applied
+	query, err := s.bind(db, args)
+	if err != nil {
+		return nil, err
+	}
+
+	sch := db.schema
+	tables := make(map[string]*tab, len(db.tables)+1)
+	for name, t := range db.tables {
+		tables[name] = t
+	}
+
+	var changed string // Table whose statistics are discarded
+	var indexed string // Table whose indexes change
+	switch q := query.(type) {
+	case *sql.CreateTableQuery:
+		sch = sch.WithTable(q.Table)
+		tables[q.Table.Name] = newTab(db.branchingFactor, q.Table.Fields)
+		changed = q.Table.Name
+	case *sql.CreateIndexQuery:
+		table := sch.GetTable(q.Table)
+		n := len(table.Indexes)
+		table.Indexes = append(table.Indexes[:n:n], q.Index)
+		sch = sch.WithTable(table)
+		indexed = q.Table
+	case *sql.DropTableQuery:
+		sch = sch.WithoutTable(q.Table)
+		delete(tables, q.Table)
+		changed = q.Table
+	case *sql.AlterTableQuery:
+		sch = sch.WithTable(q.Alteration.Apply(sch.GetTable(q.Table)))
+		changed, indexed = q.Table, q.Table
+	}
+
+	// New indexes are built before the schema changes, while no records can be
+	// committed, since commitMu is held
+	var indexes []*index
+	if indexed != "" {
+		t := tables[indexed]
+		t.mu.RLock()
+		indexes = t.indexed(sch.GetTable(indexed).Indexes)
+		t.mu.RUnlock()
+	}
+
+	db.mu.Lock()
+	db.schema, db.tables = sch, tables
+	if indexed != "" {
+		t := tables[indexed]
+		t.mu.Lock()
+		t.indexes = indexes
+		t.mu.Unlock()
+	}
+
+	// The statistics of the table changed are discarded, since they may
+	// describe fields it no longer has
+	stats := make(map[string]*tableStats, len(db.stats))
+	for name, ts := range db.stats {
+		if name != changed {
+			stats[name] = ts
+		}
+	}
+	db.stats = stats
+
+	if q, ok := query.(*sql.AlterTableQuery); ok {
+		// Views share the old history, so it is copied rather than appended to
+		t := tables[q.Table]
+		n := len(t.history)
+		t.history = append(t.history[:n:n], q.Alteration)
+		t.layouts = append(t.layouts[:n+1:n+1], layout(sch.GetTable(q.Table).Fields))
+	}
+	db.version++
+	db.mu.Unlock()
+
+	db.cache.invalidate()
+
+	return &Result{LastInsertId: -1}, nil
+}
@@ -3,185 +3,626 @@
 package database
 
 import (
-	"bytes"
-	"encoding/gob"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/alexbostock/alder/schema"
 	"github.com/alexbostock/alder/sql"
 	"github.com/alexbostock/alder/store"
-	"github.com/davecgh/go-spew/spew"
 )
 
+// A Db is a database. It is safe for concurrent use by multiple goroutines.
+//
+// The schema and tables of a database are replaced, never modified, when its
+// schema changes, which happens while holding both commitMu and mu. They may be
+// read while holding either.
 type Db struct {
-	schema        schema.Schema
-	tables        map[string]*tab
-	cachedQueries map[string]sql.Query
+	schema          schema.Schema
+	tables          map[string]*tab
+	version         int // Schema version, incremented by each change to the schema
+	cache           *planCache
+	sortMemory      int64  // Memory budget of each sort, in bytes (accessed atomically)
+	dir             string // Data directory, or "" if the database is only in memory
+	generation      int    // Generation of the last checkpoint, guarded by commitMu
+	branchingFactor int
+
+	mu       sync.Mutex  // Guards csn, commits, horizon, active and stats
+	commitMu sync.Mutex  // Serialises commits, schema changes, vacuums and checkpoints
+	csn      int         // Sequence number of the last transaction committed
+	commits  []time.Time // Time at which transaction i+1 was committed
+	horizon  int         // Earliest snapshot which has not been vacuumed
+	active   map[int]int // Snapshot CSN -> number of transactions and queries reading it
+	parent   *Db         // Database of which this is a view, or nil
+
+	// Statistics of the tables by name, collected by ANALYZE. The map is
+	// replaced, never modified.
+	stats map[string]*tableStats
 }
 
 type tab struct {
-	nextPrimaryKey int
-	store          store.Store
+	nextPrimaryKey  int64        // Accessed atomically
+	mu              sync.RWMutex // Guards store, in the tables of a database which is not a view
+	store           store.Store
+	branchingFactor int  // Branching factor of the store's B+ tree
+	base            *tab // Table from which a view of it allocates keys, or nil
+
+	// Alterations made to the table's fields, oldest first. Records are
+	// migrated from the version with which they were written as they are read.
+	history []sql.Alteration
+	layouts [][]schema.Field // Fields of the records of each version, without the primary key
+
+	// Secondary indexes, which are guarded by mu. A view of the table has the
+	// indexes it had when the view was made, whose entries are guarded by the
+	// mu of its base.
+	indexes []*index
+}
+
+// newTab returns an empty table with the given fields.
+func newTab(branchingFactor int, fields []schema.Field) *tab {
+	return &tab{
+		store:           store.NewBPTree(branchingFactor),
+		branchingFactor: branchingFactor,
+		layouts:         [][]schema.Field{layout(fields)},
+	}
 }
 
 func (t *tab) autonum() int {
-	n := t.nextPrimaryKey
-	t.nextPrimaryKey++
-	return n
+	if t.base != nil {
+		return t.base.autonum()
+	}
+
+	return int(atomic.AddInt64(&t.nextPrimaryKey, 1) - 1)
+}
+
+// scanWhere calls f on each record satisfying a WHERE clause, in primary key
+// order, using conditions on the primary key to avoid scanning the whole table.
+// The scan stops early if f returns false.
+func (t *tab) scanWhere(where sql.WhereClause, primary string, f func(int, []byte) bool) {
+	path := planAccess(where, primary)
+	pred := t.matches(path.residual, primary)
+
+	t.scanPath(path, func(key int, val []byte) bool {
+		if pred(key, val) {
+			return f(key, val)
+		}
+		return true
+	})
+}
+
+// scanPath calls f on each record with a primary key in an access path, in
+// primary key order, stopping early if f returns false. The residual filters
+// of the path are not checked.
+func (t *tab) scanPath(path accessPath, f func(int, []byte) bool) {
+	switch {
+	case path.empty():
+	case path.point():
+		if val := t.store.Get(path.min); val != nil {
+			f(path.min, val)
+		}
+	default:
+		t.store.Scan(path.min, path.max, f)
+	}
+}
+
+// keysWhere returns the primary keys of all records satisfying a WHERE clause.
+func (t *tab) keysWhere(where sql.WhereClause, primary string) []int {
+	var keys []int
+	t.scanWhere(where, primary, func(key int, _ []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	return keys
+}
+
+// updateWhere applies f to all records satisfying a WHERE clause, using
+// conditions on the primary key to avoid scanning the whole table.
+func (t *tab) updateWhere(where sql.WhereClause, primary string, f func([]byte) []byte) {
+	path := planAccess(where, primary)
+	pred := t.matches(path.residual, primary)
+
+	switch {
+	case path.empty():
+	case path.point():
+		t.store.Update(path.min, func(val []byte) []byte {
+			if !pred(path.min, val) {
+				return val
+			}
+			return f(val)
+		})
+	case path.fullScan():
+		t.store.UpdateAllWhere(pred, f)
+	case refersTo(path.residual, primary):
+		// UpdateRange does not pass keys to f, so find matching keys first
+		for _, key := range t.keysWhere(where, primary) {
+			t.store.Update(key, f)
+		}
+	default:
+		t.store.UpdateRange(path.min, path.max, func(val []byte) []byte {
+			// The residual filters do not read the primary key
+			if !pred(0, val) {
+				return val
+			}
+			return f(val)
+		})
+	}
 }
 
 func New(branchingFactor int, schema schema.Schema) *Db {
 	db := &Db{
-		schema:        schema,
-		tables:        make(map[string]*tab),
-		cachedQueries: make(map[string]sql.Query),
+		schema:          schema,
+		tables:          make(map[string]*tab),
+		cache:           newPlanCache(defaultCacheSize),
+		sortMemory:      defaultSortMemory,
+		branchingFactor: branchingFactor,
+		active:          make(map[int]int),
 	}
 
 	for _, table := range schema.Tables {
-		db.tables[table.Name] = &tab{
-			nextPrimaryKey: 0,
-			store:          store.NewBPTree(branchingFactor),
-		}
+		t := newTab(branchingFactor, table.Fields)
+		t.indexes = t.indexed(table.Indexes)
+		db.tables[table.Name] = t
 	}
 
 	return db
 }
 
-func (db *Db) Query(q string) {
-	query, ok := db.cachedQueries[q]
-	if !ok {
-		query = sql.Compile(db.schema, q)
-		db.cachedQueries[q] = query
+// SetSortMemory sets the memory budget of each sort and aggregation, in bytes.
+// Sorts which exceed the budget write sorted runs to temporary files, and merge
+// them. Aggregations with more groups than fit in the budget write partial
+// groups to sorted runs in the same way.
+func (db *Db) SetSortMemory(bytes int) {
+	atomic.StoreInt64(&db.sortMemory, int64(bytes))
+}
+
+// SetCacheSize sets the number of prepared statements kept by the plan cache,
+// which holds the most recently used ones.
+func (db *Db) SetCacheSize(n int) {
+	db.cache.resize(n)
+}
+
+// CacheStats returns statistics of the use of the plan cache.
+func (db *Db) CacheStats() CacheStats {
+	return db.cache.statistics()
+}
+
+// Query compiles and executes an SQL query in its own transaction, and returns
+// its result. The arguments are bound to the query's parameters, as by
+// Stmt.Query. Invalid queries return the error from sql.Prepare, and queries
+// which fail to execute return a *ConstraintError, *ConflictError,
+// *SnapshotError or *StorageError, without changing the database.
+func (db *Db) Query(q string, args ...interface{}) (*Result, error) {
+	st, err := db.Prepare(q)
+	if err != nil {
+		return nil, err
 	}
 
-	db.execute(query)
+	return st.Query(args...)
 }
 
-func (db *Db) execute(q sql.Query) {
+// autocommit executes a statement in its own transaction. Schema changes are
+// applied outside any transaction. A statement whose transaction conflicts with
+// another committed while it executed is executed again, reading the records
+// that transaction committed, so that a single statement never fails with a
+// *ConflictError.
+func (db *Db) autocommit(s *Stmt, args []interface{}) (*Result, error) {
+	switch s.st.Query.(type) {
+	case *sql.TransactionQuery:
+		return nil, ErrNotInSession
+	case *sql.CreateTableQuery, *sql.CreateIndexQuery, *sql.DropTableQuery, *sql.AlterTableQuery:
+		return db.alter(s, args)
+	}
+
+	for {
+		res, err := db.execOnce(s, args)
+		if _, ok := err.(*ConflictError); !ok {
+			return res, err
+		}
+	}
+}
+
+// execOnce executes a statement in its own transaction.
+func (db *Db) execOnce(s *Stmt, args []interface{}) (*Result, error) {
+	tx := db.Begin()
+	res, err := tx.QueryStmt(s, args...)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// currentSchema returns the schema of the database, and its version.
+func (db *Db) currentSchema() (schema.Schema, int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.schema, db.version
+}
+
+func (db *Db) execute(q sql.Query) (res *Result, err error) {
+	defer recoverStorageError(&err)
+
 	switch query := q.(type) {
-	case *sql.CompoundQuery:
-		db.compoundQuery(*query)
-	case *sql.SelectQuery:
-		spew.Dump(db.selectQuery(*query))
+	case *sql.CompoundQuery, *sql.SelectQuery:
+		records, err := db.subquery(query)
+		if err != nil {
+			return nil, err
+		}
+		return rowsResult(db.columns(query), records), nil
+	case *sql.ExplainQuery:
+		return db.explain(*query)
+	case *sql.AnalyzeQuery:
+		return db.analyze(*query)
 	case *sql.InsertQuery:
-		db.insertQuery(*query)
+		n, key, err := db.insertQuery(*query)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{RowsAffected: n, LastInsertId: key}, nil
 	case *sql.UpdateQuery:
-		db.updateQuery(*query)
+		n, err := db.updateQuery(*query)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{RowsAffected: n, LastInsertId: -1}, nil
 	case *sql.DeleteQuery:
-		db.deleteQuery(*query)
+		n, err := db.deleteQuery(*query)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{RowsAffected: n, LastInsertId: -1}, nil
+	case *sql.TransactionQuery:
+		return nil, ErrNotInSession
+	case *sql.CreateTableQuery, *sql.CreateIndexQuery, *sql.DropTableQuery, *sql.AlterTableQuery:
+		return nil, ErrSchemaInTransaction
 	default:
-		spew.Dump(q)
 		panic(errors.New("Invalid query tree (which should not have passed static analysis)"))
 	}
 }
 
-func (db *Db) compoundQuery(q sql.CompoundQuery) {
-	fmt.Println("Not yet implemented")
+// subquery executes a SELECT or compound query, and returns its records.
+func (db *Db) subquery(q sql.Query) ([]map[string]sql.Val, error) {
+	return db.run(q, db.plan(q), false)
+}
+
+// run executes a SELECT or compound query by its plan, and returns its records.
+// If analyze is true, what each step of the plan does is recorded.
+func (db *Db) run(q sql.Query, p queryPlan, analyze bool) ([]map[string]sql.Val, error) {
+	op, err := db.operators(q, p, time.Now(), analyze)
+	if err != nil {
+		return nil, err
+	}
+	defer op.Close()
+
+	if err := op.Open(); err != nil {
+		return nil, err
+	}
+
+	var records []map[string]sql.Val
+	for {
+		record, err := op.Next()
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			return records, nil
+		}
+
+		records = append(records, record)
+	}
+}
+
+// operators returns the operators which execute a SELECT or compound query by
+// its plan, starting at the given time. If analyze is true, each records what
+// it does in its step of the plan.
+func (db *Db) operators(q sql.Query, p queryPlan, start time.Time, analyze bool) (operator, error) {
+	switch query := q.(type) {
+	case *sql.SelectQuery:
+		return db.selectOperators(*query, p.(*selectPlan), start, analyze)
+	case *sql.CompoundQuery:
+		return db.compoundOperators(*query, p.(*compoundPlan), start, analyze)
+	default:
+		panic(errors.New("Invalid subquery (which should not have passed static analysis)"))
+	}
+}
+
+// measure returns an operator which records what op does in a plan step, if
+// analyze is true, or op otherwise.
+func measure(op operator, node *planNode, start time.Time, analyze bool) operator {
+	if !analyze {
+		return op
+	}
+	return &measuredOp{op, node, start}
+}
+
+// compoundOperators returns the operators which execute a compound query by its
+// plan: a set operation applied to the results of two queries, then a step for
+// each other step of the plan.
+func (db *Db) compoundOperators(q sql.CompoundQuery, p *compoundPlan, start time.Time, analyze bool) (operator, error) {
+	switch q.Operation {
+	case sql.Union, sql.UnionAll, sql.Intersection, sql.Difference:
+	default:
+		panic(errors.New("Invalid set operation (which should not have passed static analysis)"))
+	}
+
+	left, err := db.operators(q.Left, p.left, start, analyze)
+	if err != nil {
+		return nil, err
+	}
+	right, err := db.operators(q.Right, p.right, start, analyze)
+	if err != nil {
+		left.Close()
+		return nil, err
+	}
+
+	var op operator = &setOp{left: left, right: right, operation: q.Operation, keys: db.resultKeys(q.Left), rightKeys: db.resultKeys(q.Right)}
+	op = measure(op, p.operation, start, analyze)
+
+	if p.sort != nil {
+		budget := int(atomic.LoadInt64(&db.sortMemory))
+		op = measure(&sortOp{op, newSorter(q.OrderBy, budget), ""}, p.sort, start, analyze)
+	}
+
+	if p.limit != nil {
+		offset, limit := bounds(q.Limit, q.Offset)
+		op = measure(&limitOp{input: op, offset: offset, limit: limit}, p.limit, start, analyze)
+	}
+
+	return op, nil
 }
 
-func (db *Db) selectQuery(q sql.SelectQuery) []map[string]sql.Val {
-	store := db.tables[q.Table].store
+// resultKeys returns the names of the fields returned by a query, in order.
+// SELECT * returns the fields of each table in the order of the schema.
+func (db *Db) resultKeys(q sql.Query) []string {
+	switch query := q.(type) {
+	case *sql.SelectQuery:
+		if len(query.Keys) > 0 {
+			return query.Keys
+		}
+
+		var keys []string
+		for _, c := range db.columns(query) {
+			keys = append(keys, c.Name)
+		}
+		return keys
+	case *sql.CompoundQuery:
+		return db.resultKeys(query.Left)
+	default:
+		panic(errors.New("Invalid subquery (which should not have passed static analysis)"))
+	}
+}
+
+// recordId returns a string which identifies a record by the values of the
+// given fields, so that records with equal values have equal ids.
+func recordId(record map[string]sql.Val, keys []string) string {
+	var id strings.Builder
+
+	for _, key := range keys {
+		if val, ok := record[key]; ok {
+			id.WriteString(valueId(val))
+		} else {
+			id.WriteString("-")
+		}
+		id.WriteString(";")
+	}
+
+	return id.String()
+}
+
+// valueId returns a string which identifies a value, so that equal values
+// have equal ids.
+func valueId(val sql.Val) string {
+	if val.IsNum {
+		return fmt.Sprintf("i%d", val.Num)
+	}
+	return fmt.Sprintf("s%d:%s", len(val.Str), val.Str)
+}
+
+// selectOperators returns the operators which execute a SELECT query by its
+// plan: a scan of the table read first, joins adding the others, then a step
+// for each other step of the plan.
+func (db *Db) selectOperators(q sql.SelectQuery, p *selectPlan, start time.Time, analyze bool) (operator, error) {
+	var snapshot *snapshotOp
+	if q.AsOf != nil {
+		root := db.root()
+		csn, err := root.acquireAsOf(q.AsOf)
+		if err != nil {
+			return nil, err
+		}
+
+		db = root.view(csn)
+		snapshot = &snapshotOp{db: root, csn: csn}
+	}
+
 	primaryKey := db.schema.GetTable(q.Table).GetPrimaryKey()
+	budget := int(atomic.LoadInt64(&db.sortMemory))
 
-	_ = primaryKey
+	t, primary, qualified := db.tables[p.table], db.schema.GetTable(p.table).GetPrimaryKey(), len(p.joined) > 0
 
-	// Filters such as WHERE are not yet implemented, so return all records
-	data := deserialisePlural(store.GetAllWhere(func(int, []byte) bool {
-		return true
-	}), primaryKey)
+	var op operator
+	if p.seek != nil {
+		op = &indexSeekOp{t: t, table: p.table, primary: primary, path: p.path, seek: *p.seek, qualified: qualified}
+	} else {
+		op = &scanOp{t: t, table: p.table, primary: primary, path: p.path, qualified: qualified}
+	}
+	op = measure(op, p.access, start, analyze)
+
+	for i, j := range p.joined {
+		var read *planNode
+		if analyze {
+			read = p.joins[i].children[1]
+		}
 
-	// SELECT * FROM table
-	if len(q.Keys) == 0 {
-		return data
+		op = &joinOp{db: db, input: op, j: j, strategy: p.strategies[i], read: read, start: start}
+		op = measure(op, p.joins[i], start, analyze)
 	}
 
-	keys := make(map[string]bool)
-	for _, key := range q.Keys {
-		keys[key] = true
+	if p.filter != nil {
+		op = measure(&filterOp{op, p.where}, p.filter, start, analyze)
 	}
 
-	for _, record := range data {
-		for key := range record {
-			if !keys[key] {
-				delete(record, key)
-			}
+	if p.aggregate != nil {
+		g := newAggregator(q.GroupBy, q.Aggregates, budget)
+		op = measure(&aggregateOp{op, g, q.Table}, p.aggregate, start, analyze)
+
+		if p.having != nil {
+			op = measure(&filterOp{op, q.Having}, p.having, start, analyze)
 		}
 	}
 
-	return data
+	// Records read in primary key order are reversed by sorting them by
+	// primary key
+	if p.sort != nil {
+		keys := q.OrderBy
+		if p.keyOrdered {
+			keys = []sql.SortKey{{Key: primaryKey, Descending: true}}
+		}
+		op = measure(&sortOp{op, newSorter(keys, budget), q.Table}, p.sort, start, analyze)
+	}
+
+	if p.limit != nil {
+		offset, limit := bounds(q.Limit, q.Offset)
+		op = measure(&limitOp{input: op, offset: offset, limit: limit}, p.limit, start, analyze)
+	}
+
+	if p.project != nil {
+		op = measure(newProjectOp(op, q.Keys), p.project, start, analyze)
+	}
+
+	if snapshot != nil {
+		snapshot.operator = op
+		op = snapshot
+	}
+
+	return op, nil
+}
+
+// bounds returns the number of records a query with the given LIMIT and OFFSET
+// counts skips, and the number it returns, or -1 if there is no limit.
+func bounds(limitCount, offsetCount sql.Val) (offset, limit int) {
+	limit = -1
+	if !limitCount.Null && limitCount.Num >= 0 {
+		limit = limitCount.Num
+	}
+	if !offsetCount.Null && offsetCount.Num > 0 {
+		offset = offsetCount.Num
+	}
+
+	return offset, limit
 }
 
-func (db *Db) insertQuery(q sql.InsertQuery) {
+// insertQuery inserts records, and returns the number of records inserted and
+// the primary key of the last one.
+func (db *Db) insertQuery(q sql.InsertQuery) (int, int, error) {
 	t := db.tables[q.Table]
+	table := db.schema.GetTable(q.Table)
+	last := -1
 
-	for _, values := range q.Values {
+	for i, values := range q.Values {
 		data := make(map[string]sql.Val)
 
-		for i, key := range q.Keys {
-			data[key] = values[i]
+		// Records have no value for fields which are NULL
+		for j, key := range q.Keys {
+			if !values[j].Null {
+				data[key] = values[j]
+			}
+		}
+		if err := checkNotNull(table, data); err != nil {
+			return i, -1, err
 		}
 
-		ok := t.store.Insert(t.autonum(), serialise(data))
-		if !ok {
-			panic(errors.New("Insert failed"))
+		last = t.autonum()
+		if !t.store.Insert(last, t.encode(data)) {
+			primaryKey := db.schema.GetTable(q.Table).GetPrimaryKey()
+			return i, -1, &ConstraintError{q.Table, primaryKey, fmt.Sprintf("duplicate key %d", last)}
 		}
 	}
+
+	return len(q.Values), last, nil
 }
 
-func (db *Db) updateQuery(q sql.UpdateQuery) {
-	// WHERE clauses are not yet implemented, so update entire table
+// updateQuery updates all records satisfying the query's WHERE clause, and
+// returns the number of records updated.
+func (db *Db) updateQuery(q sql.UpdateQuery) (int, error) {
+	t := db.tables[q.Table]
+	table := db.schema.GetTable(q.Table)
 
-	predicate := func(int, []byte) bool {
-		return true
+	for _, f := range table.Fields {
+		if v, ok := q.Values[f.Name]; ok && v.Null && f.NotNull {
+			return 0, &ConstraintError{q.Table, f.Name, "cannot be NULL"}
+		}
 	}
 
+	updated := 0
 	updateFunction := func(oldValue []byte) []byte {
-		data := deserialise(oldValue)
+		updated++
+		data := t.decode(oldValue)
 		for field, val := range q.Values {
-			data[field] = val
+			if val.Null {
+				delete(data, field)
+			} else {
+				data[field] = val
+			}
 		}
-		return serialise(data)
+		return t.encode(data)
 	}
 
-	store := db.tables[q.Table].store
-	store.UpdateAllWhere(predicate, updateFunction)
-}
+	t.updateWhere(q.Where, table.GetPrimaryKey(), updateFunction)
 
-func (db *Db) deleteQuery(q sql.DeleteQuery) {
-	fmt.Println("Not yet implemented")
+	return updated, nil
 }
 
-func serialise(data map[string]sql.Val) []byte {
-	serialised := new(bytes.Buffer)
-	e := gob.NewEncoder(serialised)
-
-	e.Encode(data)
+// checkNotNull returns a *ConstraintError if a record has no value for a NOT
+// NULL field of its table.
+func checkNotNull(table schema.Table, data map[string]sql.Val) error {
+	for _, f := range table.Fields {
+		if _, ok := data[f.Name]; f.NotNull && !ok {
+			return &ConstraintError{table.Name, f.Name, "cannot be NULL"}
+		}
+	}
 
-	return serialised.Bytes()
+	return nil
 }
 
-func deserialise(data []byte) map[string]sql.Val {
-	serialised := bytes.NewReader(data)
-	d := gob.NewDecoder(serialised)
-	deserialised := make(map[string]sql.Val)
-	err := d.Decode(&deserialised)
-	if err != nil {
-		panic(err)
+// deleteQuery deletes all records satisfying the query's WHERE clause, and
+// returns the number of records deleted.
+func (db *Db) deleteQuery(q sql.DeleteQuery) (int, error) {
+	t := db.tables[q.Table]
+	primaryKey := db.schema.GetTable(q.Table).GetPrimaryKey()
+
+	// Collect keys first, since the tree cannot be modified while it is scanned
+	keys := t.keysWhere(q.Where, primaryKey)
+	for i, key := range keys {
+		if !t.store.Delete(key) {
+			return i, &StorageError{q.Table, "delete", fmt.Errorf("record %d not found", key)}
+		}
 	}
 
-	return deserialised
+	return len(keys), nil
 }
 
-func deserialisePlural(data map[int][]byte, primary string) []map[string]sql.Val {
-	result := make([]map[string]sql.Val, 0, len(data))
+// matches returns a store predicate which is true for records of the table
+// satisfying the given WHERE clause.
+func (t *tab) matches(where sql.WhereClause, primary string) func(int, []byte) bool {
+	if len(where.Filters) == 0 {
+		return func(int, []byte) bool {
+			return true
+		}
+	}
 
-	for primaryKey, val := range data {
-		deserialised := deserialise(val)
-		deserialised[primary] = sql.Val{true, primaryKey, ""}
+	return func(primaryKey int, val []byte) bool {
+		record := t.decode(val)
+		record[primary] = sql.Val{IsNum: true, Num: primaryKey}
 
-		result = append(result, deserialised)
+		return where.Eval(record)
 	}
-
-	return result
 }
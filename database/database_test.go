@@ -1,20 +1,2106 @@
 package database
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/alexbostock/alder/schema"
 	"github.com/alexbostock/alder/sql"
+	"github.com/alexbostock/alder/store"
 )
 
 func TestSerialize(t *testing.T) {
-	data := make(map[string]sql.Val)
+	fields := schema.Table{Name: "order", Fields: []schema.Field{
+		{Name: "id", Type: schema.PrimaryKey},
+		{Name: "items", Type: schema.String},
+		{Name: "price", Type: schema.Int},
+		{Name: "user_id", Type: schema.Int},
+	}}
+	table := newTab(4, fields.Fields)
 
-	data["items"] = sql.Val{IsNum: false, Str: "apples"}
-	data["price"] = sql.Val{IsNum: true, Num: 100}
-	data["user_id"] = sql.Val{IsNum: true, Num: 5}
+	records := []map[string]sql.Val{
+		{"items": {Str: "apples"}, "price": {IsNum: true, Num: 100}, "user_id": {IsNum: true, Num: 5}},
+		{"items": {Str: ""}, "price": {IsNum: true, Num: -1 << 40}},
+		{"items": {Str: "päron"}},
+		{},
+	}
+	for _, data := range records {
+		if record := table.decode(table.encode(data)); !reflect.DeepEqual(record, data) {
+			t.Errorf("Expected %v, got %v", data, record)
+		}
+	}
+
+	// Records written before an alteration are migrated when they are read
+	old := table.encode(records[0])
+	for _, a := range []sql.Alteration{
+		{Type: sql.DropColumn, Field: schema.Field{Name: "items", Type: schema.String}},
+		{Type: sql.RenameColumn, Field: schema.Field{Name: "price", Type: schema.Int}, NewName: "cost"},
+		{Type: sql.AddColumn, Field: schema.Field{Name: "note", Type: schema.String, NotNull: true}},
+		{Type: sql.AddColumn, Field: schema.Field{Name: "rating", Type: schema.Int}},
+	} {
+		fields = a.Apply(fields)
+		table.history = append(table.history, a)
+		table.layouts = append(table.layouts, layout(fields.Fields))
+	}
+	expected := map[string]sql.Val{
+		"cost":    {IsNum: true, Num: 100},
+		"user_id": {IsNum: true, Num: 5},
+		"note":    {},
+	}
+	if record := table.decode(old); !reflect.DeepEqual(record, expected) {
+		t.Errorf("Incorrect migrated record %v", record)
+	}
+
+	// Truncated records are reported by panicking with a *StorageError
+	defer func() {
+		if _, ok := recover().(*StorageError); !ok {
+			t.Error("Expected a *StorageError decoding a truncated record")
+		}
+	}()
+	table.decode(old[:len(old)-1])
+}
+
+func TestWhere(t *testing.T) {
+	db := testDb(t)
+
+	for _, q := range []string{
+		"insert into user (forename, surname, address) values ('alex', 'bostock', 'nope')",
+		"insert into user (forename, surname, address) values ('alex', 'horne', 'nope')",
+		"insert into user (forename, surname, address) values ('greg', 'davies', 'nope')",
+		"update user set address = 'redacted' where surname = 'horne'",
+	} {
+		db.Query(q)
+	}
+
+	tests := []struct {
+		query string
+		count int
+	}{
+		{"select * from user", 3},
+		{"select * from user where forename = 'alex'", 2},
+		{"select * from user where forename = 'alex' and surname = 'horne'", 1},
+		{"select * from user where user.id > 0", 2},
+		{"select * from user where 1 > id", 1},
+		{"select * from user where address = 'redacted'", 1},
+		{"select * from user where forename < surname", 2},
+	}
+
+	for _, test := range tests {
+		q := compile(t, db.schema, test.query).(*sql.SelectQuery)
+		if res := records(t, db, q); len(res) != test.count {
+			t.Errorf("%v: expected %v records, got %v", test.query, test.count, len(res))
+		}
+	}
+}
+
+func testDb(t *testing.T) *Db {
+	schemaFile, err := ioutil.ReadFile("../test.yaml")
+	if err != nil {
+		t.Fatal("Failed to load schema")
+	}
+
+	s, err := schema.New(schemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(4, s)
+}
+
+func compile(t *testing.T, s schema.Schema, query string) sql.Query {
+	q, err := sql.Compile(s, query)
+	if err != nil {
+		t.Fatalf("%v: %v", query, err)
+	}
+
+	return q
+}
+
+// records executes a SELECT or compound query on the current snapshot, and
+// returns the records it returns before they are converted to a Result.
+func records(t *testing.T, db *Db, q sql.Query) []map[string]sql.Val {
+	res, err := db.view(db.csn).subquery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func mustQuery(t *testing.T, db *Db, query string) *Result {
+	res, err := db.Query(query)
+	if err != nil {
+		t.Fatalf("%v: %v", query, err)
+	}
+
+	return res
+}
+
+func TestPlanAccess(t *testing.T) {
+	s, err := ioutil.ReadFile("../test.yaml")
+	if err != nil {
+		t.Fatal("Failed to load schema")
+	}
+	sch, err := schema.New(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		min, max int
+		residual int
+	}{
+		{"select * from order", minKey, maxKey, 0},
+		{"select * from order where id = 5", 5, 5, 0},
+		{"select * from order where id > 10 and id < 20", 11, 19, 0},
+		{"select * from order where 10 < id and price = 3", 11, maxKey, 1},
+		{"select * from order where id < user_id", minKey, maxKey, 1},
+	}
+
+	for _, test := range tests {
+		q := compile(t, sch, test.query).(*sql.SelectQuery)
+		path := planAccess(q.Where, "id")
+		if path.min != test.min || path.max != test.max || len(path.residual.Filters) != test.residual {
+			t.Errorf("%v: incorrect access path %+v", test.query, path)
+		}
+	}
+
+	if !planAccess(compile(t, sch, "select * from order where id > 10 and id = 4").(*sql.SelectQuery).Where, "id").empty() {
+		t.Error("Contradictory key conditions should give an empty access path")
+	}
+}
+
+func TestKeyRangeUpdate(t *testing.T) {
+	db := testDb(t)
+
+	for i := 0; i < 20; i++ {
+		db.Query("insert into order (items, price, user_id) values ('apples', 10, 1)")
+	}
+	db.Query("update order set price = 20 where id > 4 and id < 10")
+	db.Query("update order set price = 30 where id = 12")
+	db.Query("update order set price = 40 where id > 14 and id < user_id")
+	db.Query("update order set price = 50 where id > 17 and user_id = 1")
+
+	expected := map[int]int{5: 20, 6: 20, 7: 20, 8: 20, 9: 20, 12: 30, 18: 50, 19: 50}
+
+	q := compile(t, db.schema, "select id, price from order").(*sql.SelectQuery)
+	for _, record := range records(t, db, q) {
+		price, ok := expected[record["id"].Num]
+		if !ok {
+			price = 10
+		}
+		if record["price"].Num != price {
+			t.Errorf("Incorrect price %v for order %v", record["price"].Num, record["id"].Num)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db := testDb(t)
+
+	for i := 0; i < 50; i++ {
+		db.Query("insert into order (items, price, user_id) values ('pears', 5, 2)")
+	}
+	db.Query("update order set price = 7 where id > 39")
+
+	tests := []struct {
+		query     string
+		deleted   int
+		remaining int
+	}{
+		{"delete from order where id = 3", 1, 49},
+		{"delete from order where id = 3", 0, 49},
+		{"delete from order where id > 9 and id < 20", 10, 39},
+		{"delete from order where price = 7", 10, 29},
+		{"delete from order where id < user_id", 2, 27},
+		{"delete from order where 30 > id and items = 'pears'", 17, 10},
+		{"delete from order", 10, 0},
+	}
+
+	for _, test := range tests {
+		if n := mustQuery(t, db, test.query).RowsAffected; n != test.deleted {
+			t.Errorf("%v: expected %v records deleted, got %v", test.query, test.deleted, n)
+		}
+
+		all := compile(t, db.schema, "select * from order").(*sql.SelectQuery)
+		if n := len(records(t, db, all)); n != test.remaining {
+			t.Errorf("%v: expected %v records remaining, got %v", test.query, test.remaining, n)
+		}
+	}
+
+	db.Query("insert into order (items, price, user_id) values ('plums', 1, 1)")
+	q := compile(t, db.schema, "select * from order where id = 50").(*sql.SelectQuery)
+	if len(records(t, db, q)) != 1 {
+		t.Error("Insert after delete failed")
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	db := testDb(t)
+
+	for _, q := range []string{
+		"insert into user (forename, surname, address) values ('alex', 'bostock', 'nope')",
+		"insert into user (forename, surname, address) values ('alex', 'horne', 'nope')",
+		"insert into user (forename, surname, address) values ('greg', 'davies', 'nope')",
+		"insert into order (items, price, user_id) values ('apples', 5, 0)",
+		"insert into order (items, price, user_id) values ('pears', 5, 0)",
+		"insert into order (items, price, user_id) values ('plums', 5, 2)",
+	} {
+		db.Query(q)
+	}
+
+	tests := []struct {
+		query string
+		count int
+	}{
+		{"select forename from user union select surname from user", 5},
+		{"select forename from user union all select surname from user", 6},
+		{"select forename from user intersect select forename from user where id = 2", 1},
+		{"select id from user minus select user_id from order", 1},
+		{"select id from user intersect select user_id from order", 2},
+		{"select id from user minus select user_id from order union select price from order", 2},
+		{"select forename, id from user union select items, user_id from order", 6},
+		{"select * from user union select * from user", 3},
+		{"select * from user minus select * from user where id = 1", 2},
+		{"select * from user union all select id, forename, surname, address from user", 6},
+	}
+
+	for _, test := range tests {
+		q := compile(t, db.schema, test.query).(*sql.CompoundQuery)
+		if res := records(t, db, q); len(res) != test.count {
+			t.Errorf("%v: expected %v records, got %v", test.query, test.count, len(res))
+		}
+	}
+
+	q := compile(t, db.schema, "select id from user minus select user_id from order").(*sql.CompoundQuery)
+	res := records(t, db, q)
+	if len(res) != 1 || res[0]["id"].Num != 1 {
+		t.Errorf("Incorrect difference %v", res)
+	}
+
+	// ORDER BY after the last query sorts the whole result
+	q = compile(t, db.schema, "select forename from user union select surname from user where id > 0 order by forename desc").(*sql.CompoundQuery)
+	res = records(t, db, q)
+	expected := []string{"horne", "greg", "davies", "alex"}
+	if len(res) != len(expected) {
+		t.Fatalf("Expected %v records, got %v", len(expected), res)
+	}
+	for i, name := range expected {
+		if res[i]["forename"].Str != name {
+			t.Errorf("Incorrectly sorted union %v", res)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	db := testDb(t)
+
+	for _, q := range []string{
+		"insert into user (forename, surname, address) values ('alex', 'bostock', 'nope')",
+		"insert into user (forename, surname, address) values ('alex', 'horne', 'nope')",
+		"insert into user (forename, surname, address) values ('greg', 'davies', 'nope')",
+		"insert into order (items, price, user_id) values ('apples', 5, 0)",
+		"insert into order (items, price, user_id) values ('pears', 5, 0)",
+		"insert into order (items, price, user_id) values ('plums', 5, 7)",
+	} {
+		db.Query(q)
+	}
+
+	tests := []struct {
+		query    string
+		strategy joinStrategy
+		count    int
+	}{
+		{"select surname, price from order join user on user.id = order.user_id", primaryKeyJoin, 2},
+		{"select surname, price from order left join user on order.user_id = user.id", primaryKeyJoin, 3},
+		{"select surname, price from order right join user on user.id = order.user_id", primaryKeyJoin, 4},
+		{"select surname, price from order outer join user on user.id = order.user_id", primaryKeyJoin, 5},
+		{"select * from user inner join order on user.id = order.user_id", hashJoin, 2},
+		{"select * from user left join order on user.id = user_id", hashJoin, 4},
+		{"select * from user join order on user.id < order.user_id", nestedLoopJoin, 3},
+		{"select * from user join order on order.user_id > user.id where forename = 'alex'", nestedLoopJoin, 2},
+		{"select items from order join user on user.id = order.user_id where order.id > 0", primaryKeyJoin, 1},
+	}
+
+	for _, test := range tests {
+		q := compile(t, db.schema, test.query).(*sql.SelectQuery)
+		if s := db.joinStrategy(q.Joins[0]); s != test.strategy {
+			t.Errorf("%v: expected join strategy %v, got %v", test.query, test.strategy, s)
+		}
+		if res := records(t, db, q); len(res) != test.count {
+			t.Errorf("%v: expected %v records, got %v", test.query, test.count, len(res))
+		}
+	}
+
+	q := compile(t, db.schema, "select surname, items from user join order on user.id = order.user_id where items = 'pears'").(*sql.SelectQuery)
+	res := records(t, db, q)
+	expected := []map[string]sql.Val{{
+		"user.surname": sql.Val{Str: "bostock"},
+		"order.items":  sql.Val{Str: "pears"},
+	}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Incorrect join result %v", res)
+	}
+
+	for _, query := range []string{
+		"select * from user join order on user.forename = order.price",
+		"select id from user join order on user.id = order.user_id",
+		"select * from user join order on user.id = user.id",
+		"select * from user join user on user.id = user.id",
+	} {
+		if !compileFails(db.schema, query) {
+			t.Errorf("%v: expected a semantic error", query)
+		}
+	}
+}
+
+func compileFails(s schema.Schema, query string) bool {
+	_, err := sql.Compile(s, query)
+	return err != nil
+}
+
+func TestOrderBy(t *testing.T) {
+	db := testDb(t)
+
+	for _, q := range []string{
+		"insert into user (forename, surname, address) values ('alex', 'bostock', 'nope')",
+		"insert into user (forename, surname, address) values ('alex', 'horne', 'nope')",
+		"insert into user (forename, surname, address) values ('greg', 'davies', 'nope')",
+		"insert into order (items, price, user_id) values ('apples', 5, 1)",
+		"insert into order (items, price, user_id) values ('pears', 3, 0)",
+		"insert into order (items, price, user_id) values ('plums', 5, 2)",
+		"insert into order (items, price, user_id) values ('kiwis', 8, 0)",
+	} {
+		db.Query(q)
+	}
+
+	tests := []struct {
+		query    string
+		key      string
+		expected []sql.Val
+	}{
+		{"select * from order", "id", ints(0, 1, 2, 3)},
+		{"select * from order order by id desc", "id", ints(3, 2, 1, 0)},
+		{"select * from order order by price", "id", ints(1, 0, 2, 3)},
+		{"select * from order order by price desc, items", "id", ints(3, 0, 2, 1)},
+		{"select * from order order by price desc, items desc", "id", ints(3, 2, 0, 1)},
+		{"select items from order where price > 3 order by items asc", "items", strs("apples", "kiwis", "plums")},
+		{"select items, surname from order join user on user.id = order.user_id order by user.surname desc, order.price", "order.items",
+			strs("apples", "plums", "pears", "kiwis")},
+		{"select surname from user join order on user.id = order.user_id order by user.id desc, order.id", "user.surname",
+			strs("davies", "horne", "bostock", "bostock")},
+	}
+
+	for _, budget := range []int{defaultSortMemory, 1, 500} {
+		db.SetSortMemory(budget)
+
+		for _, test := range tests {
+			q := compile(t, db.schema, test.query).(*sql.SelectQuery)
+			res := records(t, db, q)
+
+			vals := make([]sql.Val, len(res))
+			for i, record := range res {
+				vals[i] = record[test.key]
+			}
+			if !reflect.DeepEqual(vals, test.expected) {
+				t.Errorf("%v: incorrect order %v with sort memory %v", test.query, vals, budget)
+			}
+		}
+	}
+}
+
+func TestExternalSort(t *testing.T) {
+	s := newSorter([]sql.SortKey{{Key: "a"}, {Key: "b", Descending: true}}, 1000)
+
+	for i := 0; i < 1000; i++ {
+		s.add(map[string]sql.Val{
+			"a": sql.Val{IsNum: true, Num: (i * 7919) % 100},
+			"b": sql.Val{Str: string(rune('a' + i%26))},
+		})
+	}
+
+	if len(s.runs) < 2 {
+		t.Errorf("Expected sort to spill to several runs, got %v", len(s.runs))
+	}
+
+	defer s.close()
+	if err := s.sort(); err != nil {
+		t.Fatal(err)
+	}
+
+	var prev map[string]sql.Val
+	count := 0
+	for {
+		record, err := s.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record == nil {
+			break
+		}
+
+		if prev != nil && compareRecords(prev, record, s.keys) > 0 {
+			t.Errorf("Records out of order: %v before %v", prev, record)
+		}
+		prev = record
+		count++
+	}
+	if count != 1000 {
+		t.Errorf("Expected 1000 sorted records, got %v", count)
+	}
+}
+
+func ints(xs ...int) []sql.Val {
+	vals := make([]sql.Val, len(xs))
+	for i, x := range xs {
+		vals[i] = sql.Val{IsNum: true, Num: x}
+	}
+	return vals
+}
+
+func strs(xs ...string) []sql.Val {
+	vals := make([]sql.Val, len(xs))
+	for i, x := range xs {
+		vals[i] = sql.Val{Str: x}
+	}
+	return vals
+}
+
+func TestQueryResult(t *testing.T) {
+	db := testDb(t)
+
+	res := mustQuery(t, db, "insert into user (forename, surname, address) values ('alex', 'bostock', 'nope'), ('greg', 'davies', 'nope')")
+	if res.RowsAffected != 2 || res.LastInsertId != 1 || res.Columns != nil {
+		t.Errorf("Incorrect insert result %+v", res)
+	}
+	db.Query("insert into order (items, price, user_id) values ('apples', 5, 1)")
+
+	res = mustQuery(t, db, "update user set address = 'redacted' where forename = 'greg'")
+	if res.RowsAffected != 1 || res.LastInsertId != -1 {
+		t.Errorf("Incorrect update result %+v", res)
+	}
+
+	res = mustQuery(t, db, "select * from user order by id desc")
+	expected := &Result{
+		Columns: []Column{
+			{"id", schema.PrimaryKey},
+			{"forename", schema.String},
+			{"surname", schema.String},
+			{"address", schema.String},
+		},
+		Rows: [][]sql.Val{
+			{sql.Val{IsNum: true, Num: 1}, sql.Val{Str: "greg"}, sql.Val{Str: "davies"}, sql.Val{Str: "redacted"}},
+			{sql.Val{IsNum: true, Num: 0}, sql.Val{Str: "alex"}, sql.Val{Str: "bostock"}, sql.Val{Str: "nope"}},
+		},
+		LastInsertId: -1,
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Incorrect select result %+v", res)
+	}
+
+	res = mustQuery(t, db, "select price, surname from order join user on user.id = order.user_id")
+	expected = &Result{
+		Columns: []Column{{"order.price", schema.Int}, {"user.surname", schema.String}},
+		Rows:    [][]sql.Val{{sql.Val{IsNum: true, Num: 5}, sql.Val{Str: "davies"}}},
+
+		LastInsertId: -1,
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Incorrect join result %+v", res)
+	}
+
+	res = mustQuery(t, db, "select surname from user union select items from order")
+	if len(res.Columns) != 1 || res.Columns[0].Name != "surname" || len(res.Rows) != 3 {
+		t.Errorf("Incorrect compound query result %+v", res)
+	}
+
+	res = mustQuery(t, db, "delete from user")
+	if res.RowsAffected != 2 {
+		t.Errorf("Incorrect delete result %+v", res)
+	}
+}
+
+func TestNull(t *testing.T) {
+	db := testDb(t)
+	null := sql.Val{Null: true}
+
+	mustQuery(t, db, "insert into order (items, price) values ('apples', 100), (null, 50), ('pears', 20)")
+	mustQuery(t, db, "update order set user_id = 3 where price < 60")
+
+	tests := []struct {
+		query string
+		rows  [][]sql.Val
+	}{
+		{"select items, user_id from order where id = 0", [][]sql.Val{{{Str: "apples"}, null}}},
+		{"select price from order where items is null", [][]sql.Val{ints(50)}},
+		{"select price from order where user_id is not null and items is not null", [][]sql.Val{ints(20)}},
+		{"select price from order where user_id = null", [][]sql.Val{}},
+		{"select price from order where id = null", [][]sql.Val{}},
+		{"select price from order where items = 'pears' and user_id > 1", [][]sql.Val{ints(20)}},
+		{"select items from order order by items", [][]sql.Val{{null}, strs("apples"), strs("pears")}},
+		{"select items from order order by items desc", [][]sql.Val{strs("pears"), strs("apples"), {null}}},
+		{"select user_id from order union select user_id from order", [][]sql.Val{{null}, ints(3)}},
+		{"select price from order where not (user_id = null)", [][]sql.Val{}},
+		{"select price from order where not (user_id = 3)", [][]sql.Val{}},
+		{"select price from order where not user_id < 3", [][]sql.Val{ints(50), ints(20)}},
+		{"select price from order where not items is null", [][]sql.Val{ints(100), ints(20)}},
+		{"select price from order where not (id = 1)", [][]sql.Val{ints(100), ints(20)}},
+		{"select price from order where not not items = 'pears'", [][]sql.Val{ints(20)}},
+	}
+
+	for _, test := range tests {
+		res := mustQuery(t, db, test.query)
+		if !reflect.DeepEqual(res.Rows, test.rows) {
+			t.Errorf("%v: expected %v, got %v", test.query, test.rows, res.Rows)
+		}
+	}
+
+	// A field is set to NULL by a literal or a nil argument
+	mustQuery(t, db, "update order set items = null where id = 0")
+	st, err := db.Prepare("update order set user_id = ? where id = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Query(nil, 2); err != nil {
+		t.Fatal(err)
+	}
+	if res := mustQuery(t, db, "select items, user_id from order where id = 0 and user_id is null"); !reflect.DeepEqual(res.Rows, [][]sql.Val{{null, null}}) {
+		t.Errorf("Incorrect rows %v", res.Rows)
+	}
+	if res := mustQuery(t, db, "select price from order where user_id is null"); len(res.Rows) != 2 {
+		t.Errorf("Incorrect rows %v", res.Rows)
+	}
+
+	mustQuery(t, db, "create table item (id primary key, name string not null, note string)")
+	for _, query := range []string{
+		"insert into item (note) values ('fig')",
+		"insert into item (name) values (null)",
+		"update item set name = null",
+	} {
+		if _, err := db.Query(query); err == nil {
+			t.Errorf("%v: expected a constraint error", query)
+		} else if e, ok := err.(*ConstraintError); !ok || e.Key != "name" {
+			t.Errorf("%v: expected a constraint error on item.name, got %v", query, err)
+		}
+	}
+	mustQuery(t, db, "insert into item (name, note) values ('fig', null)")
+}
+
+func TestAggregates(t *testing.T) {
+	db := testDb(t)
+	null := sql.Val{Null: true}
+
+	mustQuery(t, db, "insert into order (items, price, user_id) values ('apples', 100, 1), ('pears', 20, 1), ('figs', 45, 2), (null, 7, 2)")
+	mustQuery(t, db, "insert into order (items, user_id) values ('plums', 3)")
+	mustQuery(t, db, "insert into user (forename, surname) values ('alex', 'bostock'), ('alex', 'horne'), ('greg', 'davies')")
+
+	tests := []struct {
+		query string
+		rows  [][]sql.Val
+	}{
+		{"select count(*), count(items), count(price) from order", [][]sql.Val{ints(5, 4, 4)}},
+		{"select sum(price), avg(price), min(price), max(items) from order", [][]sql.Val{append(ints(172, 43, 7), sql.Val{Str: "plums"})}},
+		{"select user_id, sum(price), avg(price) from order group by user_id", [][]sql.Val{ints(1, 120, 60), ints(2, 52, 26), append(ints(3), null, null)}},
+		{"select user_id, count(*) from order group by user_id having count(*) > 1 order by user_id desc", [][]sql.Val{ints(2, 2), ints(1, 2)}},
+		{"select user_id from order group by user_id order by max(price)", [][]sql.Val{ints(3), ints(2), ints(1)}},
+		{"select min(items) from order group by user_id having sum(price) is null", [][]sql.Val{strs("plums")}},
+		{"select count(*), sum(price) from order where price > 1000", [][]sql.Val{append(ints(0), null)}},
+		{"select user_id, count(*) from order where price > 1000 group by user_id", [][]sql.Val{}},
+		{"select items, count(*) from order group by items having items is null", [][]sql.Val{{null, sql.Val{IsNum: true, Num: 1}}}},
+		{"select user.surname, count(order.id) from user join order on user.id = order.user_id group by user.surname", [][]sql.Val{{sql.Val{Str: "davies"}, sql.Val{IsNum: true, Num: 2}}, {sql.Val{Str: "horne"}, sql.Val{IsNum: true, Num: 2}}}},
+	}
+
+	for _, test := range tests {
+		res := mustQuery(t, db, test.query)
+		if !reflect.DeepEqual(res.Rows, test.rows) {
+			t.Errorf("%v: expected %v, got %v", test.query, test.rows, res.Rows)
+		}
+	}
+
+	res := mustQuery(t, db, "select user_id, max(items) from order group by user_id")
+	if !reflect.DeepEqual(res.Columns, []Column{{"user_id", schema.Int}, {"max(items)", schema.String}}) {
+		t.Errorf("Incorrect columns %v", res.Columns)
+	}
+
+	// Aggregations with more groups than fit in memory spill partial groups
+	for i := 0; i < 500; i++ {
+		mustQuery(t, db, "insert into order (price, user_id) values ("+strconv.Itoa(i)+", "+strconv.Itoa(i%100+10)+")")
+	}
+	for _, budget := range []int{defaultSortMemory, 1, 2000} {
+		db.SetSortMemory(budget)
+
+		res := mustQuery(t, db, "select user_id, count(*), sum(price) from order where user_id > 9 group by user_id")
+		if len(res.Rows) != 100 {
+			t.Fatalf("Expected 100 groups with sort memory %v, got %v", budget, len(res.Rows))
+		}
+		for i, row := range res.Rows {
+			if expected := ints(i+10, 5, 5*i+1000); !reflect.DeepEqual(row, expected) {
+				t.Errorf("Expected group %v with sort memory %v, got %v", expected, budget, row)
+			}
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	db := testDb(t)
+
+	for i := 0; i < 20; i++ {
+		mustQuery(t, db, "insert into order (price, user_id) values ("+strconv.Itoa(i)+", "+strconv.Itoa(i%3)+")")
+	}
+
+	tests := []struct {
+		query string
+		rows  [][]sql.Val
+	}{
+		{"select price from order limit 3", [][]sql.Val{ints(0), ints(1), ints(2)}},
+		{"select price from order limit 2 offset 5", [][]sql.Val{ints(5), ints(6)}},
+		{"select price from order where price > 16 offset 1", [][]sql.Val{ints(18), ints(19)}},
+		{"select price from order order by id desc limit 2", [][]sql.Val{ints(19), ints(18)}},
+		{"select price from order order by price desc limit 2 offset 1", [][]sql.Val{ints(18), ints(17)}},
+		{"select price from order where user_id = 1 limit 3", [][]sql.Val{ints(1), ints(4), ints(7)}},
+		{"select price from order limit 0", [][]sql.Val{}},
+		{"select price from order offset 30", [][]sql.Val{}},
+		{"select price from order where id > 10 limit null offset null", [][]sql.Val{ints(11), ints(12), ints(13), ints(14), ints(15), ints(16), ints(17), ints(18), ints(19)}},
+		{"select user_id, count(*) from order group by user_id limit 1 offset 1", [][]sql.Val{ints(1, 7)}},
+		{"select price from order where id > 17 union all select price from order where id < 3 limit 3", [][]sql.Val{ints(18), ints(19), ints(0)}},
+		{"select price from order where id < 3 union select price from order where id > 17 order by price desc limit 2 offset 1", [][]sql.Val{ints(18), ints(2)}},
+	}
+
+	for _, test := range tests {
+		res := mustQuery(t, db, test.query)
+		if !reflect.DeepEqual(res.Rows, test.rows) {
+			t.Errorf("%v: expected %v, got %v", test.query, test.rows, res.Rows)
+		}
+	}
+
+	// Negative counts bound to parameters mean no limit, and no offset
+	res, err := db.Query("select price from order where id > 15 limit ? offset ?", -1, -5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]sql.Val{ints(16), ints(17), ints(18), ints(19)}; !reflect.DeepEqual(res.Rows, expected) {
+		t.Errorf("Expected %v, got %v", expected, res.Rows)
+	}
+
+	// LIMIT after the last query of a set operation bounds the whole result
+	res, err = db.Query("select price from order where id < 2 union all select price from order where id > 17 limit ?", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]sql.Val{ints(0), ints(1), ints(18)}; !reflect.DeepEqual(res.Rows, expected) {
+		t.Errorf("Expected %v, got %v", expected, res.Rows)
+	}
+
+	// Scans in primary key order stop once the limit is reached, reading
+	// batches of 1, 2 and 4 records
+	tx := db.Begin()
+	defer tx.Rollback()
+	scanned := 0
+	view := tx.view.tables["order"]
+	view.store = countingStore{view.store, &scanned}
+	if _, err := tx.Query("select price from order where user_id = 2 limit 2"); err != nil {
+		t.Fatal(err)
+	}
+	if scanned != 7 {
+		t.Errorf("Expected the scan to stop after 7 records, read %v", scanned)
+	}
+}
+
+// A countingStore counts the records read by scans of a store.
+type countingStore struct {
+	store.Store
+	n *int
+}
+
+func (s countingStore) Scan(minKey, maxKey int, f func(int, []byte) bool) {
+	s.Store.Scan(minKey, maxKey, func(key int, val []byte) bool {
+		*s.n++
+		return f(key, val)
+	})
+}
+
+func TestStreaming(t *testing.T) {
+	db := testDb(t)
+
+	mustQuery(t, db, "insert into user (surname) values ('a')")
+	for i := 0; i < 300; i++ {
+		mustQuery(t, db, "insert into order (price, user_id) values ("+strconv.Itoa(i)+", 0)")
+	}
+
+	// Scans read every record, across batches
+	res := mustQuery(t, db, "select price from order where id > 10 and id < 290")
+	if len(res.Rows) != 279 {
+		t.Fatalf("Expected 279 records, got %v", len(res.Rows))
+	}
+	for i, row := range res.Rows {
+		if !reflect.DeepEqual(row, ints(i+11)) {
+			t.Errorf("Expected %v, got %v", ints(i+11), row)
+		}
+	}
+
+	// Joins read only the records of the left table they need
+	tx := db.Begin()
+	defer tx.Rollback()
+	scanned := 0
+	view := tx.view.tables["order"]
+	view.store = countingStore{view.store, &scanned}
+	res, err := tx.Query("select order.price, user.surname from order join user on order.user_id = user.id limit 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]sql.Val{
+		{sql.Val{IsNum: true, Num: 0}, sql.Val{Str: "a"}},
+		{sql.Val{IsNum: true, Num: 1}, sql.Val{Str: "a"}},
+		{sql.Val{IsNum: true, Num: 2}, sql.Val{Str: "a"}},
+	}; !reflect.DeepEqual(res.Rows, expected) {
+		t.Errorf("Expected %v, got %v", expected, res.Rows)
+	}
+	if scanned != 3 {
+		t.Errorf("Expected the scan to stop after 3 records, read %v", scanned)
+	}
+}
+
+func TestPage(t *testing.T) {
+	db := testDb(t)
+
+	for i := 0; i < 10; i++ {
+		mustQuery(t, db, "insert into order (price) values ("+strconv.Itoa(i)+")")
+	}
+
+	var prices []int
+	token := ""
+	for pages := 0; ; pages++ {
+		p, err := db.Page("order", 4, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pages == 0 && !reflect.DeepEqual(p.Columns[:2], []Column{{"id", schema.PrimaryKey}, {"items", schema.String}}) {
+			t.Errorf("Incorrect columns %v", p.Columns)
+		}
+		for _, row := range p.Rows {
+			prices = append(prices, row[2].Num)
+		}
+
+		// Records inserted or deleted between pages do not cause others to be
+		// skipped or repeated
+		if pages == 0 {
+			mustQuery(t, db, "delete from order where id < 2")
+			mustQuery(t, db, "insert into order (price) values (10)")
+		}
+
+		if p.Next == "" {
+			if pages != 2 {
+				t.Errorf("Expected 3 pages, got %v", pages+1)
+			}
+			break
+		}
+		token = p.Next
+	}
+
+	if expected := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}; !reflect.DeepEqual(prices, expected) {
+		t.Errorf("Expected prices %v, got %v", expected, prices)
+	}
+
+	// The last page is empty if the table has a multiple of the page size
+	p, err := db.Page("order", 3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = db.Page("order", 6, p.Next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Rows) != 6 || p.Next != "" {
+		t.Errorf("Expected a last page of 6 records, got %v with token %q", len(p.Rows), p.Next)
+	}
+
+	for _, test := range []struct {
+		table string
+		size  int
+		token string
+	}{
+		{"order", 0, ""},
+		{"orders", 4, ""},
+		{"order", 4, "nonsense"},
+		{"user", 4, encodeToken("order", 3)},
+	} {
+		if _, err := db.Page(test.table, test.size, test.token); err == nil {
+			t.Errorf("Page(%q, %v, %q): expected an error", test.table, test.size, test.token)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	db := testDb(t)
+
+	mustQuery(t, db, "insert into user (forename, surname) values ('alex', 'bostock'), ('alex', 'horne')")
+	mustQuery(t, db, "insert into order (items, price, user_id) values ('apples', 100, 1), ('pears', 20, 0), ('figs', 45, 1)")
+
+	tests := []struct {
+		query string
+		plan  []string
+	}{
+		{"explain select * from order", []string{"Scan order"}},
+		{"explain select items from order where id = 2", []string{
+			"Project items",
+			"  Get order WHERE id = 2",
+		}},
+		{"explain select * from order where id > 0 and id < 5 and price > 30 order by id desc", []string{
+			"Reverse",
+			"  Filter price > 30",
+			"    GetRange order WHERE id > 0 AND id < 5",
+		}},
+		{"explain select * from order where id < 0 and id > 5", []string{"Empty order"}},
+		{"explain select user_id, sum(price) from order group by user_id having count(*) > 1 order by sum(price) limit 5 offset 1", []string{
+			"Project user_id, sum(price)",
+			"  Limit 5, Offset 1",
+			"    Sort sum(price)",
+			"      Filter count(*) > 1",
+			"        Hash aggregate by user_id: sum(price), count(*)",
+			"          Scan order",
+		}},
+		{"explain select surname from order left join user on order.user_id = user.id where price is null", []string{
+			"Project user.surname",
+			"  Filter order.price IS NULL",
+			"    Primary key left join user ON order.user_id = user.id",
+			"      Scan order",
+			"      Get user",
+		}},
+		{"explain select surname from order join user on order.items = user.surname", []string{
+			"Project user.surname",
+			"  Hash join user ON order.items = user.surname",
+			"    Scan order",
+			"    Scan user",
+		}},
+		{"explain select price from order where items = 'figs' union all select id from user where forename > 'b'", []string{
+			"Union all",
+			"  Project price",
+			"    Filter items = 'figs'",
+			"      Scan order",
+			"  Project id",
+			"    Filter forename > 'b'",
+			"      Scan user",
+		}},
+	}
+
+	for _, test := range tests {
+		res := mustQuery(t, db, test.query)
+
+		var plan []string
+		for _, row := range res.Rows {
+			plan = append(plan, row[0].Str)
+		}
+		if !reflect.DeepEqual(plan, test.plan) {
+			t.Errorf("%v: expected plan %q, got %q", test.query, test.plan, plan)
+		}
+	}
+
+	// EXPLAIN ANALYZE reports the records produced by each step
+	res := mustQuery(t, db, "explain analyze select surname, order.price from order join user on order.user_id = user.id where order.price > 30 order by order.price")
+	expected := []string{
+		"Project user.surname, order.price  (rows=2",
+		"  Sort order.price  (rows=2",
+		"    Filter order.price > 30  (rows=2",
+		"      Primary key join user ON order.user_id = user.id  (rows=3",
+		"        Scan order  (rows=3",
+		"        Get user  (rows=3",
+	}
+	if len(res.Rows) != len(expected) {
+		t.Fatalf("Expected %v steps, got %v", len(expected), res.Rows)
+	}
+	for i, row := range res.Rows {
+		if !strings.HasPrefix(row[0].Str, expected[i]+" time=") {
+			t.Errorf("Expected step %q, got %q", expected[i], row[0].Str)
+		}
+	}
+
+	// Scans stop once enough records have been found
+	res = mustQuery(t, db, "explain analyze select * from order limit 1 offset 1")
+	if res.Rows[1][0].Str[:len("  Scan order  (rows=2 ")] != "  Scan order  (rows=2 " {
+		t.Errorf("Expected the scan to read 2 records, got %q", res.Rows[1][0].Str)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alder-analyze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, 4, testDb(t).schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustQuery(t, db, "insert into user (forename, surname, address) values ('alex', 'bostock', 'nope'), ('alex', 'horne', 'nope'), ('greg', 'davies', null)")
+	mustQuery(t, db, "insert into order (items, price, user_id) values ('apples', 100, 1), ('pears', 20, 0), ('figs', 45, 1), ('kiwi', 5, 2), ('plums', 7, 2), ('limes', null, 9)")
+
+	// Without statistics, there are no estimates, and tables are joined in
+	// the order written
+	join := "explain select surname, items from order join user on order.user_id = user.id where user.id = 2"
+	expectPlan(t, db, join,
+		"Project user.surname, order.items",
+		"  Filter user.id = 2",
+		"    Primary key join user ON order.user_id = user.id",
+		"      Scan order",
+		"      Get user",
+	)
+
+	mustQuery(t, db, "analyze")
+
+	stats := db.statistics()
+	if stats["order"].Rows != 6 || stats["user"].Rows != 3 {
+		t.Errorf("Incorrect row counts %v and %v", stats["order"].Rows, stats["user"].Rows)
+	}
+	price := stats["order"].Fields["price"]
+	if price.Nulls != 1 || price.Distinct != 5 || !reflect.DeepEqual(price.Bounds, ints(5, 7, 20, 45, 100)) {
+		t.Errorf("Incorrect statistics of price %+v", price)
+	}
+	if forename := stats["user"].Fields["forename"]; forename.Distinct != 2 || forename.Nulls != 0 {
+		t.Errorf("Incorrect statistics of forename %+v", forename)
+	}
+	if address := stats["user"].Fields["address"]; address.Distinct != 1 || address.Nulls != 1 {
+		t.Errorf("Incorrect statistics of address %+v", address)
+	}
+	if id := stats["order"].Fields["id"]; id.Distinct != 6 || !reflect.DeepEqual(id.Bounds, ints(0, 1, 2, 3, 4, 5)) {
+		t.Errorf("Incorrect statistics of id %+v", id)
+	}
+
+	expectPlan(t, db, "explain select * from order where price < 20",
+		"Filter price < 20  (estimate=2)",
+		"  Scan order  (estimate=6)",
+	)
+	expectPlan(t, db, "explain select * from order where id > 3 and items is null",
+		"Filter items IS NULL  (estimate=0)",
+		"  GetRange order WHERE id > 3  (estimate=2)",
+	)
+	expectPlan(t, db, "explain select user_id, count(*) from order group by user_id limit 3",
+		"Project user_id, count(*)  (estimate=3)",
+		"  Limit 3  (estimate=3)",
+		"    Hash aggregate by user_id: count(*)  (estimate=4)",
+		"      Scan order  (estimate=6)",
+	)
+
+	// Reading the one user first is cheaper than scanning the orders
+	expectPlan(t, db, join,
+		"Project user.surname, order.items  (estimate=2)",
+		"  Hash join order ON user.id = order.user_id  (estimate=2)",
+		"    Get user WHERE id = 2  (estimate=1)",
+		"    Scan order  (estimate=6)",
+	)
+	res := mustQuery(t, db, join[len("explain "):])
+	if expected := [][]sql.Val{strs("davies", "kiwi"), strs("davies", "plums")}; !reflect.DeepEqual(res.Rows, expected) {
+		t.Errorf("Expected %v, got %v", expected, res.Rows)
+	}
+
+	// Outer joins are not reordered
+	expectPlan(t, db, "explain select surname, items from order left join user on order.user_id = user.id where user.id = 2",
+		"Project user.surname, order.items  (estimate=2)",
+		"  Filter user.id = 2  (estimate=2)",
+		"    Primary key left join user ON order.user_id = user.id  (estimate=6)",
+		"      Scan order  (estimate=6)",
+		"      Get user  (estimate=6)",
+	)
+
+	// Analyzing one table keeps the statistics of the others
+	mustQuery(t, db, "insert into user (forename, surname) values ('ed', 'gamble')")
+	mustQuery(t, db, "insert into order (items, price, user_id) values ('dates', 3, 3)")
+	mustQuery(t, db, "analyze user")
+	if stats := db.statistics(); stats["order"].Rows != 6 || stats["user"].Rows != 4 {
+		t.Errorf("Expected 6 orders and 4 users, got %v and %v", stats["order"].Rows, stats["user"].Rows)
+	}
+
+	// Statistics are kept in the catalog
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, 4, schema.Schema{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.statistics(); stats["order"] == nil || stats["order"].Fields["price"].Distinct != 5 || stats["user"].Rows != 4 {
+		t.Errorf("Statistics were not restored: %v", stats)
+	}
+
+	// Changing a table discards its statistics
+	mustQuery(t, db, "alter table order add column discount int")
+	if stats := db.statistics(); stats["order"] != nil || stats["user"] == nil {
+		t.Errorf("Expected only the statistics of user, got %v", stats)
+	}
+	expectPlan(t, db, "explain select * from order", "Scan order")
+}
+
+// expectPlan checks the plan returned by an EXPLAIN query.
+func expectPlan(t *testing.T, db *Db, query string, plan ...string) {
+	t.Helper()
+
+	var lines []string
+	for _, row := range mustQuery(t, db, query).Rows {
+		lines = append(lines, row[0].Str)
+	}
+
+	if !reflect.DeepEqual(lines, plan) {
+		t.Errorf("%v: expected plan %q, got %q", query, plan, lines)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	db := testDb(t)
+
+	db.Query("insert into order (items, price, user_id) values ('apples', 5, 1)")
+
+	if _, err := db.Query("select * form order"); err == nil {
+		t.Error("Expected a syntax error")
+	} else if _, ok := err.(*sql.SyntaxError); !ok {
+		t.Errorf("Expected a syntax error, got %v", err)
+	}
+
+	if _, err := db.Query("select * from orders"); err == nil {
+		t.Error("Expected a semantic error")
+	} else if e, ok := err.(*sql.SemanticError); !ok || e.Ident != "orders" {
+		t.Errorf("Expected a semantic error for orders, got %v", err)
+	}
+
+	db.tables["order"].nextPrimaryKey = 0
+	_, err := db.Query("insert into order (items, price, user_id) values ('pears', 3, 1)")
+	if e, ok := err.(*ConstraintError); !ok || e.Table != "order" || e.Key != "id" {
+		t.Errorf("Expected a constraint error on order.id, got %v", err)
+	}
+
+	db.tables["order"].store.Insert(7, []byte("not a record"))
+	for _, query := range []string{
+		"select * from order",
+		"select * from order order by price",
+		"update order set price = 1",
+	} {
+		if _, err := db.Query(query); err == nil {
+			t.Errorf("%v: expected a storage error", query)
+		} else if _, ok := err.(*StorageError); !ok {
+			t.Errorf("%v: expected a storage error, got %v", query, err)
+		}
+	}
+}
+
+func TestPreparedStatements(t *testing.T) {
+	db := testDb(t)
+
+	insert, err := db.Prepare("insert into order (items, price, user_id) values (?, ?, 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if insert.NumParams() != 2 {
+		t.Errorf("Expected 2 parameters, got %v", insert.NumParams())
+	}
+
+	for i, items := range []string{"apples", "pears", "plums"} {
+		if _, err := insert.Query(items, 10*(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := db.Query("select items from order where price > $1 and price < $2 order by price desc", 10, int64(40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]sql.Val{strs("plums"), strs("pears")}; !reflect.DeepEqual(res.Rows, expected) {
+		t.Errorf("Expected rows %v, got %v", expected, res.Rows)
+	}
+
+	tx := db.Begin()
+	if _, err := tx.Query("update order set price = ? where items = ?", 5, "apples"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.QueryStmt(insert, "figs", 1); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	res = mustQuery(t, db, "select price from order order by price")
+	if expected := [][]sql.Val{ints(1), ints(5), ints(20), ints(30)}; !reflect.DeepEqual(res.Rows, expected) {
+		t.Errorf("Expected rows %v, got %v", expected, res.Rows)
+	}
+
+	for _, args := range [][]interface{}{
+		{"apples"},
+		{"apples", "ten"},
+		{"apples", 1.5},
+	} {
+		if _, err := insert.Query(args...); err == nil {
+			t.Errorf("%v: expected a bind error", args)
+		} else if _, ok := err.(*sql.BindError); !ok {
+			t.Errorf("%v: expected a bind error, got %v", args, err)
+		}
+	}
+}
+
+func TestPlanCache(t *testing.T) {
+	db := testDb(t)
+	db.SetCacheSize(2)
+
+	for _, query := range []string{
+		"insert into order (items, price, user_id) values ('apples', 5, 1)",
+		"INSERT INTO order (items, price, user_id)  VALUES ('pears', 10, 2)",
+		"select * from order where price > 7",
+		"select * from order where price > 3",
+	} {
+		mustQuery(t, db, query)
+	}
+
+	if stats := db.CacheStats(); stats != (CacheStats{Size: 2, Hits: 2, Misses: 2}) {
+		t.Errorf("Incorrect cache statistics %+v", stats)
+	}
+
+	// Literals which do not match the types of the cached statement
+	if _, err := db.Query("select * from order where price > 'ten'"); err == nil {
+		t.Error("Expected a type error")
+	} else if e, ok := err.(*sql.TypeError); !ok || e.Pos != 32 {
+		t.Errorf("Expected a type error at position 32, got %v", err)
+	}
+
+	// Queries whose fingerprints are invalid are compiled as written
+	if res := mustQuery(t, db, "select items from order where 1 = 1"); len(res.Rows) != 2 {
+		t.Errorf("Expected 2 rows, got %v", res.Rows)
+	}
+
+	mustQuery(t, db, "delete from order where id = 0")
+	if stats := db.CacheStats(); stats.Size != 2 || stats.Evictions != 1 {
+		t.Errorf("Incorrect cache statistics after eviction %+v", stats)
+	}
+
+	db.cache.invalidate()
+	mustQuery(t, db, "select * from order where price > 3")
+	if stats := db.CacheStats(); stats.Size != 1 || stats.Invalidations != 1 || stats.Hits != 3 {
+		t.Errorf("Incorrect cache statistics after invalidation %+v", stats)
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alder-catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, 8, testDb(t).schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustQuery(t, db, "insert into user (forename, surname, address) values ('alex', 'bostock', 'nope'), ('alex', 'horne', 'nope')")
+	mustQuery(t, db, "delete from user where id = 1")
+	if n, err := db.Vacuum(maxKey); err != nil || n != 2 {
+		t.Fatalf("Expected 2 versions to be vacuumed, got %v (%v)", n, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen without a schema, adding a table
+	extra, err := schema.New([]byte("tables:\n  - name: item\n    key: id\n    fields:\n      - name: name\n        type: string\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, 4, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := len(db.schema.Tables); names != 3 || db.schema.Tables[2].Name != "item" {
+		t.Errorf("Incorrect tables %v", db.schema.Tables)
+	}
+	if db.tables["user"].branchingFactor != 8 || db.tables["item"].branchingFactor != 4 {
+		t.Error("Branching factors were not restored")
+	}
+
+	// The primary key sequence continues after the deleted record
+	res := mustQuery(t, db, "insert into user (forename, surname, address) values ('greg', 'davies', 'nope')")
+	if res.LastInsertId != 2 {
+		t.Errorf("Expected primary key 2, got %v", res.LastInsertId)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mismatched, err := schema.New([]byte("tables:\n  - name: user\n    key: id\n    fields:\n      - name: name\n        type: string\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, 4, mismatched); err == nil {
+		t.Error("Expected an error opening with a schema which does not match the catalog")
+	} else if e, ok := err.(*schema.Error); !ok || e.Table != "user" {
+		t.Errorf("Expected a schema error for user, got %v", err)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alder-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	crashed := dir + "-crashed"
+	defer os.RemoveAll(crashed)
+
+	db, err := Open(dir, 4, testDb(t).schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustQuery(t, db, "insert into user (forename, surname, address) values ('alex', 'bostock', 'nope')")
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyDir(dir, crashed); err != nil {
+		t.Fatal(err)
+	}
+
+	mustQuery(t, db, "alter table user add column age int")
+	mustQuery(t, db, "insert into user (forename, surname, address, age) values ('greg', 'davies', 'nope', 50)")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the last generation is kept
+	if files, err := filepath.Glob(filepath.Join(dir, "checkpoint-*")); err != nil || len(files) != 1 {
+		t.Errorf("Expected one generation, got %v (%v)", files, err)
+	}
+
+	// A crash before the manifest is replaced leaves the new generation's files
+	// beside the previous checkpoint, which is still read
+	if err := copyDir(generationPath(dir, 2, ""), generationPath(crashed, 2, "")); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(crashed, 4, schema.Schema{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := mustQuery(t, db, "select * from user"); len(res.Rows) != 1 || len(res.Columns) != 4 {
+		t.Errorf("Expected the previous checkpoint, got %v %v", res.Columns, res.Rows)
+	}
+	mustQuery(t, db, "insert into user (forename, surname, address) values ('alex', 'horne', 'nope')")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(crashed, 4, schema.Schema{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := mustQuery(t, db, "select surname from user"); !reflect.DeepEqual(res.Rows, [][]sql.Val{strs("bostock"), strs("horne")}) {
+		t.Errorf("Incorrect records after recovery %v", res.Rows)
+	}
+}
+
+// copyDir copies the files in the directory src to the directory dst, which is
+// created.
+func copyDir(src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			if err := copyDir(filepath.Join(src, f.Name()), filepath.Join(dst, f.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(src, f.Name()))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dst, f.Name()), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestUpgradeRows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alder-upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A data directory written when records were gob-encoded maps, in which
+	// one record predates a column added to the table
+	cat := catalog{[]catalogTable{{
+		Name:            "item",
+		Fields:          []schema.Field{{Name: "id", Type: schema.PrimaryKey}, {Name: "name", Type: schema.String}, {Name: "stock", Type: schema.Int}},
+		NextPrimaryKey:  2,
+		BranchingFactor: 4,
+		History:         []sql.Alteration{{Type: sql.AddColumn, Field: schema.Field{Name: "stock", Type: schema.Int}}},
+	}}}
+	snap := snapshot{
+		Keys: []int{0, 1},
+		Values: [][]byte{
+			encodeChain([]version{{Csn: 1, Data: gobRow(0, map[string]sql.Val{"name": {Str: "fig"}})}}),
+			encodeChain([]version{
+				{Csn: 2, Data: gobRow(1, map[string]sql.Val{"name": {Str: "kiwi"}, "stock": {IsNum: true, Num: 7}})},
+				{Csn: 1, Data: gobRow(0, map[string]sql.Val{"name": {Str: "plum"}})},
+			}),
+		},
+	}
+	log := commitLog{Commits: []time.Time{time.Now(), time.Now()}}
+
+	for file, v := range map[string]interface{}{catalogFile: cat, "item.tab": snap, "commits": log} {
+		if err := writeFile(filepath.Join(dir, file), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := Open(dir, 4, schema.Schema{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]sql.Val{
+		{{IsNum: true, Num: 0}, {Str: "fig"}, {Null: true}},
+		{{IsNum: true, Num: 1}, {Str: "kiwi"}, {IsNum: true, Num: 7}},
+	}
+	if res := mustQuery(t, db, "select * from item"); !reflect.DeepEqual(res.Rows, expected) {
+		t.Errorf("Incorrect rows %v", res.Rows)
+	}
+	if res := mustQuery(t, db, "select name from item as of 1"); !reflect.DeepEqual(res.Rows, [][]sql.Val{strs("fig"), strs("plum")}) {
+		t.Errorf("Incorrect rows of the old snapshot %v", res.Rows)
+	}
+
+	// The records are written back in the compact form
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, 4, schema.Schema{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := db.catalog().Tables[0]; c.Format != compactRows || len(c.History) != 0 {
+		t.Errorf("Expected the table to be upgraded, got %+v", c)
+	}
+	if res := mustQuery(t, db, "select * from item"); !reflect.DeepEqual(res.Rows, expected) {
+		t.Errorf("Incorrect rows after upgrading %v", res.Rows)
+	}
+}
+
+func TestSchemaChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alder-schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, 4, schema.Schema{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustQuery(t, db, "create table item (name string, id primary key, price int)")
+	insert, err := db.Prepare("insert into item (name, price) values (?, ?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insert.Query("fig", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	res := mustQuery(t, db, "select * from item")
+	expected := []Column{{"id", schema.PrimaryKey}, {"name", schema.String}, {"price", schema.Int}}
+	if !reflect.DeepEqual(res.Columns, expected) || len(res.Rows) != 1 {
+		t.Errorf("Incorrect result %+v", res)
+	}
+
+	if _, err := db.Query("create table item (id primary key)"); err == nil {
+		t.Error("Expected an error creating a table which exists")
+	}
+
+	tx := db.Begin()
+	if _, err := tx.Query("drop table item"); err != ErrSchemaInTransaction {
+		t.Errorf("Expected ErrSchemaInTransaction, got %v", err)
+	}
+	tx.Query("insert into item (name, price) values ('plum', 2)")
+
+	mustQuery(t, db, "drop table item")
+	if err := tx.Commit(); err != ErrSchemaChanged {
+		t.Errorf("Expected ErrSchemaChanged, got %v", err)
+	}
+
+	// Prepared statements are compiled again against the new schema
+	if _, err := insert.Query("fig", 3); err == nil {
+		t.Error("Expected an error inserting into a dropped table")
+	} else if e, ok := err.(*sql.SemanticError); !ok || e.Ident != "item" {
+		t.Errorf("Expected a semantic error for item, got %v", err)
+	}
+	mustQuery(t, db, "create table item (id primary key, name string, price int)")
+	if _, err := insert.Query("fig", 3); err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.CacheStats(); stats.Invalidations != 3 {
+		t.Errorf("Expected 3 cache invalidations, got %+v", stats)
+	}
+
+	mustQuery(t, db, "create table other (id primary key)")
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	mustQuery(t, db, "drop table other")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if files, err := filepath.Glob(filepath.Join(dir, "*", "other.tab")); err != nil || len(files) != 0 {
+		t.Errorf("Expected the file of a dropped table to be removed, got %v (%v)", files, err)
+	}
+
+	db, err = Open(dir, 4, schema.Schema{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := mustQuery(t, db, "select name from item"); !reflect.DeepEqual(res.Rows, [][]sql.Val{strs("fig")}) {
+		t.Errorf("Incorrect rows after reopening %v", res.Rows)
+	}
+}
+
+func TestAlterTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alder-alter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, 4, schema.Schema{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustQuery(t, db, "create table item (id primary key, name string, price int)")
+	mustQuery(t, db, "insert into item (name, price) values ('fig', 3), ('plum', 2)")
+	tx := db.Begin()
+	tx.Query("insert into item (name, price) values ('pear', 4)")
+
+	mustQuery(t, db, "alter table item add column stock int not null")
+	mustQuery(t, db, "alter table item rename column name to label")
+	mustQuery(t, db, "alter table item drop column price")
+	mustQuery(t, db, "insert into item (label, stock) values ('kiwi', 7)")
+
+	// Records written against the old fields can still be committed
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Column{{"id", schema.PrimaryKey}, {"label", schema.String}, {"stock", schema.Int}}
+	check := func() {
+		res := mustQuery(t, db, "select * from item where stock = 0 order by label")
+		rows := [][]sql.Val{
+			{{IsNum: true, Num: 0}, {Str: "fig"}, {IsNum: true, Num: 0}},
+			{{IsNum: true, Num: 2}, {Str: "pear"}, {IsNum: true, Num: 0}},
+			{{IsNum: true, Num: 1}, {Str: "plum"}, {IsNum: true, Num: 0}},
+		}
+		if !reflect.DeepEqual(res.Columns, expected) || !reflect.DeepEqual(res.Rows, rows) {
+			t.Errorf("Incorrect result %+v", res)
+		}
+	}
+	check()
+
+	// Updated records are written with the new fields
+	mustQuery(t, db, "update item set stock = 5 where label = 'fig'")
+	if res := mustQuery(t, db, "select label from item where stock > 0"); !reflect.DeepEqual(res.Rows, [][]sql.Val{strs("fig"), strs("kiwi")}) {
+		t.Errorf("Incorrect rows %v", res.Rows)
+	}
+	mustQuery(t, db, "update item set stock = 0 where label = 'fig'")
+
+	for _, query := range []string{
+		"alter table item add column label string",
+		"alter table item add column id primary key",
+		"alter table item drop column price",
+		"alter table item drop column id",
+		"alter table item rename column stock to label",
+	} {
+		if _, err := db.Query(query); err == nil {
+			t.Errorf("Expected an error from %v", query)
+		}
+	}
+
+	tx = db.Begin()
+	if _, err := tx.Query("alter table item drop column stock"); err != ErrSchemaInTransaction {
+		t.Errorf("Expected ErrSchemaInTransaction, got %v", err)
+	}
+	tx.Rollback()
+
+	// The history of the table is kept in the catalog, so records are migrated
+	// after the database is reopened
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, 4, schema.Schema{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestTransactions(t *testing.T) {
+	db := testDb(t)
+	a := db.NewSession()
+	b := db.NewSession()
+
+	count := func(s *Session, query string) int {
+		res, err := s.Query(query)
+		if err != nil {
+			t.Fatalf("%v: %v", query, err)
+		}
+		return len(res.Rows)
+	}
+
+	for _, q := range []string{
+		"begin",
+		"insert into user (forename, surname, address) values ('alex', 'bostock', 'nope'), ('greg', 'davies', 'nope')",
+		"update user set address = 'redacted' where forename = 'greg'",
+	} {
+		if _, err := a.Query(q); err != nil {
+			t.Fatalf("%v: %v", q, err)
+		}
+	}
+
+	if n := count(a, "select * from user where address = 'redacted'"); n != 1 {
+		t.Errorf("Transaction should see its own changes, got %v records", n)
+	}
+	if n := count(b, "select * from user"); n != 0 {
+		t.Errorf("Other sessions should not see uncommitted changes, got %v records", n)
+	}
+
+	if _, err := a.Query("begin"); err != ErrInTransaction {
+		t.Errorf("Expected ErrInTransaction, got %v", err)
+	}
+	if _, err := a.Query("commit"); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(b, "select * from user"); n != 2 {
+		t.Errorf("Expected 2 committed records, got %v", n)
+	}
+
+	tx := db.Begin()
+	for _, q := range []string{
+		"delete from user where id = 0",
+		"insert into user (forename, surname, address) values ('alex', 'horne', 'nope')",
+		"update user set forename = 'gregory'",
+	} {
+		if _, err := tx.Query(q); err != nil {
+			t.Fatalf("%v: %v", q, err)
+		}
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Query("select * from user"); err != ErrTxDone {
+		t.Errorf("Expected ErrTxDone, got %v", err)
+	}
+
+	res := mustQuery(t, db, "select id, forename from user")
+	expected := [][]sql.Val{
+		{sql.Val{IsNum: true, Num: 0}, sql.Val{Str: "alex"}},
+		{sql.Val{IsNum: true, Num: 1}, sql.Val{Str: "greg"}},
+	}
+	if !reflect.DeepEqual(res.Rows, expected) {
+		t.Errorf("Rolled back changes were applied %v", res.Rows)
+	}
+
+	if _, err := b.Query("rollback"); err != ErrNoTransaction {
+		t.Errorf("Expected ErrNoTransaction, got %v", err)
+	}
+	if _, err := db.Query("begin"); err != ErrNotInSession {
+		t.Errorf("Expected ErrNotInSession, got %v", err)
+	}
+
+	// Keys allocated by a rolled back transaction are not reused
+	res = mustQuery(t, db, "insert into user (forename, surname, address) values ('joe', 'wilkinson', 'nope')")
+	if res.LastInsertId != 3 {
+		t.Errorf("Expected last insert id 3, got %v", res.LastInsertId)
+	}
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	db := testDb(t)
+	mustQuery(t, db, "insert into user (forename, surname, address) values ('alex', 'bostock', 'nope'), ('greg', 'davies', 'nope')")
+
+	a := db.Begin()
+	b := db.Begin()
+
+	mustQuery(t, db, "insert into user (forename, surname, address) values ('alex', 'horne', 'nope')")
+	if res, err := a.Query("select * from user"); err != nil || len(res.Rows) != 2 {
+		t.Errorf("Transaction should not see records committed after it began, got %v (%v)", res, err)
+	}
+
+	for _, tx := range []*Tx{a, b} {
+		if _, err := tx.Query("update user set address = 'redacted' where id = 1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := a.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	err := b.Commit()
+	if e, ok := err.(*ConflictError); !ok || e.Table != "user" || e.Key != 1 {
+		t.Errorf("Expected a conflict on user 1, got %v", err)
+	}
+
+	// Transactions which change different records do not conflict
+	a = db.Begin()
+	b = db.Begin()
+	a.Query("update user set address = 'a' where id = 0")
+	b.Query("update user set address = 'b' where id = 2")
+	if err := a.Commit(); err != nil {
+		t.Error(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAsOf(t *testing.T) {
+	db := testDb(t)
+
+	mustQuery(t, db, "insert into order (items, price, user_id) values ('apples', 5, 1)")
+	mustQuery(t, db, "insert into order (items, price, user_id) values ('pears', 3, 1)")
+	tx := db.Begin()
+	before := time.Now()
+	mustQuery(t, db, "update order set price = 10 where id = 0")
+	mustQuery(t, db, "delete from order where id = 1")
+
+	tests := []struct {
+		query    string
+		expected []sql.Val
+	}{
+		{"select price from order", ints(10)},
+		{"select price from order as of 1", ints(5)},
+		{"select price from order as of 2", ints(5, 3)},
+		{"select price from order as of 3", ints(10, 3)},
+		{"select price from order where price > 4 order by price desc as of 3", ints(10)},
+		{"select price from order as of '" + before.Format(time.RFC3339Nano) + "'", ints(5, 3)},
+		{"select price from order as of '2000-01-01t00:00:00z'", nil},
+	}
+
+	for _, test := range tests {
+		res := mustQuery(t, db, test.query)
+		var prices []sql.Val
+		for _, row := range res.Rows {
+			prices = append(prices, row[0])
+		}
+		if !reflect.DeepEqual(prices, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.query, test.expected, prices)
+		}
+	}
+
+	if _, err := db.Query("select * from order as of 5"); err == nil {
+		t.Error("Expected an error reading a snapshot which has not been committed")
+	}
+
+	if n, err := db.Vacuum(4); err != nil || n != 0 {
+		t.Errorf("Vacuum should keep versions seen by active transactions, discarded %v (%v)", n, err)
+	}
+	tx.Rollback()
+
+	// The pear's insert and delete, and the apple's original price
+	if n, err := db.Vacuum(4); err != nil || n != 3 {
+		t.Errorf("Expected 3 versions to be discarded, got %v (%v)", n, err)
+	}
+	if _, err := db.Query("select * from order as of 3"); err == nil {
+		t.Error("Expected an error reading a vacuumed snapshot")
+	} else if _, ok := err.(*SnapshotError); !ok {
+		t.Errorf("Expected a snapshot error, got %v", err)
+	}
+	if res := mustQuery(t, db, "select price from order as of 4"); len(res.Rows) != 1 || res.Rows[0][0].Num != 10 {
+		t.Errorf("Incorrect snapshot after vacuum %v", res.Rows)
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alder-indexes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, 4, testDb(t).schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 12; i++ {
+		n := strconv.Itoa(i)
+		mustQuery(t, db, "insert into order (items, price, user_id) values ('item"+n+"', "+n+", "+strconv.Itoa(i%3)+")")
+	}
+	mustQuery(t, db, "create index order_user on order (user_id, price)")
+
+	type querier interface {
+		Query(string, ...interface{}) (*Result, error)
+	}
+	prices := func(q querier, query string) []sql.Val {
+		t.Helper()
+		res, err := q.Query(query)
+		if err != nil {
+			t.Fatalf("%v: %v", query, err)
+		}
+		var prices []sql.Val
+		for _, row := range res.Rows {
+			prices = append(prices, row[0])
+		}
+		return prices
+	}
+	entries := func(x *index) int {
+		n := 0
+		x.entries.Scan(minKey, maxKey, func(_ int, data []byte) bool {
+			n += len(decodeEntries(data, len(x.Fields)))
+			return true
+		})
+		return n
+	}
+
+	query := "select price from order where user_id = 1 and price > 4"
+	expectPlan(t, db, "explain "+query,
+		"Project price",
+		"  Seek order USING order_user WHERE user_id = 1 AND price > 4",
+	)
+	if res := prices(db, query); !reflect.DeepEqual(res, ints(7, 10)) {
+		t.Errorf("Expected %v, got %v", ints(7, 10), res)
+	}
+
+	// Transactions find the records they have changed
+	before := db.csn
+	tx := db.Begin()
+	for _, q := range []string{
+		"insert into order (items, price, user_id) values ('extra', 20, 1)",
+		"update order set user_id = 2 where id = 7",
+	} {
+		if _, err := tx.Query(q); err != nil {
+			t.Fatalf("%v: %v", q, err)
+		}
+	}
+	if res := prices(tx, query); !reflect.DeepEqual(res, ints(10, 20)) {
+		t.Errorf("Transaction should see its own changes, got %v", res)
+	}
+	if res := prices(db, query); !reflect.DeepEqual(res, ints(7, 10)) {
+		t.Errorf("Uncommitted changes should not be seen, got %v", res)
+	}
+	if _, err := tx.Query("create index order_price on order (price)"); err != ErrSchemaInTransaction {
+		t.Errorf("Expected ErrSchemaInTransaction, got %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if res := prices(db, query); !reflect.DeepEqual(res, ints(10, 20)) {
+		t.Errorf("Expected %v, got %v", ints(10, 20), res)
+	}
+
+	// Snapshots find the versions they see
+	asOf := query + " as of " + strconv.Itoa(before)
+	if res := prices(db, asOf); !reflect.DeepEqual(res, ints(7, 10)) {
+		t.Errorf("%v: expected %v, got %v", asOf, ints(7, 10), res)
+	}
+
+	// Vacuum removes the entries of discarded versions
+	mustQuery(t, db, "delete from order where user_id = 1 and price = 10")
+	x := db.tables["order"].index("order_user")
+	if n := entries(x); n != 14 {
+		t.Errorf("Expected an entry for each of 14 versions, got %v", n)
+	}
+	if _, err := db.Vacuum(maxKey); err != nil {
+		t.Fatal(err)
+	}
+	if n := entries(x); n != 12 {
+		t.Errorf("Expected an entry for each of 12 records, got %v", n)
+	}
+	if res := prices(db, query); !reflect.DeepEqual(res, ints(20)) {
+		t.Errorf("Expected %v, got %v", ints(20), res)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Indexes are rebuilt when a database is opened, and indexes in its
+	// schema are added
+	order := "tables:\n  - name: order\n    key: id\n    fields:\n      - name: items\n        type: string\n      - name: price\n        type: int\n      - name: user_id\n        type: int\n    indexes:\n"
+	extra, err := schema.New([]byte(order + "      - name: order_items\n        fields: [items]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, 4, extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexes := db.schema.GetTable("order").Indexes; len(indexes) != 2 || indexes[0].Name != "order_user" || indexes[1].Name != "order_items" {
+		t.Errorf("Incorrect indexes %v", indexes)
+	}
+	expectPlan(t, db, "explain "+query,
+		"Project price",
+		"  Seek order USING order_user WHERE user_id = 1 AND price > 4",
+	)
+	if res := prices(db, query); !reflect.DeepEqual(res, ints(20)) {
+		t.Errorf("Expected %v, got %v", ints(20), res)
+	}
+	if res := prices(db, "select price from order where items = 'item4'"); !reflect.DeepEqual(res, ints(4)) {
+		t.Errorf("Expected %v, got %v", ints(4), res)
+	}
+
+	// Renaming a field keeps its indexes, and dropping it drops them
+	mustQuery(t, db, "alter table order rename column user_id to customer")
+	expectPlan(t, db, "explain select price from order where customer = 2",
+		"Project price",
+		"  Seek order USING order_user WHERE customer = 2",
+	)
+	if res := prices(db, "select price from order where customer = 2"); !reflect.DeepEqual(res, ints(2, 5, 7, 8, 11)) {
+		t.Errorf("Expected %v, got %v", ints(2, 5, 7, 8, 11), res)
+	}
+	mustQuery(t, db, "alter table order drop column customer")
+	if indexes := db.schema.GetTable("order").Indexes; len(indexes) != 1 || indexes[0].Name != "order_items" {
+		t.Errorf("Incorrect indexes %v", indexes)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mismatched, err := schema.New([]byte(strings.Replace(order, "      - name: user_id\n        type: int\n", "", 1) + "      - name: order_items\n        fields: [price]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, 4, mismatched); err == nil {
+		t.Error("Expected an error opening with an index which does not match the catalog")
+	} else if e, ok := err.(*schema.Error); !ok || e.Table != "order" {
+		t.Errorf("Expected a schema error for order, got %v", err)
+	}
+}
+
+func TestIndexSharedValue(t *testing.T) {
+	db := testDb(t)
+	mustQuery(t, db, "create index order_user on order (user_id)")
+
+	// Each record is its own entry, so adding one does not read the others
+	// with the same value
+	for i := 0; i < 4000; i++ {
+		mustQuery(t, db, "insert into order (price, user_id) values ("+strconv.Itoa(i)+", "+strconv.Itoa(i/3999)+")")
+	}
+	x := db.tables["order"].index("order_user")
+	keys := 0
+	x.entries.Scan(minKey, maxKey, func(key int, data []byte) bool {
+		keys++
+		if entries := decodeEntries(data, 1); len(entries) != 1 || key != entryKey(bucketKey(entries[0].vals[0]), entries[0].key) {
+			t.Errorf("Expected key %v to hold the entry of its record, got %v", key, entries)
+		}
+		return true
+	})
+	if keys != 4000 {
+		t.Errorf("Expected a key for each of 4000 records, got %v", keys)
+	}
+
+	expectPlan(t, db, "explain select count(*) from order where user_id = 0",
+		"Project count(*)",
+		"  Aggregate: count(*)",
+		"    Seek order USING order_user WHERE user_id = 0",
+	)
+	if res := mustQuery(t, db, "select count(*) from order where user_id = 0"); !reflect.DeepEqual(res.Rows, [][]sql.Val{ints(3999)}) {
+		t.Errorf("Expected 3999 records, got %v", res.Rows)
+	}
+	if res := mustQuery(t, db, "select price from order where user_id = 1"); !reflect.DeepEqual(res.Rows, [][]sql.Val{ints(3999)}) {
+		t.Errorf("Expected %v, got %v", ints(3999), res.Rows)
+	}
+
+	// Keys are removed with their last entry
+	mustQuery(t, db, "delete from order where user_id = 1")
+	if _, err := db.Vacuum(maxKey); err != nil {
+		t.Fatal(err)
+	}
+	if x.entries.Get(entryKey(1, 3999)) != nil {
+		t.Error("Expected the entries of 1 to be removed")
+	}
+}
+
+func TestIndexChoice(t *testing.T) {
+	db := testDb(t)
+	for i := 0; i < 12; i++ {
+		mustQuery(t, db, "insert into order (price, user_id) values ("+strconv.Itoa(i)+", "+strconv.Itoa(i%3)+")")
+	}
+	mustQuery(t, db, "create index order_user on order (user_id)")
+	mustQuery(t, db, "create index order_user_price on order (user_id, price)")
+
+	// Without statistics, the index with the most conditions on a value of its
+	// first field is used, and ranges are scanned
+	expectPlan(t, db, "explain select price from order where user_id = 1 and price = 7",
+		"Project price",
+		"  Seek order USING order_user_price WHERE user_id = 1 AND price = 7",
+	)
+	expectPlan(t, db, "explain select price from order where user_id = 1",
+		"Project price",
+		"  Seek order USING order_user WHERE user_id = 1",
+	)
+	expectPlan(t, db, "explain select price from order where user_id > 1",
+		"Project price",
+		"  Filter user_id > 1",
+		"    Scan order",
+	)
+	if res := mustQuery(t, db, "select price from order where user_id = 1 and price = 7"); !reflect.DeepEqual(res.Rows, [][]sql.Val{ints(7)}) {
+		t.Errorf("Expected %v, got %v", ints(7), res.Rows)
+	}
+}
+
+func TestBucketKey(t *testing.T) {
+	// Keys are ordered as their values, and within the bounds of buckets
+	values := []sql.Val{
+		{Null: true},
+		{IsNum: true, Num: minKey},
+		{IsNum: true, Num: -1 << 40},
+		{IsNum: true, Num: -1 << 30},
+		{IsNum: true, Num: -5},
+		{IsNum: true, Num: 0},
+		{IsNum: true, Num: 1<<30 - 1},
+		{IsNum: true, Num: 1 << 30},
+		{IsNum: true, Num: 3 << 30},
+		{IsNum: true, Num: 1 << 40},
+		{IsNum: true, Num: 1<<40 + 1<<20},
+		{IsNum: true, Num: maxKey},
+	}
+	for i, v := range values {
+		key := bucketKey(v)
+		if key < minBucket || key > maxBucket {
+			t.Errorf("%v: key %v is out of bounds", v, key)
+		}
+		if i > 0 && key <= bucketKey(values[i-1]) {
+			t.Errorf("%v: key %v is not greater than that of %v", v, key, values[i-1])
+		}
+	}
+
+	strs := []string{"", "a", "ab", "abc", "abd", "b", "zzzz"}
+	for i := 1; i < len(strs); i++ {
+		if bucketKey(sql.Val{Str: strs[i]}) <= bucketKey(sql.Val{Str: strs[i-1]}) {
+			t.Errorf("Key of %q is not greater than that of %q", strs[i], strs[i-1])
+		}
+	}
+	if bucketKey(sql.Val{Str: "item1"}) != bucketKey(sql.Val{Str: "item2"}) {
+		t.Error("Expected strings with the same first 4 bytes to share a bucket")
+	}
+}
+
+// TestConcurrentQueries should be run with the race detector.
+func TestConcurrentQueries(t *testing.T) {
+	db := testDb(t)
+
+	const accounts = 10
+	for i := 0; i < accounts; i++ {
+		mustQuery(t, db, "insert into order (items, price, user_id) values ('account', 100, 0)")
+	}
+
+	price := func(tx *Tx, id int) int {
+		res, err := tx.Query("select price from order where id = " + strconv.Itoa(id))
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		return res.Rows[0][0].Num
+	}
+
+	// transfer moves 1 between two accounts, retrying on conflicts
+	transfer := func(from, to int) {
+		for {
+			tx := db.Begin()
+			a, b := price(tx, from), price(tx, to)
+			tx.Query("update order set price = " + strconv.Itoa(a-1) + " where id = " + strconv.Itoa(from))
+			tx.Query("update order set price = " + strconv.Itoa(b+1) + " where id = " + strconv.Itoa(to))
+
+			err := tx.Commit()
+			if _, ok := err.(*ConflictError); ok {
+				continue
+			}
+			if err != nil {
+				t.Error(err)
+			}
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	var idsMu sync.Mutex
+	ids := make(map[int]bool)
+
+	for g := 0; g < 8; g++ {
+		wg.Add(4)
+
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 30; i++ {
+				if from, to := (g+i)%accounts, (g+2*i+1)%accounts; from != to {
+					transfer(from, to)
+				}
+			}
+		}(g)
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 30; i++ {
+				res, err := db.Query("select price from order order by price")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				total := 0
+				for _, row := range res.Rows {
+					total += row[0].Num
+				}
+				if total != 100*accounts {
+					t.Errorf("Inconsistent snapshot with total %v", total)
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 30; i++ {
+				res, err := db.Query("insert into user (forename, surname, address) values ('alex', 'bostock', 'nope')")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				idsMu.Lock()
+				if ids[res.LastInsertId] {
+					t.Errorf("Primary key %v allocated twice", res.LastInsertId)
+				}
+				ids[res.LastInsertId] = true
+				idsMu.Unlock()
+
+				if i%10 == 0 {
+					db.Vacuum(maxKey)
+				}
+			}
+		}()
+
+		// Single statements changing the accounts being transferred between
+		// never fail with conflicts
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 30; i++ {
+				if _, err := db.Query("update order set items = 'account' where price > 0"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
 
-	if !reflect.DeepEqual(deserialise(serialise(data)), data) {
-		t.Error("Serialisation/deserialisation failed")
+	if res := mustQuery(t, db, "select * from user"); len(res.Rows) != 8*30 {
+		t.Errorf("Expected %v users, got %v", 8*30, len(res.Rows))
 	}
 }
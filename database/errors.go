@@ -0,0 +1,66 @@
+package database
+
+import "fmt"
+
+// A ConstraintError reports a query which would violate a constraint of the
+// schema, such as the uniqueness of primary keys.
+type ConstraintError struct {
+	Table string
+	Key   string // Field whose constraint would be violated
+	Msg   string
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("Constraint error on %s.%s: %s", e.Table, e.Key, e.Msg)
+}
+
+// A StorageError reports a failure to read or write stored data, or temporary
+// files, while executing a query.
+type StorageError struct {
+	Table string // Table being accessed, if any
+	Op    string // Operation which failed, such as "delete" or "sort"
+	Err   error
+}
+
+func (e *StorageError) Error() string {
+	if e.Table == "" {
+		return fmt.Sprintf("Storage error during %s: %s", e.Op, e.Err)
+	}
+	return fmt.Sprintf("Storage error during %s of %s: %s", e.Op, e.Table, e.Err)
+}
+
+// A ConflictError reports a transaction which could not be committed, because
+// a record it changed was also changed by a transaction committed since it
+// began.
+type ConflictError struct {
+	Table string
+	Key   int // Primary key of the record changed by both transactions
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Conflict error: record %d of %s was changed by a concurrent transaction", e.Key, e.Table)
+}
+
+// A SnapshotError reports an AS OF clause identifying a snapshot which cannot
+// be read.
+type SnapshotError struct {
+	Csn int // Sequence number of the last transaction committed in the snapshot
+	Msg string
+}
+
+func (e *SnapshotError) Error() string {
+	return fmt.Sprintf("Snapshot error at transaction %d: %s", e.Csn, e.Msg)
+}
+
+// recoverStorageError recovers a panic caused by a *StorageError, which is how
+// errors are raised from callbacks run by the store, and stores it in err.
+// Other panics are not recovered.
+func recoverStorageError(err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(*StorageError)
+		if !ok {
+			panic(r)
+		}
+		*err = e
+	}
+}
@@ -0,0 +1,353 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexbostock/alder/schema"
+	"github.com/alexbostock/alder/sql"
+)
+
+// A planNode is a step of the physical plan of a query, which produces records
+// from those produced by its children. As the query is executed, each step
+// counts the records it produces, and records the time from the start of the
+// query until it had produced them all, which includes the time taken by its
+// children. The methods which record these do nothing on a nil *planNode, for
+// steps which are not part of a plan.
+type planNode struct {
+	op       string
+	children []*planNode
+	estimate float64 // Estimated records produced, or -1 if the tables read have no statistics
+	rows     int
+	time     time.Duration
+}
+
+func newPlanNode(op string, estimate float64, children ...*planNode) *planNode {
+	return &planNode{op: op, children: children, estimate: estimate}
+}
+
+// produced counts records produced by the step.
+func (n *planNode) produced(rows int) {
+	if n != nil {
+		n.rows += rows
+	}
+}
+
+// finish records that the step has produced all of its records.
+func (n *planNode) finish(start time.Time) {
+	if n != nil {
+		n.time = time.Since(start)
+	}
+}
+
+// describe appends a line describing each step of the plan to lines, with the
+// steps which produce its input below it, indented. Each line reports the
+// estimated number of records the step produces, if there is one, and if
+// analyzed is true, the records it produced, and the time taken.
+func (n *planNode) describe(lines []string, depth int, analyzed bool) []string {
+	var details []string
+	if n.estimate >= 0 {
+		details = append(details, fmt.Sprintf("estimate=%.0f", n.estimate))
+	}
+	if analyzed {
+		details = append(details, fmt.Sprintf("rows=%d time=%.3fms", n.rows, float64(n.time)/float64(time.Millisecond)))
+	}
+
+	line := strings.Repeat("  ", depth) + n.op
+	if len(details) > 0 {
+		line += "  (" + strings.Join(details, " ") + ")"
+	}
+	lines = append(lines, line)
+
+	for _, child := range n.children {
+		lines = child.describe(lines, depth+1, analyzed)
+	}
+
+	return lines
+}
+
+// A queryPlan is the plan of a SELECT or compound query.
+type queryPlan interface {
+	node() *planNode
+}
+
+// A selectPlan is the plan of a SELECT query: the order in which its tables are
+// read, and the steps which then produce its result. Steps which are not needed
+// are nil.
+type selectPlan struct {
+	root *planNode
+
+	table      string          // Table read first
+	path       accessPath      // Primary keys read from the table
+	seek       *indexPath      // Index by which the table is read, or nil
+	joined     []sql.Join      // Joins adding the other tables, in order
+	strategies []joinStrategy  // Strategy of each join
+	where      sql.WhereClause // Conditions not used by the access path
+	keyOrdered bool            // Records are sorted by being read in primary key order
+
+	access    *planNode // Read of the table read first
+	joins     []*planNode
+	filter    *planNode
+	aggregate *planNode
+	having    *planNode
+	sort      *planNode // Sort, or reversal of records read in primary key order
+	limit     *planNode
+	project   *planNode
+}
+
+func (p *selectPlan) node() *planNode {
+	return p.root
+}
+
+// A compoundPlan is the plan of a compound query: the set operation applied to
+// the results of its two queries, and the steps which then produce its result.
+// Steps which are not needed are nil.
+type compoundPlan struct {
+	root        *planNode
+	left, right queryPlan
+
+	operation *planNode
+	sort      *planNode
+	limit     *planNode
+}
+
+func (p *compoundPlan) node() *planNode {
+	return p.root
+}
+
+var joinStrategyNames = map[joinStrategy]string{
+	nestedLoopJoin: "Nested loop",
+	hashJoin:       "Hash",
+	primaryKeyJoin: "Primary key",
+}
+
+var joinTypeNames = map[sql.JoinType]string{
+	sql.InnerJoin: "join",
+	sql.LeftJoin:  "left join",
+	sql.RightJoin: "right join",
+	sql.OuterJoin: "outer join",
+}
+
+var setOperationNames = map[sql.SetOperation]string{
+	sql.Union:        "Union",
+	sql.UnionAll:     "Union all",
+	sql.Intersection: "Intersect",
+	sql.Difference:   "Minus",
+}
+
+// plan returns the plan by which a SELECT or compound query is executed.
+func (db *Db) plan(q sql.Query) queryPlan {
+	switch query := q.(type) {
+	case *sql.SelectQuery:
+		return db.planSelect(*query)
+	case *sql.CompoundQuery:
+		return db.planCompound(*query)
+	default:
+		panic(errors.New("Invalid subquery (which should not have passed static analysis)"))
+	}
+}
+
+// planCompound plans a compound query.
+func (db *Db) planCompound(q sql.CompoundQuery) *compoundPlan {
+	p := &compoundPlan{left: db.plan(q.Left), right: db.plan(q.Right)}
+	p.operation = newPlanNode(setOperationNames[q.Operation], -1, p.left.node(), p.right.node())
+	n := p.operation
+
+	if len(q.OrderBy) > 0 {
+		p.sort = newPlanNode("Sort "+sortKeys(q.OrderBy), -1, n)
+		n = p.sort
+	}
+
+	if offset, limit := bounds(q.Limit, q.Offset); limit >= 0 || offset > 0 {
+		p.limit = newPlanNode(describeBounds(offset, limit), -1, n)
+		n = p.limit
+	}
+
+	p.root = n
+	return p
+}
+
+// sortKeys describes the keys by which records are sorted.
+func sortKeys(keys []sql.SortKey) string {
+	described := make([]string, len(keys))
+	for i, k := range keys {
+		described[i] = k.String()
+	}
+
+	return strings.Join(described, ", ")
+}
+
+// describeBounds describes the records skipped and returned by a limit, which
+// returns all of them if limit is -1.
+func describeBounds(offset, limit int) string {
+	var op []string
+	if limit >= 0 {
+		op = append(op, "Limit "+strconv.Itoa(limit))
+	}
+	if offset > 0 {
+		op = append(op, "Offset "+strconv.Itoa(offset))
+	}
+
+	return strings.Join(op, ", ")
+}
+
+// planSelect plans a SELECT query. If every table it reads has statistics, the
+// number of records produced by each step is estimated, and the order in which
+// its tables are joined is chosen by its estimated cost.
+func (db *Db) planSelect(q sql.SelectQuery) *selectPlan {
+	e := newEstimator(db.schema, db.statistics(), q)
+	o := db.planJoins(q, e)
+	p := &selectPlan{
+		table:      o.table,
+		path:       o.path,
+		seek:       o.seek,
+		joined:     o.joins,
+		strategies: o.strategies,
+		where:      o.filter,
+	}
+
+	// Records are scanned in primary key order, so sorting by primary key is
+	// only needed when there are joins
+	primaryKey := db.schema.GetTable(q.Table).GetPrimaryKey()
+	p.keyOrdered = !q.Grouped && len(q.Joins) == 0 && len(q.OrderBy) > 0 && q.OrderBy[0].Key == primaryKey
+
+	p.access = newPlanNode(accessOp(p.table, db.schema.GetTable(p.table).GetPrimaryKey(), p.path, p.seek), o.rows[0])
+	n := p.access
+
+	for i, j := range p.joined {
+		right := newPlanNode("Scan "+j.Table, -1)
+		if e != nil {
+			right.estimate = e.rows(j.Table)
+		}
+		if p.strategies[i] == primaryKeyJoin {
+			right.op = "Get " + j.Table
+			right.estimate = minFloat(o.rows[i], o.rows[i+1])
+		}
+
+		n = newPlanNode(joinStrategyNames[p.strategies[i]]+" "+joinTypeNames[j.Type]+" "+j.String(), o.rows[i+1], n, right)
+		p.joins = append(p.joins, n)
+	}
+
+	// Estimated records produced by the last step, which stays -1 without
+	// statistics
+	rows := n.estimate
+
+	if len(p.where.Filters) > 0 {
+		if e != nil {
+			rows *= e.where(p.where)
+		}
+		p.filter = newPlanNode("Filter "+p.where.String(), rows, n)
+		n = p.filter
+	}
+
+	if q.Grouped {
+		names := make([]string, len(q.Aggregates))
+		for i, a := range q.Aggregates {
+			names[i] = a.Name
+		}
+
+		op := "Aggregate"
+		if len(q.GroupBy) > 0 {
+			op = "Hash aggregate by " + strings.Join(q.GroupBy, ", ")
+		}
+		if len(names) > 0 {
+			op += ": " + strings.Join(names, ", ")
+		}
+		if e != nil {
+			rows = e.groups(rows, q.GroupBy)
+		}
+		p.aggregate = newPlanNode(op, rows, n)
+		n = p.aggregate
+
+		if len(q.Having.Filters) > 0 {
+			if e != nil {
+				rows *= e.where(q.Having)
+			}
+			p.having = newPlanNode("Filter "+q.Having.String(), rows, n)
+			n = p.having
+		}
+	}
+
+	if len(q.OrderBy) > 0 && !p.keyOrdered {
+		p.sort = newPlanNode("Sort "+sortKeys(q.OrderBy), rows, n)
+		n = p.sort
+	} else if p.keyOrdered && q.OrderBy[0].Descending {
+		p.sort = newPlanNode("Reverse", rows, n)
+		n = p.sort
+	}
+
+	if offset, limit := bounds(q.Limit, q.Offset); limit >= 0 || offset > 0 {
+		if e != nil {
+			rows = maxFloat(0, rows-float64(offset))
+			if limit >= 0 {
+				rows = minFloat(rows, float64(limit))
+			}
+		}
+		p.limit = newPlanNode(describeBounds(offset, limit), rows, n)
+		n = p.limit
+	}
+
+	if len(q.Keys) > 0 {
+		p.project = newPlanNode("Project "+strings.Join(q.Keys, ", "), rows, n)
+		n = p.project
+	}
+
+	p.root = n
+	return p
+}
+
+// accessOp describes how the records of a table in an access path are read,
+// through an index if seek is not nil.
+func accessOp(table, primary string, path accessPath, seek *indexPath) string {
+	switch {
+	case path.empty():
+		return "Empty " + table
+	case path.point():
+		return fmt.Sprintf("Get %s WHERE %s = %d", table, primary, path.min)
+	case path.fullScan() && seek == nil:
+		return "Scan " + table
+	}
+
+	var bounds []string
+	if seek != nil {
+		bounds = append(bounds, seek.where.String())
+	}
+	if path.min != minKey {
+		bounds = append(bounds, fmt.Sprintf("%s > %d", primary, path.min-1))
+	}
+	if path.max != maxKey {
+		bounds = append(bounds, fmt.Sprintf("%s < %d", primary, path.max+1))
+	}
+
+	if seek != nil {
+		return "Seek " + table + " USING " + seek.index.Name + " WHERE " + strings.Join(bounds, " AND ")
+	}
+	return "GetRange " + table + " WHERE " + strings.Join(bounds, " AND ")
+}
+
+// explain returns the plan of a query as rows of a single column, with a row
+// for each step, below which are the steps producing its input, indented.
+// EXPLAIN ANALYZE executes the query first, and adds what each step did.
+func (db *Db) explain(q sql.ExplainQuery) (*Result, error) {
+	p := db.plan(q.Query)
+	if q.Analyze {
+		if _, err := db.run(q.Query, p, true); err != nil {
+			return nil, err
+		}
+	}
+
+	lines := p.node().describe(nil, 0, q.Analyze)
+	r := &Result{
+		Columns:      []Column{{"plan", schema.String}},
+		Rows:         make([][]sql.Val, len(lines)),
+		LastInsertId: -1,
+	}
+	for i, line := range lines {
+		r.Rows[i] = []sql.Val{{Str: line}}
+	}
+
+	return r, nil
+}
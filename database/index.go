@@ -0,0 +1,384 @@
+package database
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sort"
+
+	"github.com/alexbostock/alder/schema"
+	"github.com/alexbostock/alder/sql"
+	"github.com/alexbostock/alder/store"
+)
+
+// An index is a secondary index of a table. It has an entry for each version
+// of each record, with the record's values of the indexed fields and its
+// primary key.
+//
+// Entries are kept in a B+ tree, keyed by the bucketKey of their first value in
+// the high 32 bits, and the low 32 bits of their primary key, so that they are
+// in the order of their first values, and adding or removing an entry reads
+// only the entries of its record (and of any record whose primary key shares
+// its low 32 bits, in the same bucket). Each key holds a list of the entries
+// with that key.
+//
+// Entries are added as records are committed, and removed by Vacuum when none
+// of the versions of their record which are kept has their values. An entry
+// may therefore describe a version of its record which a snapshot does not
+// see, so records found by an index are checked again as they are read.
+type index struct {
+	schema.Index
+	entries store.Store // entryKey -> entries with that key
+}
+
+func newIndex(branchingFactor int, i schema.Index) *index {
+	return &index{i, store.NewBPTree(branchingFactor)}
+}
+
+// An entry is the values of the indexed fields in a version of a record, and
+// the record's primary key.
+type entry struct {
+	key  int
+	vals []sql.Val
+}
+
+const (
+	minBucket = -1 << 31
+	maxBucket = 1<<31 - 1
+)
+
+// bucketKey returns the key of the bucket holding entries whose first value is
+// v, which is between minBucket and maxBucket. Keys are ordered as the values
+// they are given for, but a bucket may hold several values: ints of magnitude
+// 2^30 or more are keyed by their highest 25 bits, and strings by their first
+// 31 bits. NULL has the smallest key.
+func bucketKey(v sql.Val) int {
+	switch {
+	case v.Null:
+		return minBucket
+	case v.IsNum && v.Num < 0:
+		return -intBucket(^v.Num) - 1
+	case v.IsNum:
+		return intBucket(v.Num)
+	}
+
+	key := 0
+	for i := 0; i < 4; i++ {
+		key <<= 8
+		if i < len(v.Str) {
+			key |= int(v.Str[i])
+		}
+	}
+
+	return key >> 1
+}
+
+// intBucket returns the bucket key of a non-negative int, which is less than
+// 2^31. Ints from 2^30 are keyed by the position of their highest bit, and the
+// 24 bits which follow it.
+func intBucket(n int) int {
+	if n < 1<<30 {
+		return n
+	}
+
+	high := bits.Len64(uint64(n))
+	return 1<<30 + (high-31)<<24 + (n>>uint(high-25))&(1<<24-1)
+}
+
+// entryKey returns the key of the entries of the record with the given primary
+// key in a bucket.
+func entryKey(bucket, key int) int {
+	return bucket<<32 | key&(1<<32-1)
+}
+
+// encodeEntries serialises a list of entries: their number, then the primary
+// key and values of each, in which each value is preceded by a byte giving its
+// type.
+func encodeEntries(entries []entry) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	data := append([]byte(nil), scratch[:binary.PutUvarint(scratch[:], uint64(len(entries)))]...)
+
+	for _, e := range entries {
+		data = append(data, scratch[:binary.PutVarint(scratch[:], int64(e.key))]...)
+		for _, v := range e.vals {
+			switch {
+			case v.Null:
+				data = append(data, 0)
+			case v.IsNum:
+				data = append(data, 1)
+				data = append(data, scratch[:binary.PutVarint(scratch[:], int64(v.Num))]...)
+			default:
+				data = append(data, 2)
+				data = append(data, scratch[:binary.PutUvarint(scratch[:], uint64(len(v.Str)))]...)
+				data = append(data, v.Str...)
+			}
+		}
+	}
+
+	return data
+}
+
+// decodeEntries deserialises a list of entries, each with n values. It
+// reports corrupt data in the same way as decode.
+func decodeEntries(data []byte, n int) []entry {
+	count, pos := binary.Uvarint(data)
+	if pos <= 0 {
+		panic(&StorageError{"", "decode", errTruncated})
+	}
+
+	// varint reads a varint at pos
+	varint := func() int64 {
+		x, n := binary.Varint(data[pos:])
+		if n <= 0 {
+			panic(&StorageError{"", "decode", errTruncated})
+		}
+		pos += n
+		return x
+	}
+
+	entries := make([]entry, count)
+	for i := range entries {
+		entries[i].key = int(varint())
+		entries[i].vals = make([]sql.Val, n)
+
+		for j := range entries[i].vals {
+			if pos >= len(data) {
+				panic(&StorageError{"", "decode", errTruncated})
+			}
+			pos++
+
+			switch data[pos-1] {
+			case 0:
+				entries[i].vals[j] = sql.Val{Null: true}
+			case 1:
+				entries[i].vals[j] = sql.Val{IsNum: true, Num: int(varint())}
+			default:
+				length, n := binary.Uvarint(data[pos:])
+				if n <= 0 || length > uint64(len(data)-pos-n) {
+					panic(&StorageError{"", "decode", errTruncated})
+				}
+				pos += n
+				entries[i].vals[j] = sql.Val{Str: string(data[pos : pos+int(length)])}
+				pos += int(length)
+			}
+		}
+	}
+
+	return entries
+}
+
+// values returns the values of the indexed fields of a record, which are NULL
+// for fields it has no value for.
+func (x *index) values(record map[string]sql.Val) []sql.Val {
+	vals := make([]sql.Val, len(x.Fields))
+	for i, field := range x.Fields {
+		v, ok := record[field]
+		if !ok {
+			v = sql.Val{Null: true}
+		}
+		vals[i] = v
+	}
+
+	return vals
+}
+
+// add adds an entry to the index, unless it already has one with the same
+// values and primary key.
+func (x *index) add(vals []sql.Val, key int) {
+	e := entry{key, vals}
+	k := entryKey(bucketKey(vals[0]), key)
+
+	if !x.entries.Update(k, func(data []byte) []byte {
+		entries := decodeEntries(data, len(x.Fields))
+		for _, other := range entries {
+			if other.key == key && sameValues(other.vals, vals) {
+				return data
+			}
+		}
+		return encodeEntries(append(entries, e))
+	}) {
+		x.entries.Insert(k, encodeEntries([]entry{e}))
+	}
+}
+
+// remove removes the entry with the given values and primary key, if there is
+// one.
+func (x *index) remove(vals []sql.Val, key int) {
+	k := entryKey(bucketKey(vals[0]), key)
+
+	empty := false
+	x.entries.Update(k, func(data []byte) []byte {
+		entries := decodeEntries(data, len(x.Fields))
+		for i, other := range entries {
+			if other.key == key && sameValues(other.vals, vals) {
+				entries = append(entries[:i], entries[i+1:]...)
+				break
+			}
+		}
+
+		empty = len(entries) == 0
+		return encodeEntries(entries)
+	})
+	if empty {
+		x.entries.Delete(k)
+	}
+}
+
+func sameValues(a, b []sql.Val) bool {
+	for i, v := range a {
+		if v.Compare(b[i]) != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// seek returns the primary keys of the records with entries in the buckets of
+// an index path whose values satisfy its conditions, in no particular order.
+func (x *index) seek(path indexPath) []int {
+	min := entryKey(maxInt(path.min, minBucket), 0)
+	max := entryKey(minInt(path.max, maxBucket), -1)
+
+	var keys []int
+	x.entries.Scan(min, max, func(_ int, data []byte) bool {
+		for _, e := range decodeEntries(data, len(x.Fields)) {
+			if path.matches(e.vals) {
+				keys = append(keys, e.key)
+			}
+		}
+		return true
+	})
+
+	return keys
+}
+
+// seek returns the primary keys in an access path of the records which may be
+// found by an index path, in ascending order. Records changed by a transaction
+// are not indexed until it is committed, so in a transaction, the records it
+// has changed may also be found.
+func (t *tab) seek(p indexPath, path accessPath) []int {
+	base := t
+	if t.base != nil {
+		base = t.base
+	}
+
+	base.mu.RLock()
+	keys := t.index(p.index.Name).seek(p)
+	base.mu.RUnlock()
+
+	if o, ok := t.store.(*store.Overlay); ok {
+		o.Changes(func(key int, val []byte) {
+			if val != nil {
+				keys = append(keys, key)
+			}
+		})
+	}
+
+	// A record has an entry for each of its versions
+	sort.Ints(keys)
+	n := 0
+	for i, key := range keys {
+		if (i == 0 || key != keys[i-1]) && key >= path.min && key <= path.max {
+			keys[n] = key
+			n++
+		}
+	}
+
+	return keys[:n]
+}
+
+// index returns the table's index of the given name, or nil if it has none.
+// The caller must hold t.mu, unless t is in a view.
+func (t *tab) index(name string) *index {
+	for _, x := range t.indexes {
+		if x.Name == name {
+			return x
+		}
+	}
+
+	return nil
+}
+
+// indexed returns the indexes of the table after its indexes have become
+// those of a schema. Indexes which the table already has keep their entries,
+// even if their fields have been renamed, since records are migrated to the
+// table's fields as they are read. New indexes are built from the table's
+// records. The caller must hold t.mu.
+func (t *tab) indexed(indexes []schema.Index) []*index {
+	result := make([]*index, len(indexes))
+	for i, si := range indexes {
+		if x := t.index(si.Name); x != nil {
+			kept := *x
+			kept.Index = si
+			result[i] = &kept
+		} else {
+			result[i] = newIndex(t.branchingFactor, si)
+			t.build(result[i])
+		}
+	}
+
+	return result
+}
+
+// build adds the entries of every version of the table's records to an index.
+// The caller must hold t.mu.
+func (t *tab) build(x *index) {
+	t.store.Scan(minKey, maxKey, func(key int, val []byte) bool {
+		for _, record := range t.records(mustDecodeChain(val)) {
+			x.add(x.values(record), key)
+		}
+		return true
+	})
+}
+
+// indexVersion adds entries for a new version of a record to the table's
+// indexes. The caller must hold t.mu.
+func (t *tab) indexVersion(key int, data []byte) {
+	if len(t.indexes) == 0 {
+		return
+	}
+
+	record := t.decode(data)
+	for _, x := range t.indexes {
+		x.add(x.values(record), key)
+	}
+}
+
+// unindexVersions removes the entries of discarded versions of a record from
+// the table's indexes, unless a version which is kept has the same values. The
+// caller must hold t.mu.
+func (t *tab) unindexVersions(key int, kept, discarded []version) {
+	if len(t.indexes) == 0 {
+		return
+	}
+
+	keep, discard := t.records(kept), t.records(discarded)
+	for _, x := range t.indexes {
+		for _, d := range discard {
+			vals := x.values(d)
+
+			found := false
+			for _, k := range keep {
+				if sameValues(x.values(k), vals) {
+					found = true
+				}
+			}
+			if !found {
+				x.remove(vals, key)
+			}
+		}
+	}
+}
+
+// records returns the records of the versions of a record which were not
+// deleted.
+func (t *tab) records(versions []version) []map[string]sql.Val {
+	var records []map[string]sql.Val
+	for _, v := range versions {
+		if !v.Deleted {
+			records = append(records, t.decode(v.Data))
+		}
+	}
+
+	return records
+}
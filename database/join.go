@@ -0,0 +1,242 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/alexbostock/alder/sql"
+)
+
+// A joinStrategy is an algorithm for finding pairs of records which satisfy a
+// join condition.
+type joinStrategy int
+
+const (
+	// Compare every pair of records. Works for any comparator.
+	nestedLoopJoin joinStrategy = iota
+	// Build a hash table of the joined table, then probe it with each record
+	// on the left. Requires an equality condition.
+	hashJoin
+	// Get the matching record of the joined table from its store by primary
+	// key. Requires an equality condition on the primary key.
+	primaryKeyJoin
+)
+
+// joinStrategy returns the strategy best suited to a join's condition.
+func (db *Db) joinStrategy(j sql.Join) joinStrategy {
+	if j.Comparator != sql.EqualTo {
+		return nestedLoopJoin
+	}
+
+	if strings.TrimPrefix(j.Right, j.Table+".") == db.schema.GetTable(j.Table).GetPrimaryKey() {
+		return primaryKeyJoin
+	}
+
+	return hashJoin
+}
+
+// A joinOp combines the records of its input (whose keys are qualified by table
+// name) with the records of the joined table which satisfy a join condition, by
+// a join strategy. The records of its input are joined one at a time, and for
+// right and outer joins, followed by the records of the joined table which
+// matched none of them. Hash and nested loop joins read the whole joined table
+// when they are opened.
+type joinOp struct {
+	db       *Db
+	input    operator
+	j        sql.Join
+	strategy joinStrategy
+
+	// Plan step counting the records read from the joined table, or nil, and
+	// the start of the query
+	read  *planNode
+	start time.Time
+
+	right   []map[string]sql.Val // Records of the joined table, for hash and nested loop joins
+	buckets map[string][]map[string]sql.Val
+	pending []map[string]sql.Val // Joined records not yet returned
+	done    bool                 // Whether the records of the input have all been read
+
+	// Unmatched records of the joined table are identified by primary key, and
+	// for primary key joins, read by a scan after those of the input
+	primary   string
+	matched   map[int]bool
+	unmatched operator
+}
+
+func (j *joinOp) Open() error {
+	j.primary = j.db.schema.GetTable(j.j.Table).GetPrimaryKey()
+	if j.j.Type == sql.RightJoin || j.j.Type == sql.OuterJoin {
+		j.matched = make(map[int]bool)
+	}
+
+	switch j.strategy {
+	case primaryKeyJoin:
+	case hashJoin:
+		j.right = j.db.scanQualified(j.j.Table, wholeTable)
+
+		j.buckets = make(map[string][]map[string]sql.Val)
+		for _, record := range j.right {
+			if val, ok := record[j.j.Right]; ok {
+				j.buckets[valueId(val)] = append(j.buckets[valueId(val)], record)
+			}
+		}
+	case nestedLoopJoin:
+		j.right = j.db.scanQualified(j.j.Table, wholeTable)
+	default:
+		panic(errors.New("Invalid join strategy"))
+	}
+	j.read.produced(len(j.right))
+	j.read.finish(j.start)
+
+	return j.input.Open()
+}
+
+func (j *joinOp) Next() (map[string]sql.Val, error) {
+	for len(j.pending) == 0 {
+		if j.done {
+			return j.nextUnmatched()
+		}
+
+		record, err := j.input.Next()
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			j.done = true
+			continue
+		}
+
+		j.pending = j.matches(record)
+		if len(j.pending) == 0 && (j.j.Type == sql.LeftJoin || j.j.Type == sql.OuterJoin) {
+			return record, nil
+		}
+	}
+
+	record := j.pending[0]
+	j.pending = j.pending[1:]
+	return record, nil
+}
+
+// matches returns a record of the input joined with each record of the joined
+// table which it matches.
+func (j *joinOp) matches(left map[string]sql.Val) []map[string]sql.Val {
+	a, ok := left[j.j.Left]
+	if !ok {
+		return nil
+	}
+
+	var right []map[string]sql.Val
+	switch j.strategy {
+	case primaryKeyJoin:
+		t := j.db.tables[j.j.Table]
+		if data := t.store.Get(a.Num); data != nil {
+			j.read.produced(1)
+			j.read.finish(j.start)
+			right = append(right, t.qualify(j.j.Table, j.primary, a.Num, data))
+		}
+	case hashJoin:
+		right = j.buckets[valueId(a)]
+	case nestedLoopJoin:
+		for _, record := range j.right {
+			if b, ok := record[j.j.Right]; ok && j.j.Comparator.Test(a, b) {
+				right = append(right, record)
+			}
+		}
+	}
+
+	result := make([]map[string]sql.Val, len(right))
+	for i, record := range right {
+		if j.matched != nil {
+			j.matched[record[j.j.Table+"."+j.primary].Num] = true
+		}
+		result[i] = merge(left, record)
+	}
+
+	return result
+}
+
+// nextUnmatched returns the next record of the joined table of a right or
+// outer join which matched no record of the input, or nil after the last.
+func (j *joinOp) nextUnmatched() (map[string]sql.Val, error) {
+	if j.matched == nil {
+		return nil, nil
+	}
+
+	for {
+		var record map[string]sql.Val
+		if j.strategy == primaryKeyJoin {
+			if j.unmatched == nil {
+				t := j.db.tables[j.j.Table]
+				j.unmatched = &scanOp{t: t, table: j.j.Table, primary: j.primary, path: wholeTable, qualified: true}
+				if err := j.unmatched.Open(); err != nil {
+					return nil, err
+				}
+			}
+
+			var err error
+			if record, err = j.unmatched.Next(); record == nil || err != nil {
+				return nil, err
+			}
+			j.read.produced(1)
+			j.read.finish(j.start)
+		} else {
+			if len(j.right) == 0 {
+				return nil, nil
+			}
+			record, j.right = j.right[0], j.right[1:]
+		}
+
+		if !j.matched[record[j.j.Table+"."+j.primary].Num] {
+			return record, nil
+		}
+	}
+}
+
+func (j *joinOp) Close() {
+	j.input.Close()
+	if j.unmatched != nil {
+		j.unmatched.Close()
+	}
+}
+
+// scanQualified returns the records of a table with primary keys in an access
+// path, with keys qualified by the table name. The residual filters of the path
+// are not checked.
+func (db *Db) scanQualified(table string, path accessPath) []map[string]sql.Val {
+	primaryKey := db.schema.GetTable(table).GetPrimaryKey()
+
+	var result []map[string]sql.Val
+	t := db.tables[table]
+	t.scanPath(path, func(key int, val []byte) bool {
+		result = append(result, t.qualify(table, primaryKey, key, val))
+		return true
+	})
+
+	return result
+}
+
+// qualify decodes a record of the table, qualifying its keys with the table
+// name.
+func (t *tab) qualify(table, primary string, key int, val []byte) map[string]sql.Val {
+	record := make(map[string]sql.Val)
+	for field, v := range t.decode(val) {
+		record[table+"."+field] = v
+	}
+	record[table+"."+primary] = sql.Val{IsNum: true, Num: key}
+
+	return record
+}
+
+func merge(a, b map[string]sql.Val) map[string]sql.Val {
+	record := make(map[string]sql.Val, len(a)+len(b))
+	for k, v := range a {
+		record[k] = v
+	}
+	for k, v := range b {
+		record[k] = v
+	}
+
+	return record
+}
@@ -0,0 +1,330 @@
+package database
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexbostock/alder/sql"
+)
+
+// The stores of a database's tables hold a chain of versions of each record.
+// Each committed transaction is numbered by a commit sequence number (CSN),
+// and each version is stamped with the CSN of the transaction which wrote it.
+// A snapshot of the database at CSN n sees, for each record, the newest
+// version stamped with a CSN of at most n.
+
+// A version is a record as written by one transaction.
+type version struct {
+	Csn     int
+	Deleted bool
+	Data    []byte // Serialised record, or nil if Deleted
+}
+
+func encodeChain(chain []version) []byte {
+	encoded := new(bytes.Buffer)
+	gob.NewEncoder(encoded).Encode(chain)
+
+	return encoded.Bytes()
+}
+
+func decodeChain(data []byte) ([]version, error) {
+	var chain []version
+	if data == nil {
+		return chain, nil
+	}
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&chain)
+	return chain, err
+}
+
+// mustDecodeChain decodes a version chain, reporting corrupt chains in the same
+// way as decode.
+func mustDecodeChain(data []byte) []version {
+	chain, err := decodeChain(data)
+	if err != nil {
+		panic(&StorageError{"", "decode", err})
+	}
+
+	return chain
+}
+
+// visible returns the data of the version of a record seen by a snapshot at
+// the given CSN, or nil if the record does not exist in the snapshot. Chains
+// are ordered newest first.
+func visible(chain []version, csn int) []byte {
+	for _, v := range chain {
+		if v.Csn <= csn {
+			if v.Deleted {
+				return nil
+			}
+			return v.Data
+		}
+	}
+
+	return nil
+}
+
+// latest returns the CSN of the newest version in a chain, or 0 if there are
+// none.
+func latest(chain []version) int {
+	if len(chain) == 0 {
+		return 0
+	}
+	return chain[0].Csn
+}
+
+// A snapshotStore is a read-only Store presenting the records of a table as
+// seen by a snapshot. Changes are made through a store.Overlay, and applied by
+// committing a Tx.
+type snapshotStore struct {
+	t   *tab // Table holding the version chains
+	csn int
+}
+
+func (s *snapshotStore) Get(key int) []byte {
+	s.t.mu.RLock()
+	chain := s.t.store.Get(key)
+	s.t.mu.RUnlock()
+
+	return visible(mustDecodeChain(chain), s.csn)
+}
+
+// Scan holds a read lock on the table while it runs, so f must not read the
+// same table.
+func (s *snapshotStore) Scan(minKey, maxKey int, f func(int, []byte) bool) {
+	s.t.mu.RLock()
+	defer s.t.mu.RUnlock()
+
+	s.t.store.Scan(minKey, maxKey, func(key int, val []byte) bool {
+		if data := visible(mustDecodeChain(val), s.csn); data != nil {
+			return f(key, data)
+		}
+		return true
+	})
+}
+
+func (s *snapshotStore) GetRange(minKey, maxKey int) map[int][]byte {
+	result := make(map[int][]byte)
+	s.Scan(minKey, maxKey, func(key int, val []byte) bool {
+		result[key] = val
+		return true
+	})
+
+	return result
+}
+
+func (s *snapshotStore) GetAllWhere(pred func(int, []byte) bool) map[int][]byte {
+	result := make(map[int][]byte)
+	s.Scan(minKey, maxKey, func(key int, val []byte) bool {
+		if pred(key, val) {
+			result[key] = val
+		}
+		return true
+	})
+
+	return result
+}
+
+func (s *snapshotStore) Insert(int, []byte) bool                                    { return false }
+func (s *snapshotStore) Update(int, func([]byte) []byte) bool                       { return false }
+func (s *snapshotStore) Delete(int) bool                                            { return false }
+func (s *snapshotStore) UpdateRange(int, int, func([]byte) []byte)                  {}
+func (s *snapshotStore) UpdateAllWhere(func(int, []byte) bool, func([]byte) []byte) {}
+
+// view returns a read-only view of the database as seen by a snapshot at the
+// given CSN. The snapshot should be acquired while the view is in use, so that
+// it is not vacuumed.
+func (db *Db) view(csn int) *Db {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	v := &Db{
+		schema:          db.schema,
+		tables:          make(map[string]*tab, len(db.tables)),
+		version:         db.version,
+		cache:           db.cache,
+		sortMemory:      atomic.LoadInt64(&db.sortMemory),
+		branchingFactor: db.branchingFactor,
+		parent:          db,
+	}
+
+	for name, t := range db.tables {
+		v.tables[name] = &tab{store: &snapshotStore{t, csn}, base: t, history: t.history, layouts: t.layouts, indexes: t.indexes}
+	}
+
+	return v
+}
+
+// root returns the database of which db is a view, or db if it is not a view.
+func (db *Db) root() *Db {
+	if db.parent != nil {
+		return db.parent
+	}
+	return db
+}
+
+// acquire returns the CSN of the current snapshot, which is not vacuumed until
+// it is released.
+func (db *Db) acquire() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.active[db.csn]++
+	return db.csn
+}
+
+// acquireAsOf returns the CSN of the snapshot identified by an AS OF clause,
+// which is not vacuumed until it is released.
+func (db *Db) acquireAsOf(a *sql.AsOf) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	csn := a.Txid
+
+	if !a.Time.IsZero() {
+		// Find the last transaction committed at or before the time
+		csn = 0
+		for csn < len(db.commits) && !db.commits[csn].After(a.Time) {
+			csn++
+		}
+	}
+
+	switch {
+	case csn > db.csn:
+		return 0, &SnapshotError{csn, "transaction has not been committed"}
+	case csn < db.horizon:
+		return 0, &SnapshotError{csn, fmt.Sprintf("versions before transaction %d have been vacuumed", db.horizon)}
+	}
+
+	db.active[csn]++
+	return csn, nil
+}
+
+func (db *Db) release(csn int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.active[csn]--
+	if db.active[csn] == 0 {
+		delete(db.active, csn)
+	}
+}
+
+// commit appends versions stamped with a new CSN to the changed records, and
+// returns the CSN. Changes are given per table as maps of keys to new data,
+// with nil data for deleted records. The caller must hold commitMu.
+//
+// Tables are locked one at a time, but the new versions are not seen by any
+// snapshot until every table has been changed, when the CSN is advanced.
+func (db *Db) commit(changes map[string]map[int][]byte) int {
+	db.mu.Lock()
+	csn := db.csn + 1
+	db.mu.Unlock()
+
+	for name, records := range changes {
+		t := db.tables[name]
+		t.mu.Lock()
+		versions := t.store
+		for key, data := range records {
+			v := version{csn, data == nil, data}
+
+			if !versions.Update(key, func(old []byte) []byte {
+				return encodeChain(append([]version{v}, mustDecodeChain(old)...))
+			}) && data != nil {
+				versions.Insert(key, encodeChain([]version{v}))
+			}
+
+			if data != nil {
+				t.indexVersion(key, data)
+			}
+		}
+		t.mu.Unlock()
+	}
+
+	db.mu.Lock()
+	db.csn = csn
+	db.commits = append(db.commits, time.Now())
+	db.mu.Unlock()
+
+	return csn
+}
+
+// latestCsn returns the CSN of the newest version of a record.
+func (t *tab) latestCsn(key int) int {
+	t.mu.RLock()
+	chain := t.store.Get(key)
+	t.mu.RUnlock()
+
+	return latest(mustDecodeChain(chain))
+}
+
+// Vacuum discards the versions of records which are not seen by any snapshot
+// at or after the given CSN, and returns the number of versions discarded. It
+// keeps the versions seen by active transactions, so the CSN may be reduced to
+// that of the oldest active transaction. After a vacuum, AS OF queries cannot
+// read snapshots before the CSN.
+func (db *Db) Vacuum(csn int) (discarded int, err error) {
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+
+	defer recoverStorageError(&err)
+
+	db.mu.Lock()
+	if csn > db.csn {
+		csn = db.csn
+	}
+	for snapshot := range db.active {
+		if snapshot < csn {
+			csn = snapshot
+		}
+	}
+	if csn <= db.horizon {
+		db.mu.Unlock()
+		return 0, nil
+	}
+	db.horizon = csn
+	db.mu.Unlock()
+
+	for _, t := range db.tables {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		pruned := make(map[int][]version)
+		discardedVersions := make(map[int][]version)
+		t.store.Scan(minKey, maxKey, func(key int, val []byte) bool {
+			chain := mustDecodeChain(val)
+
+			// Keep the versions newer than the snapshot, and the one it sees
+			keep := 0
+			for keep < len(chain) && chain[keep].Csn > csn {
+				keep++
+			}
+			if keep < len(chain) && !chain[keep].Deleted {
+				keep++
+			}
+
+			if keep < len(chain) {
+				discarded += len(chain) - keep
+				pruned[key] = chain[:keep]
+				discardedVersions[key] = chain[keep:]
+			}
+			return true
+		})
+
+		for key, chain := range pruned {
+			t.unindexVersions(key, chain, discardedVersions[key])
+			if len(chain) == 0 {
+				t.store.Delete(key)
+			} else {
+				t.store.Update(key, func([]byte) []byte {
+					return encodeChain(chain)
+				})
+			}
+		}
+	}
+
+	return discarded, nil
+}
@@ -0,0 +1,456 @@
+package database
+
+import (
+	"time"
+
+	"github.com/alexbostock/alder/sql"
+)
+
+// scanBatch is the largest number of records a scan reads from its table at
+// once.
+const scanBatch = 64
+
+// An operator executes a step of a query, producing records one at a time.
+// Open prepares it to produce records, each call to Next returns the next
+// record, or nil after the last, and Close releases its resources, whether or
+// not it was opened. Operators read records from their inputs only as they need
+// them, so records stream through a query: only sorts and aggregations, which
+// spill to disk, and the joined tables of hash and nested loop joins are held
+// in full.
+type operator interface {
+	Open() error
+	Next() (map[string]sql.Val, error)
+	Close()
+}
+
+// A scanOp reads the records of a table with primary keys in an access path,
+// in primary key order, as a full scan, a Get or a GetRange. Records are read
+// from the table's B+ tree in batches, each starting after the last key of the
+// one before, so the tree is not locked between batches. Each batch is twice
+// the size of the one before, up to scanBatch, so a scan which is not read to
+// the end reads few more records than are needed.
+type scanOp struct {
+	t         *tab
+	table     string
+	primary   string
+	path      accessPath
+	qualified bool // Whether keys are qualified by the table name, as for joins
+
+	from  int  // Smallest key not yet read
+	size  int  // Size of the next batch
+	done  bool // Whether the last batch has been read
+	batch []map[string]sql.Val
+}
+
+func (s *scanOp) Open() error {
+	s.from, s.size, s.done = s.path.min, 1, s.path.empty()
+	return nil
+}
+
+func (s *scanOp) Next() (map[string]sql.Val, error) {
+	if len(s.batch) == 0 && !s.done {
+		s.read()
+	}
+	if len(s.batch) == 0 {
+		return nil, nil
+	}
+
+	record := s.batch[0]
+	s.batch = s.batch[1:]
+	return record, nil
+}
+
+// read reads the next batch of records.
+func (s *scanOp) read() {
+	s.batch = make([]map[string]sql.Val, 0, s.size)
+
+	last := s.from
+	s.t.scanPath(accessPath{min: s.from, max: s.path.max}, func(key int, val []byte) bool {
+		s.batch = append(s.batch, s.t.record(s.table, s.primary, key, val, s.qualified))
+		last = key
+		return len(s.batch) < s.size
+	})
+
+	// No record follows the last key of the path
+	s.done = len(s.batch) < s.size || last == s.path.max
+	s.from = last + 1
+	s.size = minInt(2*s.size, scanBatch)
+}
+
+func (s *scanOp) Close() {
+	s.batch = nil
+}
+
+// record returns the record of a table with the given primary key and stored
+// value, whose keys are qualified by the table name if qualified is true.
+func (t *tab) record(table, primary string, key int, val []byte, qualified bool) map[string]sql.Val {
+	if qualified {
+		return t.qualify(table, primary, key, val)
+	}
+
+	record := t.decode(val)
+	record[primary] = sql.Val{IsNum: true, Num: key}
+	return record
+}
+
+// An indexSeekOp reads the records of a table found by a secondary index, with
+// primary keys in an access path, in primary key order. The primary keys are
+// found when it is opened, and each record is then read by its key, and
+// checked against the conditions of the index path, since the index may have
+// entries for values which the record does not have in the snapshot read.
+type indexSeekOp struct {
+	t         *tab
+	table     string
+	primary   string
+	path      accessPath
+	seek      indexPath
+	qualified bool
+
+	keys []int // Primary keys of the records not yet read
+}
+
+func (s *indexSeekOp) Open() error {
+	s.keys = s.t.seek(s.seek, s.path)
+	return nil
+}
+
+func (s *indexSeekOp) Next() (map[string]sql.Val, error) {
+	for len(s.keys) > 0 {
+		key := s.keys[0]
+		s.keys = s.keys[1:]
+
+		val := s.t.store.Get(key)
+		if val == nil {
+			continue
+		}
+
+		record := s.t.record(s.table, s.primary, key, val, s.qualified)
+		if s.seek.where.Eval(record) {
+			return record, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *indexSeekOp) Close() {
+	s.keys = nil
+}
+
+// A filterOp returns the records of its input which satisfy a WHERE clause.
+type filterOp struct {
+	input operator
+	where sql.WhereClause
+}
+
+func (f *filterOp) Open() error {
+	return f.input.Open()
+}
+
+func (f *filterOp) Next() (map[string]sql.Val, error) {
+	for {
+		record, err := f.input.Next()
+		if record == nil || err != nil {
+			return nil, err
+		}
+
+		if f.where.Eval(record) {
+			return record, nil
+		}
+	}
+}
+
+func (f *filterOp) Close() {
+	f.input.Close()
+}
+
+// A projectOp removes the fields of the records of its input which are not
+// selected.
+type projectOp struct {
+	input operator
+	keys  map[string]bool
+}
+
+func newProjectOp(input operator, keys []string) *projectOp {
+	p := &projectOp{input, make(map[string]bool, len(keys))}
+	for _, key := range keys {
+		p.keys[key] = true
+	}
+
+	return p
+}
+
+func (p *projectOp) Open() error {
+	return p.input.Open()
+}
+
+func (p *projectOp) Next() (map[string]sql.Val, error) {
+	record, err := p.input.Next()
+	if record == nil || err != nil {
+		return nil, err
+	}
+
+	for key := range record {
+		if !p.keys[key] {
+			delete(record, key)
+		}
+	}
+
+	return record, nil
+}
+
+func (p *projectOp) Close() {
+	p.input.Close()
+}
+
+// A limitOp skips offset records of its input, then returns up to limit of
+// them, or all of them if limit is negative. It reads no more records than it
+// needs.
+type limitOp struct {
+	input             operator
+	offset, limit     int
+	skipped, returned int
+}
+
+func (l *limitOp) Open() error {
+	return l.input.Open()
+}
+
+func (l *limitOp) Next() (map[string]sql.Val, error) {
+	if l.limit >= 0 && l.returned >= l.limit {
+		return nil, nil
+	}
+
+	for l.skipped < l.offset {
+		record, err := l.input.Next()
+		if record == nil || err != nil {
+			return nil, err
+		}
+		l.skipped++
+	}
+
+	record, err := l.input.Next()
+	if record != nil {
+		l.returned++
+	}
+	return record, err
+}
+
+func (l *limitOp) Close() {
+	l.input.Close()
+}
+
+// A sortOp returns the records of its input sorted by a sorter. It reads all of
+// them when it is opened.
+type sortOp struct {
+	input operator
+	s     *sorter
+	table string // Table of the query, which reports errors
+}
+
+func (s *sortOp) Open() error {
+	if err := s.input.Open(); err != nil {
+		return err
+	}
+
+	for {
+		record, err := s.input.Next()
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			break
+		}
+
+		if err := s.s.add(record); err != nil {
+			return &StorageError{s.table, "sort", err}
+		}
+	}
+
+	if err := s.s.sort(); err != nil {
+		return &StorageError{s.table, "sort", err}
+	}
+	return nil
+}
+
+func (s *sortOp) Next() (map[string]sql.Val, error) {
+	record, err := s.s.next()
+	if err != nil {
+		return nil, &StorageError{s.table, "sort", err}
+	}
+	return record, nil
+}
+
+func (s *sortOp) Close() {
+	s.s.close()
+	s.input.Close()
+}
+
+// An aggregateOp returns a record for each group of the records of its input,
+// computed by an aggregator. It reads all of them when it is opened.
+type aggregateOp struct {
+	input operator
+	g     *aggregator
+	table string // Table of the query, which reports errors
+}
+
+func (a *aggregateOp) Open() error {
+	if err := a.input.Open(); err != nil {
+		return err
+	}
+
+	for {
+		record, err := a.input.Next()
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			break
+		}
+
+		if err := a.g.add(record); err != nil {
+			return &StorageError{a.table, "aggregate", err}
+		}
+	}
+
+	if err := a.g.sort(); err != nil {
+		return &StorageError{a.table, "aggregate", err}
+	}
+	return nil
+}
+
+func (a *aggregateOp) Next() (map[string]sql.Val, error) {
+	record, err := a.g.next()
+	if err != nil {
+		return nil, &StorageError{a.table, "aggregate", err}
+	}
+	return record, nil
+}
+
+func (a *aggregateOp) Close() {
+	a.g.sorted.close()
+	a.input.Close()
+}
+
+// A setOp applies a set operation to the records of two queries. Records from
+// the right query are renamed to use the field names of the left query. The
+// records of the right query are read when it is opened for an intersection or
+// difference, and after those of the left query for a union.
+type setOp struct {
+	left, right     operator
+	operation       sql.SetOperation
+	keys, rightKeys []string
+
+	seen    map[string]bool // Ids of the records returned, which are not returned again
+	other   map[string]bool // Ids of the records of the right query
+	onRight bool            // Whether the records of the left query have all been read
+}
+
+func (s *setOp) Open() error {
+	if err := s.left.Open(); err != nil {
+		return err
+	}
+	if err := s.right.Open(); err != nil {
+		return err
+	}
+
+	s.seen = make(map[string]bool)
+	if s.operation != sql.Intersection && s.operation != sql.Difference {
+		return nil
+	}
+
+	s.other = make(map[string]bool)
+	for {
+		record, err := s.right.Next()
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			return nil
+		}
+
+		s.other[recordId(record, s.rightKeys)] = true
+	}
+}
+
+func (s *setOp) Next() (map[string]sql.Val, error) {
+	for {
+		var record map[string]sql.Val
+		var err error
+
+		if !s.onRight {
+			record, err = s.left.Next()
+			if record == nil && err == nil && s.other == nil {
+				s.onRight = true
+				continue
+			}
+		} else if record, err = s.right.Next(); record != nil {
+			record = s.rename(record)
+		}
+		if record == nil || err != nil {
+			return nil, err
+		}
+
+		if s.operation == sql.UnionAll {
+			return record, nil
+		}
+
+		id := recordId(record, s.keys)
+		if s.seen[id] || (s.other != nil && s.other[id] != (s.operation == sql.Intersection)) {
+			continue
+		}
+
+		s.seen[id] = true
+		return record, nil
+	}
+}
+
+// rename renames the fields of a record of the right query to those of the
+// left query.
+func (s *setOp) rename(record map[string]sql.Val) map[string]sql.Val {
+	renamed := make(map[string]sql.Val, len(record))
+	for i, key := range s.rightKeys {
+		if val, ok := record[key]; ok {
+			renamed[s.keys[i]] = val
+		}
+	}
+
+	return renamed
+}
+
+func (s *setOp) Close() {
+	s.left.Close()
+	s.right.Close()
+}
+
+// A snapshotOp executes a query reading a past snapshot of a database, which
+// it releases when it is closed.
+type snapshotOp struct {
+	operator
+	db  *Db
+	csn int
+}
+
+func (s *snapshotOp) Close() {
+	s.operator.Close()
+	s.db.release(s.csn)
+}
+
+// A measuredOp records what another operator does in the step of a query plan
+// which it executes: the records it produces, and the time from the start of
+// the query at which it produced the last of them.
+type measuredOp struct {
+	operator
+	node  *planNode
+	start time.Time
+}
+
+func (m *measuredOp) Next() (map[string]sql.Val, error) {
+	record, err := m.operator.Next()
+	if record != nil {
+		m.node.produced(1)
+	}
+	m.node.finish(m.start)
+
+	return record, err
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/alexbostock/alder/schema"
+	"github.com/alexbostock/alder/sql"
+)
+
+var (
+	ErrPageSize     = errors.New("Page size must be positive")
+	ErrInvalidToken = errors.New("Invalid continuation token")
+)
+
+// A Page is a page of the records of a table, returned by Db.Page.
+type Page struct {
+	*Result
+	Next string // Continuation token of the next page, or "" if this is the last page
+}
+
+// Page returns up to size records of a table, with all of its fields, in
+// primary key order. The first page is returned for the token "", and each
+// page but the last has a continuation token for the next.
+//
+// Pages are found by primary key rather than by position: a continuation token
+// holds the key of the last record of its page, and the next page is read by
+// finding the leaf of the table's B+ tree in which the following key would be,
+// then following the chain of leaves. So records before the page are not read,
+// as they are with OFFSET, and records inserted or deleted between pages do not
+// cause others to be skipped or returned twice. Each page is read from the
+// snapshot current when Page is called.
+//
+// Page returns a *schema.Error if the table does not exist, ErrInvalidToken if
+// the token was not returned by a page of the same table, and ErrPageSize if
+// size is not positive.
+func (db *Db) Page(table string, size int, token string) (p *Page, err error) {
+	defer recoverStorageError(&err)
+
+	if size <= 0 {
+		return nil, ErrPageSize
+	}
+
+	start, done := minKey, false
+	if token != "" {
+		last, err := decodeToken(table, token)
+		if err != nil {
+			return nil, err
+		}
+
+		// No record follows the largest key
+		start, done = last+1, last == maxKey
+	}
+
+	csn := db.acquire()
+	defer db.release(csn)
+	view := db.view(csn)
+
+	t, ok := view.tables[table]
+	if !ok {
+		return nil, &schema.Error{Table: table, Msg: "unknown table"}
+	}
+	primaryKey := view.schema.GetTable(table).GetPrimaryKey()
+
+	var records []map[string]sql.Val
+	last, more := 0, false
+
+	if !done {
+		t.store.Scan(start, maxKey, func(key int, val []byte) bool {
+			if len(records) == size {
+				more = true
+				return false
+			}
+
+			record := t.decode(val)
+			record[primaryKey] = sql.Val{IsNum: true, Num: key}
+			records = append(records, record)
+			last = key
+			return true
+		})
+	}
+
+	p = &Page{Result: rowsResult(view.columns(&sql.SelectQuery{Table: table}), records)}
+	if more {
+		p.Next = encodeToken(table, last)
+	}
+
+	return p, nil
+}
+
+// encodeToken returns the continuation token of a page of a table which ends
+// with the record with the given key.
+func encodeToken(table string, last int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(table + ":" + strconv.Itoa(last)))
+}
+
+// decodeToken returns the key of the last record of the page of a table with
+// the given continuation token.
+func decodeToken(table, token string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+
+	i := strings.LastIndex(string(data), ":")
+	if i < 0 || string(data[:i]) != table {
+		return 0, ErrInvalidToken
+	}
+
+	last, err := strconv.Atoi(string(data[i+1:]))
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+
+	return last, nil
+}
@@ -0,0 +1,352 @@
+package database
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/alexbostock/alder/schema"
+	"github.com/alexbostock/alder/sql"
+)
+
+const (
+	catalogFile  = "catalog"
+	manifestFile = "manifest"
+)
+
+// A manifest names the generation of the last checkpoint of a database, whose
+// files are in the generation's directory. Generation 0 is the data directory
+// itself, in which databases were written before checkpoints had generations.
+type manifest struct {
+	Generation int
+}
+
+// A commitLog is the on-disk form of the history of a database's transactions.
+type commitLog struct {
+	Commits []time.Time
+	Horizon int
+}
+
+// A snapshot is the on-disk form of a table: its records, in primary key
+// order.
+type snapshot struct {
+	Keys   []int
+	Values [][]byte
+}
+
+// Open returns a database whose tables are loaded from the last checkpoint in
+// the data directory dir, which is created if it does not exist. Changes are
+// written back to dir by Checkpoint and Close.
+//
+// The tables are described by the catalog in the data directory. Tables and
+// indexes of the schema s which are not in the catalog are created, with B+
+// trees of the given branching factor, so s may be the zero Schema to open an
+// existing database. Open returns a *schema.Error if a table or index of s does
+// not match the catalog.
+func Open(dir string, branchingFactor int, s schema.Schema) (db *Db, err error) {
+	defer recoverStorageError(&err)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, &StorageError{"", "open", err}
+	}
+
+	var m manifest
+	if err := readFile(filepath.Join(dir, manifestFile), &m); err != nil {
+		return nil, &StorageError{"", "load", err}
+	}
+
+	var cat catalog
+	if err := readFile(generationPath(dir, m.Generation, catalogFile), &cat); err != nil {
+		return nil, &StorageError{"", "load", err}
+	}
+	if err := cat.merge(s, branchingFactor); err != nil {
+		return nil, err
+	}
+
+	db = New(branchingFactor, cat.schema())
+	db.dir, db.generation = dir, m.Generation
+
+	for _, ct := range cat.Tables {
+		t := newTab(ct.BranchingFactor, ct.Fields)
+		t.nextPrimaryKey = int64(ct.NextPrimaryKey)
+		db.tables[ct.Name] = t
+		if ct.Statistics != nil {
+			if db.stats == nil {
+				db.stats = make(map[string]*tableStats)
+			}
+			db.stats[ct.Name] = ct.Statistics
+		}
+
+		var upgrade func([]byte) ([]byte, error)
+		if ct.Format == gobRows {
+			// The records are converted to the compact form of the table's
+			// fields as they are now, so its history is no longer needed
+			history := ct.History
+			upgrade = func(chain []byte) ([]byte, error) {
+				return t.upgrade(history, chain)
+			}
+		} else {
+			t.history, t.layouts = ct.History, ct.Layouts
+		}
+
+		if err := t.load(db.tablePath(db.generation, ct.Name), upgrade); err != nil {
+			return nil, &StorageError{ct.Name, "load", err}
+		}
+
+		// Indexes are not saved, but built from the records
+		t.indexes = t.indexed(ct.Indexes)
+	}
+
+	var log commitLog
+	if err := readFile(db.commitLogPath(db.generation), &log); err != nil {
+		return nil, &StorageError{"", "load", err}
+	}
+	db.commits = log.Commits
+	db.csn = len(log.Commits)
+	db.horizon = log.Horizon
+
+	return db, nil
+}
+
+// Checkpoint writes every table, the catalog and the commit log to the data
+// directory. They are written, and synced to disk, in the directory of a new
+// generation, which replaces the previous one when the manifest naming it is
+// renamed into place. A checkpoint which fails, or is interrupted by a crash,
+// therefore leaves the previous one intact.
+func (db *Db) Checkpoint() error {
+	if db.dir == "" {
+		return nil
+	}
+
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+
+	// Files left by a checkpoint of the same generation which failed are
+	// discarded
+	generation := db.generation + 1
+	genDir := generationPath(db.dir, generation, "")
+	if err := os.RemoveAll(genDir); err != nil {
+		return &StorageError{"", "checkpoint", err}
+	}
+	if err := os.Mkdir(genDir, 0755); err != nil {
+		return &StorageError{"", "checkpoint", err}
+	}
+
+	for name, t := range db.tables {
+		if err := t.save(db.tablePath(generation, name)); err != nil {
+			return &StorageError{name, "checkpoint", err}
+		}
+	}
+
+	if err := writeFile(db.catalogPath(generation), db.catalog()); err != nil {
+		return &StorageError{"", "checkpoint", err}
+	}
+
+	db.mu.Lock()
+	log := commitLog{db.commits, db.horizon}
+	db.mu.Unlock()
+
+	if err := writeFile(db.commitLogPath(generation), log); err != nil {
+		return &StorageError{"", "checkpoint", err}
+	}
+
+	if err := syncDir(genDir); err != nil {
+		return &StorageError{"", "checkpoint", err}
+	}
+	if err := syncDir(db.dir); err != nil {
+		return &StorageError{"", "checkpoint", err}
+	}
+	if err := writeFile(filepath.Join(db.dir, manifestFile), manifest{generation}); err != nil {
+		return &StorageError{"", "checkpoint", err}
+	}
+	if err := syncDir(db.dir); err != nil {
+		return &StorageError{"", "checkpoint", err}
+	}
+
+	// The previous generation, with the files of dropped tables, is no
+	// longer needed
+	db.generation = generation
+	if err := removeGenerations(db.dir, generation); err != nil {
+		return &StorageError{"", "checkpoint", err}
+	}
+
+	return nil
+}
+
+// Close writes the database to its data directory, if it has one.
+func (db *Db) Close() error {
+	return db.Checkpoint()
+}
+
+// generationPath returns the path of a file of a generation of the checkpoints
+// in the data directory dir, or of the generation's directory if file is "".
+func generationPath(dir string, generation int, file string) string {
+	if generation > 0 {
+		dir = filepath.Join(dir, "checkpoint-"+strconv.Itoa(generation))
+	}
+
+	return filepath.Join(dir, file)
+}
+
+// removeGenerations removes the files of every generation of the checkpoints in
+// the data directory dir except the given one, including those left by
+// checkpoints which failed or were interrupted.
+func removeGenerations(dir string, generation int) error {
+	files, err := filepath.Glob(filepath.Join(dir, "checkpoint-*"))
+	if err != nil {
+		return err
+	}
+	if generation > 0 {
+		tables, err := filepath.Glob(filepath.Join(dir, "*.tab"))
+		if err != nil {
+			return err
+		}
+		files = append(files, tables...)
+		files = append(files, filepath.Join(dir, catalogFile), filepath.Join(dir, "commits"))
+	}
+
+	for _, file := range files {
+		if file == generationPath(dir, generation, "") {
+			continue
+		}
+		if err := os.RemoveAll(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *Db) tablePath(generation int, table string) string {
+	return generationPath(db.dir, generation, table+".tab")
+}
+
+func (db *Db) catalogPath(generation int) string {
+	return generationPath(db.dir, generation, catalogFile)
+}
+
+func (db *Db) commitLogPath(generation int) string {
+	return generationPath(db.dir, generation, "commits")
+}
+
+// load reads a table written by save. A missing file is an empty table. The
+// primary key sequence is advanced past the keys of the records, in case it was
+// not saved. If upgrade is not nil, it converts each version chain as it is
+// read.
+func (t *tab) load(path string, upgrade func([]byte) ([]byte, error)) error {
+	var snap snapshot
+	if err := readFile(path, &snap); err != nil {
+		return err
+	}
+
+	for i, key := range snap.Keys {
+		chain := snap.Values[i]
+		if upgrade != nil {
+			var err error
+			if chain, err = upgrade(chain); err != nil {
+				return err
+			}
+		}
+
+		t.store.Insert(key, chain)
+		if int64(key) >= t.nextPrimaryKey {
+			t.nextPrimaryKey = int64(key) + 1
+		}
+	}
+
+	return nil
+}
+
+// upgrade converts a version chain of records in the gob form, written by a
+// table with the given history, to one of records in the compact form of the
+// table's current version.
+func (t *tab) upgrade(history []sql.Alteration, chain []byte) ([]byte, error) {
+	versions, err := decodeChain(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range versions {
+		if v.Deleted {
+			continue
+		}
+
+		record, err := decodeGobRow(history, v.Data)
+		if err != nil {
+			return nil, err
+		}
+		versions[i].Data = t.encode(record)
+	}
+
+	return encodeChain(versions), nil
+}
+
+func (t *tab) save(path string) error {
+	var snap snapshot
+
+	t.mu.RLock()
+	t.store.Scan(minKey, maxKey, func(key int, val []byte) bool {
+		snap.Keys = append(snap.Keys, key)
+		snap.Values = append(snap.Values, val)
+		return true
+	})
+	t.mu.RUnlock()
+
+	return writeFile(path, snap)
+}
+
+// readFile decodes a file written by writeFile into v, leaving v unchanged if
+// the file does not exist.
+func readFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gob.NewDecoder(f).Decode(v)
+}
+
+// writeFile encodes v to a temporary file, which is synced to disk and then
+// replaces the file at path. The rename is only durable once the directory is
+// synced.
+func writeFile(path string, v interface{}) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// syncDir syncs a directory to disk, so that the files created and renamed in
+// it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
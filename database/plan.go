@@ -0,0 +1,432 @@
+package database
+
+import (
+	"strings"
+
+	"github.com/alexbostock/alder/schema"
+	"github.com/alexbostock/alder/sql"
+)
+
+// The smallest and largest possible primary keys
+const (
+	maxKey = int(^uint(0) >> 1)
+	minKey = -maxKey - 1
+)
+
+// An accessPath describes which records of a table need to be read to answer
+// a WHERE clause. Conditions comparing the primary key with a literal are
+// turned into an inclusive range of keys, so only that range of the tree is
+// visited. The remaining conditions must still be checked for every record.
+type accessPath struct {
+	min, max int
+	residual sql.WhereClause
+}
+
+// wholeTable is the access path of every record of a table.
+var wholeTable = accessPath{min: minKey, max: maxKey}
+
+func (p accessPath) empty() bool {
+	return p.min > p.max
+}
+
+func (p accessPath) point() bool {
+	return p.min == p.max
+}
+
+func (p accessPath) fullScan() bool {
+	return p.min == minKey && p.max == maxKey
+}
+
+// planAccess splits a WHERE clause on a table with the given primary key into
+// a range of primary keys and residual filters.
+func planAccess(where sql.WhereClause, primary string) accessPath {
+	path := accessPath{min: minKey, max: maxKey}
+
+	for _, f := range where.Filters {
+		c, v, ok := keyCondition(f, primary)
+		if !ok {
+			path.residual.Filters = append(path.residual.Filters, f)
+			continue
+		}
+
+		switch c {
+		case sql.LessThan:
+			if v == minKey {
+				return accessPath{min: 1, max: 0}
+			}
+			path.max = minInt(path.max, v-1)
+		case sql.GreaterThan:
+			if v == maxKey {
+				return accessPath{min: 1, max: 0}
+			}
+			path.min = maxInt(path.min, v+1)
+		case sql.EqualTo:
+			path.min = maxInt(path.min, v)
+			path.max = minInt(path.max, v)
+		}
+	}
+
+	return path
+}
+
+// keyCondition determines whether a filter compares the primary key with a
+// literal other than NULL, and is not negated. If so, it returns the filter
+// rewritten in the form key <c> v.
+func keyCondition(f sql.Filter, primary string) (c sql.Comparator, v int, ok bool) {
+	switch {
+	case f.Negated || f.Comparator == sql.IsNull || f.Comparator == sql.IsNotNull:
+		return 0, 0, false
+	case f.Left.Val.Null || f.Right.Val.Null:
+		return 0, 0, false
+	case f.Left.Key == primary && f.Right.Key == "":
+		return f.Comparator, f.Right.Val.Num, true
+	case f.Right.Key == primary && f.Left.Key == "":
+		return f.Comparator.Flip(), f.Left.Val.Num, true
+	default:
+		return 0, 0, false
+	}
+}
+
+// An indexPath describes the records of a table found by a secondary index:
+// those with entries in an inclusive range of its buckets whose values satisfy
+// conditions comparing indexed fields with literals. The records found are
+// checked against the conditions again as they are read.
+type indexPath struct {
+	index    schema.Index
+	keys     []string        // Indexed fields, as named by the query
+	min, max int             // Keys of the buckets read
+	where    sql.WhereClause // Conditions on the indexed fields
+}
+
+// matches returns true iff the values of an index entry satisfy the
+// conditions of the path.
+func (p indexPath) matches(vals []sql.Val) bool {
+	record := make(map[string]sql.Val, len(vals))
+	for i, v := range vals {
+		record[p.keys[i]] = v
+	}
+
+	return p.where.Eval(record)
+}
+
+// planIndex splits filters into the conditions of a path through an index, and
+// the remaining filters. Indexed fields are named by the qualifier followed by
+// their names. It returns false if no condition is on the first indexed field,
+// by whose values the index's buckets are keyed.
+func planIndex(where sql.WhereClause, i schema.Index, qualifier string) (indexPath, sql.WhereClause, bool) {
+	p := indexPath{index: i, min: minKey, max: maxKey}
+	for _, field := range i.Fields {
+		p.keys = append(p.keys, qualifier+field)
+	}
+
+	var residual sql.WhereClause
+	first := false
+	for _, f := range where.Filters {
+		key, c, v, ok := indexCondition(f, p.keys)
+		if !ok {
+			residual.Filters = append(residual.Filters, f)
+			continue
+		}
+
+		p.where.Filters = append(p.where.Filters, f)
+		if key != p.keys[0] {
+			continue
+		}
+
+		// Buckets may hold values on either side of v
+		first = true
+		switch c {
+		case sql.LessThan:
+			p.max = minInt(p.max, bucketKey(v))
+		case sql.GreaterThan:
+			p.min = maxInt(p.min, bucketKey(v))
+		case sql.EqualTo:
+			p.min = maxInt(p.min, bucketKey(v))
+			p.max = minInt(p.max, bucketKey(v))
+		}
+	}
+
+	return p, residual, first
+}
+
+// indexCondition determines whether a filter compares one of the given keys
+// with a literal other than NULL, and is not negated. If so, it returns the
+// filter rewritten in the form key <c> v.
+func indexCondition(f sql.Filter, keys []string) (key string, c sql.Comparator, v sql.Val, ok bool) {
+	switch {
+	case f.Negated || f.Comparator == sql.IsNull || f.Comparator == sql.IsNotNull:
+	case f.Left.Val.Null || f.Right.Val.Null:
+	case f.Right.Key == "" && contains(keys, f.Left.Key):
+		return f.Left.Key, f.Comparator, f.Right.Val, true
+	case f.Left.Key == "" && contains(keys, f.Right.Key):
+		return f.Right.Key, f.Comparator.Flip(), f.Left.Val, true
+	}
+
+	return "", 0, sql.Val{}, false
+}
+
+// chooseIndex chooses a secondary index by which to find the records of a
+// table in an access path, and returns the path through it, or nil if the
+// access path is read in full, with the residual filters of the access path
+// which are not conditions of the index path, and the estimated number of
+// records read. Without statistics, an index is only used to find records
+// with a given value of its first field, when no condition limits the primary
+// keys read, and of such indexes, the one with the most conditions is used, so
+// that ranges of values are read by scanning the table. With statistics, the
+// index estimated to read the fewest records is used, if it reads fewer than
+// the access path.
+func (db *Db) chooseIndex(table string, path accessPath, qualifier string, e *estimator) (*indexPath, sql.WhereClause, float64) {
+	var best *indexPath
+	residual := path.residual
+	cost := -1.0
+	if e != nil {
+		cost = e.path(table, path)
+	}
+	if path.empty() || path.point() {
+		return best, residual, cost
+	}
+
+	for _, i := range db.schema.GetTable(table).Indexes {
+		p, rest, ok := planIndex(path.residual, i, qualifier)
+		switch {
+		case !ok:
+		case e == nil:
+			if path.fullScan() && p.min == p.max && (best == nil || len(p.where.Filters) > len(best.where.Filters)) {
+				best, residual = &p, rest
+			}
+		default:
+			// Each entry in the buckets read is checked, and each record found
+			// is read from the table's B+ tree
+			var first sql.WhereClause
+			for _, f := range p.where.Filters {
+				if f.Left.Key == p.keys[0] || f.Right.Key == p.keys[0] {
+					first.Filters = append(first.Filters, f)
+				}
+			}
+			entries := e.rows(table) * e.where(first)
+			found := e.path(table, path) * e.where(p.where)
+
+			if c := entries + found*db.treeDepth(e.rows(table)); c < cost {
+				best, residual, cost = &p, rest, c
+			}
+		}
+	}
+
+	return best, residual, cost
+}
+
+// maxReorderedTables is the largest number of tables read by a query whose
+// joins may be reordered. The joins of queries reading more tables are done in
+// the order in which they are written.
+const maxReorderedTables = 6
+
+// A joinOrder is an order in which the tables read by a SELECT query are read:
+// the records of one table in an access path, to which each join adds those
+// of another table.
+type joinOrder struct {
+	table      string
+	path       accessPath
+	seek       *indexPath // Index by which the table is read, or nil
+	joins      []sql.Join
+	strategies []joinStrategy
+	filter     sql.WhereClause // Conditions checked after the joins
+
+	// Estimated records read from the table, then produced by each join, or
+	// -1 without statistics, and the estimated number of records read and
+	// produced by the whole order
+	rows []float64
+	cost float64
+}
+
+// planJoins chooses the order in which the tables read by a SELECT query are
+// joined, and the strategy of each join. Without statistics, tables are joined
+// in the order written, each by the strategy best suited to its condition.
+// With statistics, the strategies are chosen by their estimated costs, and the
+// tables of inner joins may be joined in any order in which each table joined
+// has a condition comparing it with a table before it. The order estimated to
+// read and produce the fewest records is chosen.
+func (db *Db) planJoins(q sql.SelectQuery, e *estimator) joinOrder {
+	best := db.costJoins(q.Table, q.Joins, q.Where, e)
+	if e == nil || len(q.Joins) == 0 || len(q.Joins)+1 > maxReorderedTables {
+		return best
+	}
+	for _, j := range q.Joins {
+		if j.Type != sql.InnerJoin {
+			return best
+		}
+	}
+
+	tables := []string{q.Table}
+	for _, j := range q.Joins {
+		tables = append(tables, j.Table)
+	}
+
+	var permute func(placed []string, joins []sql.Join)
+	permute = func(placed []string, joins []sql.Join) {
+		if len(placed) == len(tables) {
+			if o := db.costJoins(placed[0], joins, q.Where, e); o.cost < best.cost {
+				best = o
+			}
+			return
+		}
+
+		n := len(joins)
+		for _, t := range tables {
+			if contains(placed, t) {
+				continue
+			}
+
+			if len(placed) == 0 {
+				permute([]string{t}, nil)
+			} else if j, ok := joinTo(q.Joins, placed, t); ok {
+				permute(append(placed[:len(placed):len(placed)], t), append(joins[:n:n], j))
+			}
+		}
+	}
+	permute(nil, nil)
+
+	return best
+}
+
+// joinTo returns an inner join adding a table to records of the tables already
+// placed, by the condition of one of a query's joins comparing it with one of
+// them.
+func joinTo(joins []sql.Join, placed []string, table string) (sql.Join, bool) {
+	for _, j := range joins {
+		for _, p := range placed {
+			switch {
+			case j.Table == table && strings.HasPrefix(j.Left, p+"."):
+				return j, true
+			case j.Table == p && strings.HasPrefix(j.Left, table+"."):
+				return sql.Join{Type: sql.InnerJoin, Table: table, Left: j.Right, Comparator: j.Comparator.Flip(), Right: j.Left}, true
+			}
+		}
+	}
+
+	return sql.Join{}, false
+}
+
+// costJoins plans the access path of the table read first, and the index by
+// which it is read, if any, and the strategies of the joins which follow, and
+// estimates the cost of joining the tables in that order if there are
+// statistics.
+func (db *Db) costJoins(table string, joins []sql.Join, where sql.WhereClause, e *estimator) joinOrder {
+	qualifier := ""
+	if len(joins) > 0 {
+		qualifier = table + "."
+	}
+
+	// Conditions on the primary key and indexed fields of the table read first
+	// limit the records read from it. They are checked again after joins which
+	// also return records of the joined table matching none of those, which
+	// they reject.
+	path := planAccess(where, qualifier+db.schema.GetTable(table).GetPrimaryKey())
+	seek, residual, cost := db.chooseIndex(table, path, qualifier, e)
+	o := joinOrder{table: table, path: path, seek: seek, joins: joins, filter: residual}
+	for _, j := range joins {
+		if j.Type == sql.RightJoin || j.Type == sql.OuterJoin {
+			o.filter = where
+		}
+	}
+
+	rows := -1.0
+	if e != nil {
+		rows = e.path(table, path)
+		if seek != nil {
+			rows *= e.where(seek.where)
+		}
+		o.cost = cost
+	}
+	o.rows = append(o.rows, rows)
+
+	for _, j := range joins {
+		s, cost := db.joinCost(j, rows, e)
+		o.strategies = append(o.strategies, s)
+		if e != nil {
+			rows = e.join(rows, j)
+			o.cost += cost + rows
+		}
+		o.rows = append(o.rows, rows)
+	}
+
+	return o
+}
+
+// joinCost chooses the strategy of a join of records with those of the joined
+// table, and returns it with the estimated number of records it reads and
+// compares. Without statistics, it returns the strategy best suited to the
+// join's condition.
+func (db *Db) joinCost(j sql.Join, left float64, e *estimator) (joinStrategy, float64) {
+	s := db.joinStrategy(j)
+	if e == nil {
+		return s, 0
+	}
+
+	right := e.rows(j.Table)
+	switch s {
+	case nestedLoopJoin:
+		return s, left * right
+	case hashJoin:
+		return s, left + right
+	}
+
+	// Each record on the left gets a record from the joined table's B+ tree,
+	// which is read in full if its unmatched records are returned
+	get := left * db.treeDepth(right)
+	if j.Type == sql.RightJoin || j.Type == sql.OuterJoin {
+		get += right
+	}
+	if hash := left + right; hash < get {
+		return hashJoin, hash
+	}
+
+	return primaryKeyJoin, get
+}
+
+// treeDepth estimates the number of nodes of a B+ tree visited to find a
+// record by key, if it holds the given number of records.
+func (db *Db) treeDepth(rows float64) float64 {
+	b := float64(maxInt(db.branchingFactor, 2))
+
+	depth := 1.0
+	for n := b; n < rows; n *= b {
+		depth++
+	}
+
+	return depth
+}
+
+func contains(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// refersTo returns true iff any filter in the clause reads the given field.
+func refersTo(where sql.WhereClause, key string) bool {
+	for _, f := range where.Filters {
+		if f.Left.Key == key || f.Right.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
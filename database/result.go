@@ -0,0 +1,93 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/alexbostock/alder/schema"
+	"github.com/alexbostock/alder/sql"
+)
+
+// A Column describes a field of the records returned by a query.
+type Column struct {
+	Name string
+	Type schema.Datatype
+}
+
+// A Result is the outcome of executing a query. Queries which read records
+// return them in Rows, with one value for each column, in order, which may be
+// NULL. Queries which write records report the number of records written in
+// RowsAffected.
+type Result struct {
+	Columns      []Column
+	Rows         [][]sql.Val
+	RowsAffected int
+	LastInsertId int // Primary key of the last record inserted, or -1 if none was
+}
+
+// rowsResult converts records returned by a query into a Result. A record with
+// no value for a column is NULL in that column.
+func rowsResult(columns []Column, records []map[string]sql.Val) *Result {
+	r := &Result{
+		Columns:      columns,
+		Rows:         make([][]sql.Val, len(records)),
+		LastInsertId: -1,
+	}
+
+	for i, record := range records {
+		r.Rows[i] = make([]sql.Val, len(columns))
+		for j, c := range columns {
+			if v, ok := record[c.Name]; ok {
+				r.Rows[i][j] = v
+			} else {
+				r.Rows[i][j] = sql.Val{Null: true}
+			}
+		}
+	}
+
+	return r
+}
+
+// columns returns the columns of the records returned by a query, in order.
+func (db *Db) columns(q sql.Query) []Column {
+	switch query := q.(type) {
+	case *sql.SelectQuery:
+		tables := []string{query.Table}
+		for _, j := range query.Joins {
+			tables = append(tables, j.Table)
+		}
+
+		var columns []Column
+		for _, table := range tables {
+			for _, field := range db.schema.GetTable(table).Fields {
+				name := field.Name
+				if len(query.Joins) > 0 {
+					name = table + "." + name
+				}
+				columns = append(columns, Column{name, field.Type})
+			}
+		}
+
+		// SELECT * FROM table
+		if len(query.Keys) == 0 {
+			return columns
+		}
+
+		for _, a := range query.Aggregates {
+			columns = append(columns, Column{a.Name, a.Type})
+		}
+
+		selected := make([]Column, len(query.Keys))
+		for i, key := range query.Keys {
+			for _, c := range columns {
+				if c.Name == key {
+					selected[i] = c
+				}
+			}
+		}
+		return selected
+	case *sql.CompoundQuery:
+		return db.columns(query.Left)
+	default:
+		panic(errors.New("Invalid subquery (which should not have passed static analysis)"))
+	}
+}
@@ -0,0 +1,158 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"github.com/alexbostock/alder/schema"
+	"github.com/alexbostock/alder/sql"
+)
+
+// Records are stored in a compact binary form, described by the fields of the
+// version of the table with which they were written:
+//
+//	version  uvarint, the number of alterations made to the table
+//	nulls    a bit for each field, set if the record has no value for it
+//	values   each other field in order: ints as varints, strings as their
+//	         length as a uvarint followed by their bytes
+//
+// The primary key is the key of the record in the store, so it is not part of
+// the record.
+
+// Formats of the records of a table, as recorded in the catalog.
+const (
+	gobRows     = iota // Version followed by a gob-encoded map, converted when the table is loaded
+	compactRows        // The form described above
+)
+
+var errTruncated = errors.New("record is truncated")
+
+// layout returns the fields of a table which are stored in its records.
+func layout(fields []schema.Field) []schema.Field {
+	var l []schema.Field
+	for _, f := range fields {
+		if f.Type != schema.PrimaryKey {
+			l = append(l, f)
+		}
+	}
+
+	return l
+}
+
+// encode serialises a record in the form of the table's current version.
+func (t *tab) encode(data map[string]sql.Val) []byte {
+	version := len(t.history)
+	fields := t.layouts[version]
+
+	var scratch [binary.MaxVarintLen64]byte
+	row := make([]byte, 0, 8+4*len(fields))
+	row = append(row, scratch[:binary.PutUvarint(scratch[:], uint64(version))]...)
+
+	nulls := len(row)
+	row = append(row, make([]byte, (len(fields)+7)/8)...)
+
+	for i, f := range fields {
+		v, ok := data[f.Name]
+		switch {
+		case !ok:
+			row[nulls+i/8] |= 1 << uint(i%8)
+		case f.Type == schema.String:
+			row = append(row, scratch[:binary.PutUvarint(scratch[:], uint64(len(v.Str)))]...)
+			row = append(row, v.Str...)
+		default:
+			row = append(row, scratch[:binary.PutVarint(scratch[:], int64(v.Num))]...)
+		}
+	}
+
+	return row
+}
+
+// decode deserialises a stored record, and migrates it to the current version
+// of the table's fields by applying the alterations made since it was written.
+// Since it is called from store callbacks, it reports corrupt records by
+// panicking with a *StorageError, which execute recovers.
+func (t *tab) decode(row []byte) map[string]sql.Val {
+	version, record, err := t.decodeVersion(row)
+	if err != nil {
+		panic(&StorageError{"", "decode", err})
+	}
+
+	for _, a := range t.history[version:] {
+		a.Migrate(record)
+	}
+
+	return record
+}
+
+// decodeVersion deserialises a stored record, returning it in the form of the
+// version with which it was written.
+func (t *tab) decodeVersion(row []byte) (int, map[string]sql.Val, error) {
+	v, n := binary.Uvarint(row)
+	if n <= 0 {
+		return 0, nil, errTruncated
+	}
+	if v >= uint64(len(t.layouts)) {
+		return 0, nil, fmt.Errorf("record has unknown version %d", v)
+	}
+	version := int(v)
+	fields := t.layouts[version]
+
+	nulls := row[n:]
+	pos := n + (len(fields)+7)/8
+	if pos > len(row) {
+		return 0, nil, errTruncated
+	}
+
+	record := make(map[string]sql.Val, len(fields))
+	for i, f := range fields {
+		if nulls[i/8]&(1<<uint(i%8)) != 0 {
+			continue
+		}
+
+		if f.Type == schema.String {
+			length, n := binary.Uvarint(row[pos:])
+			if n <= 0 || length > uint64(len(row)-pos-n) {
+				return 0, nil, errTruncated
+			}
+			pos += n
+			record[f.Name] = sql.Val{Str: string(row[pos : pos+int(length)])}
+			pos += int(length)
+		} else {
+			x, n := binary.Varint(row[pos:])
+			if n <= 0 {
+				return 0, nil, errTruncated
+			}
+			pos += n
+			record[f.Name] = sql.Val{IsNum: true, Num: int(x)}
+		}
+	}
+
+	return version, record, nil
+}
+
+// decodeGobRow deserialises a record in the gob form used before records were
+// stored compactly, migrating it by the alterations of the table's history.
+func decodeGobRow(history []sql.Alteration, row []byte) (map[string]sql.Val, error) {
+	r := bytes.NewReader(row)
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if version > uint64(len(history)) {
+		return nil, fmt.Errorf("record has unknown version %d", version)
+	}
+
+	record := make(map[string]sql.Val)
+	if err := gob.NewDecoder(r).Decode(&record); err != nil {
+		return nil, err
+	}
+
+	for _, a := range history[version:] {
+		a.Migrate(record)
+	}
+
+	return record, nil
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"strconv"
+	"testing"
+
+	"github.com/alexbostock/alder/schema"
+	"github.com/alexbostock/alder/sql"
+)
+
+// gobRow encodes a record in the gob form, as it was stored before records
+// were stored compactly.
+func gobRow(version int, record map[string]sql.Val) []byte {
+	row := new(bytes.Buffer)
+
+	header := make([]byte, binary.MaxVarintLen64)
+	row.Write(header[:binary.PutUvarint(header, uint64(version))])
+	gob.NewEncoder(row).Encode(record)
+
+	return row.Bytes()
+}
+
+// benchmarkTable returns a table of n fields, alternately strings and ints,
+// and a record with a value for each.
+func benchmarkTable(n int) (*tab, map[string]sql.Val) {
+	fields := []schema.Field{{Name: "id", Type: schema.PrimaryKey}}
+	record := make(map[string]sql.Val)
+
+	for i := 0; i < n; i++ {
+		name := "field" + strconv.Itoa(i)
+		if i%2 == 0 {
+			fields = append(fields, schema.Field{Name: name, Type: schema.String})
+			record[name] = sql.Val{Str: "value " + strconv.Itoa(i)}
+		} else {
+			fields = append(fields, schema.Field{Name: name, Type: schema.Int})
+			record[name] = sql.Val{IsNum: true, Num: i * 1000}
+		}
+	}
+
+	return newTab(4, fields), record
+}
+
+func BenchmarkEncodeRow(b *testing.B) {
+	for _, n := range []int{4, 16} {
+		t, record := benchmarkTable(n)
+
+		b.Run("compact/"+strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				t.encode(record)
+			}
+			b.ReportMetric(float64(len(t.encode(record))), "bytes/row")
+		})
+
+		b.Run("gob/"+strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				gobRow(0, record)
+			}
+			b.ReportMetric(float64(len(gobRow(0, record))), "bytes/row")
+		})
+	}
+}
+
+func BenchmarkDecodeRow(b *testing.B) {
+	for _, n := range []int{4, 16} {
+		t, record := benchmarkTable(n)
+
+		b.Run("compact/"+strconv.Itoa(n), func(b *testing.B) {
+			row := t.encode(record)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				t.decode(row)
+			}
+		})
+
+		b.Run("gob/"+strconv.Itoa(n), func(b *testing.B) {
+			row := gobRow(0, record)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeGobRow(nil, row); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package database
+
+import (
+	"container/heap"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/alexbostock/alder/sql"
+)
+
+// defaultSortMemory is the default memory budget of a sort, in bytes.
+const defaultSortMemory = 32 << 20
+
+// A sorter sorts records by a list of sort keys. Records are buffered in memory
+// until their estimated size exceeds the memory budget, when the buffer is
+// sorted and written to a temporary file as a run. Once all records have been
+// added, they are sorted, and read in order one at a time, by merging the runs.
+type sorter struct {
+	keys    []sql.SortKey
+	budget  int
+	size    int
+	records []map[string]sql.Val
+	runs    []*os.File
+	merge   *runHeap // Runs being merged, or nil if the records fit in memory
+}
+
+func newSorter(keys []sql.SortKey, budget int) *sorter {
+	return &sorter{
+		keys:   keys,
+		budget: budget,
+	}
+}
+
+func (s *sorter) add(record map[string]sql.Val) error {
+	s.records = append(s.records, record)
+	s.size += recordSize(record)
+
+	if s.size > s.budget {
+		return s.spill()
+	}
+
+	return nil
+}
+
+// spill sorts the buffered records and writes them to a new run.
+func (s *sorter) spill() error {
+	s.sortBuffer()
+
+	f, err := ioutil.TempFile("", "alder-sort")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, f)
+
+	e := gob.NewEncoder(f)
+	for _, record := range s.records {
+		if err := e.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	s.records = nil
+	s.size = 0
+
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+func (s *sorter) sortBuffer() {
+	sort.SliceStable(s.records, func(i, j int) bool {
+		return compareRecords(s.records[i], s.records[j], s.keys) < 0
+	})
+}
+
+// sort sorts the records added to the sorter, after which no more can be
+// added, and they can be read in order by next.
+func (s *sorter) sort() error {
+	if len(s.runs) == 0 {
+		s.sortBuffer()
+		return nil
+	}
+
+	if len(s.records) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+
+	s.merge = &runHeap{keys: s.keys}
+	for _, run := range s.runs {
+		r := &runReader{d: gob.NewDecoder(run)}
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			s.merge.runs = append(s.merge.runs, r)
+		}
+	}
+	heap.Init(s.merge)
+
+	return nil
+}
+
+// next returns the next record in order, or nil after the last.
+func (s *sorter) next() (map[string]sql.Val, error) {
+	if s.merge == nil {
+		if len(s.records) == 0 {
+			return nil, nil
+		}
+
+		record := s.records[0]
+		s.records = s.records[1:]
+		return record, nil
+	}
+
+	if s.merge.Len() == 0 {
+		return nil, nil
+	}
+
+	r := s.merge.runs[0]
+	record := r.head
+
+	ok, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		heap.Fix(s.merge, 0)
+	} else {
+		heap.Pop(s.merge)
+	}
+
+	return record, nil
+}
+
+// close removes any temporary files.
+func (s *sorter) close() {
+	for _, run := range s.runs {
+		run.Close()
+		os.Remove(run.Name())
+	}
+	s.runs = nil
+}
+
+// A runReader reads the records of a sorted run in order.
+type runReader struct {
+	d    *gob.Decoder
+	head map[string]sql.Val
+}
+
+// next reads the next record into head, and returns false at the end of the
+// run.
+func (r *runReader) next() (bool, error) {
+	r.head = make(map[string]sql.Val)
+
+	err := r.d.Decode(&r.head)
+	if err == io.EOF {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// A runHeap is a min-heap of runs, ordered by their next record.
+type runHeap struct {
+	keys []sql.SortKey
+	runs []*runReader
+}
+
+func (h *runHeap) Len() int {
+	return len(h.runs)
+}
+
+func (h *runHeap) Less(i, j int) bool {
+	return compareRecords(h.runs[i].head, h.runs[j].head, h.keys) < 0
+}
+
+func (h *runHeap) Swap(i, j int) {
+	h.runs[i], h.runs[j] = h.runs[j], h.runs[i]
+}
+
+func (h *runHeap) Push(x interface{}) {
+	h.runs = append(h.runs, x.(*runReader))
+}
+
+func (h *runHeap) Pop() interface{} {
+	r := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return r
+}
+
+// compareRecords returns -1, 0 or 1 as record a sorts before, equal to or after
+// record b. Records with no value for a key sort before records with a value.
+func compareRecords(a, b map[string]sql.Val, keys []sql.SortKey) int {
+	for _, key := range keys {
+		x, xOk := a[key.Key]
+		y, yOk := b[key.Key]
+
+		var c int
+		switch {
+		case !xOk && !yOk:
+			c = 0
+		case !xOk:
+			c = -1
+		case !yOk:
+			c = 1
+		default:
+			c = x.Compare(y)
+		}
+
+		if key.Descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// recordSize estimates the memory used by a record, in bytes.
+func recordSize(record map[string]sql.Val) int {
+	size := 48
+	for key, val := range record {
+		size += len(key) + len(val.Str) + 48
+	}
+
+	return size
+}
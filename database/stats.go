@@ -0,0 +1,368 @@
+package database
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/alexbostock/alder/schema"
+	"github.com/alexbostock/alder/sql"
+)
+
+// histogramBuckets is the number of buckets of the histogram of each field.
+const histogramBuckets = 16
+
+// Selectivities assumed for conditions about which statistics say nothing.
+const (
+	defaultEquality = 0.1
+	defaultRange    = 1.0 / 3
+	defaultNull     = 0.1
+)
+
+// The tableStats of a table are collected by ANALYZE, and kept in the catalog.
+// They describe the table as it was when it was analyzed, and are used only to
+// estimate the number of records produced by the steps of query plans.
+type tableStats struct {
+	Rows   int
+	Fields map[string]fieldStats // Including the primary key
+}
+
+// The fieldStats of a field describe its values in the records of a table.
+type fieldStats struct {
+	Nulls    int
+	Distinct int // Number of distinct values other than NULL
+
+	// Bounds of an equi-depth histogram of the values other than NULL: the
+	// smallest value, followed by the largest value of each bucket, each of
+	// which holds about the same number of values
+	Bounds []sql.Val
+}
+
+// analyze executes an ANALYZE statement, collecting the statistics of the
+// tables it names from the records seen by db. The statistics replace those of
+// the database of which db may be a view, so they are kept even if the
+// transaction in which ANALYZE is executed is rolled back.
+func (db *Db) analyze(q sql.AnalyzeQuery) (*Result, error) {
+	stats := make(map[string]*tableStats)
+	for _, table := range db.schema.Tables {
+		if q.Table == "" || q.Table == table.Name {
+			stats[table.Name] = db.analyzeTable(table.Name)
+		}
+	}
+
+	root := db.root()
+	root.mu.Lock()
+	for name, s := range root.stats {
+		if _, ok := stats[name]; !ok {
+			stats[name] = s
+		}
+	}
+	root.stats = stats
+	root.mu.Unlock()
+
+	return &Result{LastInsertId: -1}, nil
+}
+
+// analyzeTable collects the statistics of the records of a table.
+func (db *Db) analyzeTable(name string) *tableStats {
+	table := db.schema.GetTable(name)
+	primaryKey := table.GetPrimaryKey()
+	t := db.tables[name]
+
+	rows := 0
+	values := make(map[string][]sql.Val, len(table.Fields))
+	t.store.Scan(minKey, maxKey, func(key int, val []byte) bool {
+		rows++
+		record := t.decode(val)
+		record[primaryKey] = sql.Val{IsNum: true, Num: key}
+		for field, v := range record {
+			values[field] = append(values[field], v)
+		}
+		return true
+	})
+
+	stats := &tableStats{Rows: rows, Fields: make(map[string]fieldStats, len(table.Fields))}
+	for _, f := range table.Fields {
+		vals := values[f.Name]
+		sort.Slice(vals, func(i, j int) bool {
+			return vals[i].Compare(vals[j]) < 0
+		})
+
+		fs := fieldStats{Nulls: rows - len(vals), Bounds: histogram(vals)}
+		for i, v := range vals {
+			if i == 0 || v.Compare(vals[i-1]) != 0 {
+				fs.Distinct++
+			}
+		}
+		stats.Fields[f.Name] = fs
+	}
+
+	return stats
+}
+
+// histogram returns the bounds of an equi-depth histogram of sorted values.
+func histogram(vals []sql.Val) []sql.Val {
+	if len(vals) == 0 {
+		return nil
+	}
+
+	buckets := minInt(histogramBuckets, len(vals)-1)
+	bounds := []sql.Val{vals[0]}
+	for i := 1; i <= buckets; i++ {
+		bounds = append(bounds, vals[i*(len(vals)-1)/buckets])
+	}
+
+	return bounds
+}
+
+// statistics returns the statistics of the database's tables, by name. Tables
+// which have not been analyzed have none.
+func (db *Db) statistics() map[string]*tableStats {
+	root := db.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	return root.stats
+}
+
+// below estimates the fraction of the values of a field, other than NULL,
+// which are less than v, in a table of the given number of records.
+func (f fieldStats) below(v sql.Val, rows float64) float64 {
+	b := f.Bounds
+	if len(b) == 0 || v.Compare(b[0]) <= 0 {
+		return 0
+	}
+	if v.Compare(b[len(b)-1]) > 0 {
+		return 1
+	}
+
+	// The first bucket whose largest value is at least v holds v, and its
+	// values are assumed to be spread evenly over its range. The number of
+	// values less than v is then its estimated position in sorted order.
+	i := sort.Search(len(b), func(i int) bool {
+		return b[i].Compare(v) >= 0
+	})
+	within := 0.5
+	if v.IsNum && b[i].Num != b[i-1].Num {
+		within = (float64(v.Num) - float64(b[i-1].Num)) / (float64(b[i].Num) - float64(b[i-1].Num))
+	}
+
+	values := rows - float64(f.Nulls)
+	return (float64(i-1) + within) / float64(len(b)-1) * (values - 1) / values
+}
+
+// equal estimates the fraction of the values of a field, other than NULL,
+// which are equal to v.
+func (f fieldStats) equal(v sql.Val) float64 {
+	b := f.Bounds
+	if f.Distinct == 0 || v.Compare(b[0]) < 0 || v.Compare(b[len(b)-1]) > 0 {
+		return 0
+	}
+
+	return 1 / float64(f.Distinct)
+}
+
+// An estimator estimates the number of records produced by the steps of a
+// query plan, from the statistics of the tables read by the query.
+type estimator struct {
+	schema    schema.Schema
+	stats     map[string]*tableStats
+	table     string // Table of the query, whose fields are not qualified
+	qualified bool   // Whether keys are qualified by table name, as when there are joins
+}
+
+// newEstimator returns an estimator for a SELECT query, or nil if any table it
+// reads has not been analyzed.
+func newEstimator(s schema.Schema, stats map[string]*tableStats, q sql.SelectQuery) *estimator {
+	if stats[q.Table] == nil {
+		return nil
+	}
+	for _, j := range q.Joins {
+		if stats[j.Table] == nil {
+			return nil
+		}
+	}
+
+	return &estimator{s, stats, q.Table, len(q.Joins) > 0}
+}
+
+// rows returns the number of records of a table.
+func (e *estimator) rows(table string) float64 {
+	return float64(e.stats[table].Rows)
+}
+
+// field returns the statistics of the field with the given key, and the number
+// of records of its table. It returns false for keys which are not fields, such
+// as aggregates.
+func (e *estimator) field(key string) (fieldStats, float64, bool) {
+	table := e.table
+	if i := strings.LastIndex(key, "."); e.qualified && i >= 0 {
+		table, key = key[:i], key[i+1:]
+	}
+
+	t := e.stats[table]
+	if t == nil {
+		return fieldStats{}, 0, false
+	}
+	f, ok := t.Fields[key]
+	return f, float64(t.Rows), ok && t.Rows > 0
+}
+
+// distinct estimates the number of distinct values of a field, including NULL.
+func (e *estimator) distinct(key string) float64 {
+	f, _, ok := e.field(key)
+	if !ok {
+		return 1 / defaultEquality
+	}
+
+	if f.Nulls > 0 {
+		return float64(f.Distinct + 1)
+	}
+	return float64(f.Distinct)
+}
+
+// where estimates the fraction of records satisfying a WHERE clause, whose
+// filters are assumed to be independent.
+func (e *estimator) where(w sql.WhereClause) float64 {
+	s := 1.0
+	for _, f := range w.Filters {
+		s *= e.filter(f)
+	}
+
+	return s
+}
+
+// filter estimates the fraction of records satisfying a filter.
+func (e *estimator) filter(f sql.Filter) float64 {
+	if f.Negated {
+		f.Negated = false
+		return 1 - e.filter(f)
+	}
+
+	if f.Comparator == sql.IsNull || f.Comparator == sql.IsNotNull {
+		nulls := defaultNull
+		if stats, rows, ok := e.field(f.Left.Key); ok {
+			nulls = float64(stats.Nulls) / rows
+		}
+
+		if f.Comparator == sql.IsNull {
+			return nulls
+		}
+		return 1 - nulls
+	}
+
+	left, c, right := f.Left, f.Comparator, f.Right
+	if left.Key == "" {
+		left, c, right = right, c.Flip(), left
+	}
+
+	switch {
+	case left.Key == "":
+		return defaultRange
+	case right.Key != "":
+		if c == sql.EqualTo {
+			return 1 / maxFloat(1, maxFloat(e.distinct(left.Key), e.distinct(right.Key)))
+		}
+		return defaultRange
+	case right.Val.Null:
+		return 0
+	}
+
+	stats, rows, ok := e.field(left.Key)
+	if !ok {
+		if c == sql.EqualTo {
+			return defaultEquality
+		}
+		return defaultRange
+	}
+
+	nonNull := 1 - float64(stats.Nulls)/rows
+	switch c {
+	case sql.LessThan:
+		return nonNull * stats.below(right.Val, rows)
+	case sql.GreaterThan:
+		return nonNull * maxFloat(0, 1-stats.below(right.Val, rows)-stats.equal(right.Val))
+	default:
+		return nonNull * stats.equal(right.Val)
+	}
+}
+
+// path estimates the number of records of a table with primary keys in an
+// access path.
+func (e *estimator) path(table string, path accessPath) float64 {
+	rows := e.rows(table)
+	stats := e.stats[table].Fields[e.schema.GetTable(table).GetPrimaryKey()]
+
+	switch {
+	case path.empty():
+		return 0
+	case path.point():
+		return rows * stats.equal(sql.Val{IsNum: true, Num: path.min})
+	case path.fullScan():
+		return rows
+	}
+
+	below := 1.0
+	if path.max != maxKey {
+		max := sql.Val{IsNum: true, Num: path.max}
+		below = stats.below(max, rows) + stats.equal(max)
+	}
+	above := 0.0
+	if path.min != minKey {
+		above = stats.below(sql.Val{IsNum: true, Num: path.min}, rows)
+	}
+
+	return rows * maxFloat(0, below-above)
+}
+
+// join estimates the number of records produced by a join of records with
+// those of the joined table.
+func (e *estimator) join(left float64, j sql.Join) float64 {
+	right := e.rows(j.Table)
+
+	s := defaultRange
+	if j.Comparator == sql.EqualTo {
+		s = 1 / maxFloat(1, maxFloat(e.distinct(j.Left), e.distinct(j.Right)))
+	}
+	rows := left * right * s
+
+	// Unmatched records are also returned by outer joins
+	switch j.Type {
+	case sql.LeftJoin:
+		rows = maxFloat(rows, left)
+	case sql.RightJoin:
+		rows = maxFloat(rows, right)
+	case sql.OuterJoin:
+		rows = maxFloat(rows, maxFloat(left, right))
+	}
+
+	return rows
+}
+
+// groups estimates the number of groups of records with the given GROUP BY
+// keys.
+func (e *estimator) groups(rows float64, groupBy []string) float64 {
+	if len(groupBy) == 0 {
+		return 1
+	}
+
+	groups := 1.0
+	for _, key := range groupBy {
+		groups *= e.distinct(key)
+	}
+
+	return minFloat(rows, groups)
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
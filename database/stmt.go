@@ -0,0 +1,111 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/alexbostock/alder/sql"
+)
+
+// A Stmt is a prepared statement: a compiled query with placeholders for
+// parameters, whose values are given each time it is executed. It is safe for
+// concurrent use by multiple goroutines.
+type Stmt struct {
+	db       *Db
+	text     string
+	version  int // Version of the schema against which the query was compiled
+	st       *sql.Statement
+	literals []sql.Val // Values of the literals of the query, bound after its parameters
+}
+
+// Prepare compiles a query which may have placeholders for parameters, ? or $n,
+// which are type-checked against the schema. It returns the errors of
+// sql.Prepare.
+//
+// Statements are cached by the fingerprint of their query, in which literals
+// are replaced by parameters, so queries which differ only in their literals
+// are compiled once.
+func (db *Db) Prepare(q string) (*Stmt, error) {
+	fingerprint, literals, err := sql.Fingerprint(q)
+	if err != nil {
+		return nil, err
+	}
+
+	s, version := db.currentSchema()
+
+	// Statements compiled against old schemas are not found by later lookups,
+	// even if they are cached while the schema changes
+	key := strconv.Itoa(version) + ":" + fingerprint
+
+	st, ok := db.cache.get(key)
+	if !ok {
+		st, err = sql.Prepare(s, fingerprint)
+		if err == nil {
+			db.cache.put(key, st)
+		}
+	}
+	if err == nil && len(literals) > 0 {
+		err = st.Check(literals)
+	}
+
+	if err != nil {
+		// Compile the query as it was written, which reports errors at their
+		// positions in it, and allows literals which cannot be parameters
+		st, err = sql.Prepare(s, q)
+		if err != nil {
+			return nil, err
+		}
+		literals = nil
+	}
+
+	return &Stmt{db, q, version, st, literals}, nil
+}
+
+// NumParams returns the number of parameters of the statement.
+func (s *Stmt) NumParams() int {
+	return len(s.st.Params) - len(s.literals)
+}
+
+// Query executes the statement in its own transaction, binding the arguments to
+// its parameters in order, and returns its result. Arguments must be ints,
+// int64s or strings, of the types of the parameters, or nil for NULL, and
+// otherwise Query returns a *sql.BindError. It returns the same errors as Db.Query.
+func (s *Stmt) Query(args ...interface{}) (*Result, error) {
+	return s.db.autocommit(s, args)
+}
+
+// bind returns the statement's query with the arguments bound to its
+// parameters, to be executed by db, which is the statement's database or a view
+// of it. If the schema has changed since the statement was prepared, the query
+// is compiled again, against the schema of db.
+func (s *Stmt) bind(db *Db, args []interface{}) (sql.Query, error) {
+	if _, version := db.currentSchema(); version != s.version {
+		var err error
+		if s, err = db.Prepare(s.text); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(args) != s.NumParams() {
+		return nil, &sql.BindError{Msg: fmt.Sprintf("expected %d parameters, got %d", s.NumParams(), len(args))}
+	}
+
+	vals := make([]sql.Val, len(args), len(args)+len(s.literals))
+
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case nil:
+			vals[i] = sql.Val{Null: true}
+		case int:
+			vals[i] = sql.Val{IsNum: true, Num: v}
+		case int64:
+			vals[i] = sql.Val{IsNum: true, Num: int(v)}
+		case string:
+			vals[i] = sql.Val{Str: v}
+		default:
+			return nil, &sql.BindError{Param: i + 1, Msg: fmt.Sprintf("unsupported type %T", arg)}
+		}
+	}
+
+	return s.st.Bind(append(vals, s.literals...))
+}
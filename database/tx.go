@@ -0,0 +1,248 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/alexbostock/alder/sql"
+	"github.com/alexbostock/alder/store"
+)
+
+var (
+	ErrTxDone        = errors.New("Transaction has already been committed or rolled back")
+	ErrInTransaction = errors.New("A transaction is already in progress")
+	ErrNoTransaction = errors.New("No transaction is in progress")
+	ErrNotInSession  = errors.New("BEGIN, COMMIT and ROLLBACK can only be used in a session")
+
+	ErrSchemaInTransaction = errors.New("CREATE TABLE, CREATE INDEX, DROP TABLE and ALTER TABLE cannot be used in a transaction")
+	ErrSchemaChanged       = errors.New("A table changed by the transaction has been dropped")
+)
+
+// A Tx is a transaction. Its queries read a snapshot of the database as it was
+// when the transaction began, together with the changes made by earlier
+// queries in the transaction. The changes are buffered, and other queries do
+// not see them until the transaction is committed. A transaction cannot be
+// committed if a record it changed has been changed by another transaction
+// committed since it began. A Tx should only be used by one goroutine at a
+// time.
+type Tx struct {
+	db       *Db
+	view     *Db // The database as seen by the transaction's queries
+	snapshot int // CSN of the snapshot read by the transaction
+	overlays map[string]*store.Overlay
+	done     bool
+}
+
+// Begin starts a transaction.
+func (db *Db) Begin() *Tx {
+	csn := db.acquire()
+	tx := &Tx{
+		db:       db,
+		view:     db.view(csn),
+		snapshot: csn,
+		overlays: make(map[string]*store.Overlay, len(db.tables)),
+	}
+
+	for name, t := range tx.view.tables {
+		o := store.NewOverlay(t.store, db.branchingFactor)
+		tx.overlays[name] = o
+		t.store = o
+	}
+
+	return tx
+}
+
+// Query compiles and executes an SQL query in the transaction, binding the
+// arguments to its parameters. COMMIT and ROLLBACK end the transaction.
+func (tx *Tx) Query(q string, args ...interface{}) (*Result, error) {
+	st, err := tx.view.Prepare(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.QueryStmt(st, args...)
+}
+
+// QueryStmt executes a prepared statement in the transaction, binding the
+// arguments to its parameters.
+func (tx *Tx) QueryStmt(st *Stmt, args ...interface{}) (*Result, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+
+	query, err := st.bind(tx.view, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if t, ok := query.(*sql.TransactionQuery); ok {
+		return transactionResult(tx.control(t.Statement))
+	}
+
+	return tx.view.execute(query)
+}
+
+func (tx *Tx) control(s sql.TransactionStatement) error {
+	switch s {
+	case sql.Commit:
+		return tx.Commit()
+	case sql.Rollback:
+		return tx.Rollback()
+	default:
+		return ErrInTransaction
+	}
+}
+
+// Commit applies the changes made by the transaction to the database, or
+// returns a *ConflictError and discards them if another transaction has changed
+// the same records since the transaction began. It returns ErrSchemaChanged if
+// a table which the transaction changed has since been dropped.
+func (tx *Tx) Commit() (err error) {
+	if tx.done {
+		return ErrTxDone
+	}
+	overlays := tx.overlays
+	tx.end()
+
+	tx.db.commitMu.Lock()
+	defer tx.db.commitMu.Unlock()
+
+	defer recoverStorageError(&err)
+
+	changes := make(map[string]map[int][]byte)
+	for name, o := range overlays {
+		t := tx.db.tables[name]
+
+		o.Changes(func(key int, val []byte) {
+			if err == nil && t != tx.view.tables[name].base {
+				err = ErrSchemaChanged
+			}
+			if err == nil && t.latestCsn(key) > tx.snapshot {
+				err = &ConflictError{name, key}
+			}
+
+			if changes[name] == nil {
+				changes[name] = make(map[int][]byte)
+			}
+			changes[name][key] = val
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(changes) > 0 {
+		tx.db.commit(changes)
+	}
+
+	return nil
+}
+
+// Rollback discards the changes made by the transaction. Primary keys
+// allocated by the transaction are not reused.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.end()
+
+	return nil
+}
+
+func (tx *Tx) end() {
+	tx.done = true
+	tx.overlays = nil
+	tx.db.release(tx.snapshot)
+}
+
+// A Session executes a sequence of queries, such as those from one client. It
+// starts a transaction when it executes BEGIN, and ends it when it executes
+// COMMIT or ROLLBACK. Queries outside a transaction are applied immediately.
+// A Session should only be used by one goroutine at a time.
+type Session struct {
+	db *Db
+	tx *Tx
+}
+
+func (db *Db) NewSession() *Session {
+	return &Session{db: db}
+}
+
+// Query compiles and executes an SQL query, in the current transaction if there
+// is one, binding the arguments to its parameters.
+func (s *Session) Query(q string, args ...interface{}) (*Result, error) {
+	st, err := s.db.Prepare(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.QueryStmt(st, args...)
+}
+
+// QueryStmt executes a prepared statement, in the current transaction if there
+// is one, binding the arguments to its parameters.
+func (s *Session) QueryStmt(st *Stmt, args ...interface{}) (*Result, error) {
+	if t, ok := st.st.Query.(*sql.TransactionQuery); ok {
+		if _, err := st.bind(s.db, args); err != nil {
+			return nil, err
+		}
+
+		switch t.Statement {
+		case sql.Begin:
+			return transactionResult(s.Begin())
+		case sql.Commit:
+			return transactionResult(s.Commit())
+		default:
+			return transactionResult(s.Rollback())
+		}
+	}
+
+	if s.tx != nil {
+		return s.tx.QueryStmt(st, args...)
+	}
+	return s.db.autocommit(st, args)
+}
+
+// InTransaction returns true iff the session has started a transaction which
+// has not ended.
+func (s *Session) InTransaction() bool {
+	return s.tx != nil
+}
+
+func (s *Session) Begin() error {
+	if s.tx != nil {
+		return ErrInTransaction
+	}
+
+	s.tx = s.db.Begin()
+	return nil
+}
+
+func (s *Session) Commit() error {
+	if s.tx == nil {
+		return ErrNoTransaction
+	}
+
+	err := s.tx.Commit()
+	s.tx = nil
+	return err
+}
+
+func (s *Session) Rollback() error {
+	if s.tx == nil {
+		return ErrNoTransaction
+	}
+
+	err := s.tx.Rollback()
+	s.tx = nil
+	return err
+}
+
+// transactionResult returns the result of a BEGIN, COMMIT or ROLLBACK statement
+// which returned err.
+func transactionResult(err error) (*Result, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &Result{LastInsertId: -1}, nil
+}
@@ -0,0 +1,328 @@
+// Package driver provides a database/sql driver for alder, registered with the
+// name "alder".
+//
+// The data source name gives the schema file and the data directory, as in
+//
+//	schema=schema.yaml&data=/var/lib/alder
+//
+// If no data directory is given, the database is only held in memory. The
+// schema file may be omitted when the data directory holds a database, whose
+// catalog describes its tables. DBs with the same data source name share a
+// database, which is written to its data directory when the last of them is
+// closed. Connections may be opened and closed by database/sql at any time
+// without closing the database.
+package driver
+
+import (
+	"context"
+	dbsql "database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sync"
+
+	"github.com/alexbostock/alder/database"
+	"github.com/alexbostock/alder/schema"
+	"github.com/alexbostock/alder/sql"
+)
+
+// branchingFactor is the branching factor of the B+ trees of databases opened
+// by the driver.
+const branchingFactor = 32
+
+func init() {
+	dbsql.Register("alder", &Driver{})
+}
+
+// A Driver opens connections to alder databases.
+type Driver struct{}
+
+// A shared is a database shared by all connectors and connections with the
+// same data source name.
+type shared struct {
+	db   *database.Db
+	refs int // Connectors and connections using the database
+}
+
+var (
+	openMu sync.Mutex
+	open   = make(map[string]*shared) // Data source name -> database
+)
+
+// OpenConnector returns a connector to the database described by a data source
+// name, opening the database if it is not already open. The database stays
+// open until the connector is closed, which database/sql does when the DB
+// using it is closed, however often it opens and closes connections.
+func (d *Driver) OpenConnector(dsn string) (sqldriver.Connector, error) {
+	s, err := acquire(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &connector{d, dsn, s}, nil
+}
+
+// Open returns a new connection to the database described by a data source
+// name, opening the database if it is not already open. The database stays
+// open until the connection is closed.
+func (d *Driver) Open(dsn string) (sqldriver.Conn, error) {
+	s, err := acquire(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{dsn, s, s.db.NewSession()}, nil
+}
+
+// acquire returns the database described by a data source name, opening it if
+// it is not already open, and adds a reference to it, which must be released.
+func acquire(dsn string) (*shared, error) {
+	openMu.Lock()
+	defer openMu.Unlock()
+
+	s, ok := open[dsn]
+	if !ok {
+		var err error
+		s, err = openShared(dsn)
+		if err != nil {
+			return nil, err
+		}
+		open[dsn] = s
+	}
+
+	s.refs++
+	return s, nil
+}
+
+// release removes a reference to a database, closing it if it has no others.
+func release(dsn string, s *shared) error {
+	openMu.Lock()
+	defer openMu.Unlock()
+
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+
+	delete(open, dsn)
+
+	return s.db.Close()
+}
+
+func openShared(dsn string) (*shared, error) {
+	params, err := url.ParseQuery(dsn)
+	if err != nil {
+		return nil, errors.New("alder: invalid data source name: " + err.Error())
+	}
+
+	dir := params.Get("data")
+
+	var s schema.Schema
+	if schemaFileName := params.Get("schema"); schemaFileName != "" {
+		schemaFile, err := ioutil.ReadFile(schemaFileName)
+		if err != nil {
+			return nil, err
+		}
+
+		s, err = schema.New(schemaFile)
+		if err != nil {
+			return nil, err
+		}
+	} else if dir == "" {
+		return nil, errors.New("alder: data source name has no schema file or data directory")
+	}
+
+	var db *database.Db
+	if dir != "" {
+		db, err = database.Open(dir, branchingFactor, s)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		db = database.New(branchingFactor, s)
+	}
+
+	return &shared{db: db}, nil
+}
+
+// A connector opens connections to a database, which it keeps open until it is
+// closed.
+type connector struct {
+	d   *Driver
+	dsn string
+	s   *shared
+}
+
+func (c *connector) Connect(context.Context) (sqldriver.Conn, error) {
+	return &conn{"", c.s, c.s.db.NewSession()}, nil
+}
+
+func (c *connector) Driver() sqldriver.Driver {
+	return c.d
+}
+
+// Close closes the database if no other connector or connection is using it.
+func (c *connector) Close() error {
+	return release(c.dsn, c.s)
+}
+
+type conn struct {
+	dsn     string // Data source name, if the connection keeps the database open
+	s       *shared
+	session *database.Session
+}
+
+// Prepare compiles a query, so that invalid queries are reported before they
+// are executed. Queries may have placeholders for parameters, ? or $n.
+func (c *conn) Prepare(query string) (sqldriver.Stmt, error) {
+	st, err := c.s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stmt{c, st}, nil
+}
+
+// Close closes the connection, rolling back its transaction if it has one. A
+// connection opened by Driver.Open also closes the database if nothing else is
+// using it.
+func (c *conn) Close() error {
+	if c.session.InTransaction() {
+		c.session.Rollback()
+	}
+
+	if c.dsn == "" {
+		return nil
+	}
+
+	return release(c.dsn, c.s)
+}
+
+func (c *conn) Begin() (sqldriver.Tx, error) {
+	if err := c.session.Begin(); err != nil {
+		return nil, err
+	}
+	return tx{c}, nil
+}
+
+type tx struct {
+	c *conn
+}
+
+func (t tx) Commit() error {
+	return t.c.session.Commit()
+}
+
+func (t tx) Rollback() error {
+	return t.c.session.Rollback()
+}
+
+type stmt struct {
+	c  *conn
+	st *database.Stmt
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return s.st.NumParams()
+}
+
+func (s *stmt) Exec(args []sqldriver.Value) (sqldriver.Result, error) {
+	r, err := s.query(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return result{r}, nil
+}
+
+func (s *stmt) Query(args []sqldriver.Value) (sqldriver.Rows, error) {
+	r, err := s.query(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rows{r, 0}, nil
+}
+
+// query executes the statement in the connection's session. Arguments are
+// int64s, strings or nil, and others are rejected by database.Stmt.
+func (s *stmt) query(args []sqldriver.Value) (*database.Result, error) {
+	vals := make([]interface{}, len(args))
+	for i, arg := range args {
+		vals[i] = arg
+	}
+
+	return s.c.session.QueryStmt(s.st, vals...)
+}
+
+type result struct {
+	r *database.Result
+}
+
+// LastInsertId returns the primary key of the last record inserted, which is
+// an error if the query inserted no records.
+func (r result) LastInsertId() (int64, error) {
+	if r.r.LastInsertId < 0 {
+		return 0, errors.New("alder: query inserted no records")
+	}
+	return int64(r.r.LastInsertId), nil
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return int64(r.r.RowsAffected), nil
+}
+
+type rows struct {
+	r    *database.Result
+	next int // Index of the next row to return
+}
+
+func (r *rows) Columns() []string {
+	names := make([]string, len(r.r.Columns))
+	for i, c := range r.r.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// ColumnTypeDatabaseTypeName returns INT or STRING, as the type of a column.
+func (r *rows) ColumnTypeDatabaseTypeName(i int) string {
+	if r.r.Columns[i].Type == schema.String {
+		return "STRING"
+	}
+	return "INT"
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []sqldriver.Value) error {
+	if r.next >= len(r.r.Rows) {
+		return io.EOF
+	}
+
+	for i, val := range r.r.Rows[r.next] {
+		dest[i] = value(val)
+	}
+	r.next++
+
+	return nil
+}
+
+// value converts a value to an int64 or a string, or nil if it is NULL.
+func value(v sql.Val) sqldriver.Value {
+	if v.Null {
+		return nil
+	}
+	if v.IsNum {
+		return int64(v.Num)
+	}
+	return v.Str
+}
@@ -0,0 +1,220 @@
+package driver
+
+import (
+	dbsql "database/sql"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDriver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alder-driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dsn := "schema=../test.yaml&data=" + dir
+
+	db, err := dbsql.Open("alder", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := db.Exec("insert into user (forename, surname, address) values ('alex', 'bostock', 'nope'), ('greg', 'davies', 'nope')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Errorf("Expected 2 rows affected, got %v", n)
+	}
+	if id, _ := res.LastInsertId(); id != 1 {
+		t.Errorf("Expected last insert id 1, got %v", id)
+	}
+
+	res, err = db.Exec("update user set address = 'redacted' where id = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := res.LastInsertId(); err == nil {
+		t.Error("Expected an error for the last insert id of an update")
+	}
+
+	if _, err := db.Prepare("select * from users"); err == nil {
+		t.Error("Expected an error preparing an invalid query")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the database from its data directory, whose catalog holds the schema
+	db, err = dbsql.Open("alder", "data="+dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	stmt, err := db.Prepare("select id, surname, address from user order by id desc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	if cols, _ := rows.Columns(); !reflect.DeepEqual(cols, []string{"id", "surname", "address"}) {
+		t.Errorf("Incorrect columns %v", cols)
+	}
+
+	type user struct {
+		id               int64
+		surname, address string
+	}
+	var users []user
+	for rows.Next() {
+		var u user
+		if err := rows.Scan(&u.id, &u.surname, &u.address); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []user{{1, "davies", "redacted"}, {0, "bostock", "nope"}}
+	if !reflect.DeepEqual(users, expected) {
+		t.Errorf("Incorrect rows %v", users)
+	}
+
+	var id int64
+	err = db.QueryRow("insert into user (forename, surname, address) values ('alex', 'horne', 'nope')").Scan(&id)
+	if err != dbsql.ErrNoRows {
+		t.Errorf("Expected no rows from an insert, got %v", err)
+	}
+	if err := db.QueryRow("select id from user where surname = 'horne'").Scan(&id); err != nil || id != 2 {
+		t.Errorf("Expected id 2 after reopening, got %v (%v)", id, err)
+	}
+}
+
+func TestDriverTransactions(t *testing.T) {
+	db, err := dbsql.Open("alder", "schema=../test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("insert into order (items, price, user_id) values ('apples', 5, 1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	if err := tx.QueryRow("select price from order").Scan(&n); err != nil || n != 5 {
+		t.Errorf("Transaction should see its own insert, got %v (%v)", n, err)
+	}
+	if err := db.QueryRow("select price from order").Scan(&n); err != dbsql.ErrNoRows {
+		t.Errorf("Expected no rows outside the transaction, got %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("select price from order").Scan(&n); err != nil || n != 5 {
+		t.Errorf("Expected the committed insert, got %v (%v)", n, err)
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Exec("delete from order")
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("select price from order").Scan(&n); err != nil {
+		t.Errorf("Rolled back delete was applied: %v", err)
+	}
+}
+
+func TestDriverParameters(t *testing.T) {
+	db, err := dbsql.Open("alder", "schema=../test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	stmt, err := db.Prepare("insert into order (items, price, user_id) values ($1, $2, $2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	for i, items := range []string{"apples", "pears"} {
+		if _, err := stmt.Exec(items, i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var items string
+	if err := db.QueryRow("select items from order where price = ?", 2).Scan(&items); err != nil || items != "pears" {
+		t.Errorf("Expected pears, got %v (%v)", items, err)
+	}
+
+	if _, err := stmt.Exec("figs"); err == nil {
+		t.Error("Expected an error for a missing parameter")
+	}
+	if _, err := db.Exec("update order set price = ?", "ten"); err == nil {
+		t.Error("Expected an error for a parameter of the wrong type")
+	}
+
+	// NULL is passed and returned as nil
+	if _, err := db.Exec("update order set items = ? where price = 1", nil); err != nil {
+		t.Fatal(err)
+	}
+	var missing dbsql.NullString
+	if err := db.QueryRow("select items from order where price = 1").Scan(&missing); err != nil || missing.Valid {
+		t.Errorf("Expected NULL, got %v (%v)", missing, err)
+	}
+}
+
+func TestDriverConnectionPool(t *testing.T) {
+	db, err := dbsql.Open("alder", "schema=../test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Each connection is closed as soon as it is idle, but the database is
+	// kept until the DB is closed
+	db.SetMaxIdleConns(0)
+
+	if _, err := db.Exec("insert into user (forename, surname, address) values ('alex', 'bostock', 'nope')"); err != nil {
+		t.Fatal(err)
+	}
+	var surname string
+	if err := db.QueryRow("select surname from user").Scan(&surname); err != nil || surname != "bostock" {
+		t.Errorf("Expected bostock, got %v (%v)", surname, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the DB closes the in-memory database
+	db, err = dbsql.Open("alder", "schema=../test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("select surname from user").Scan(&surname); err != dbsql.ErrNoRows {
+		t.Errorf("Expected no users in a new database, got %v", err)
+	}
+}
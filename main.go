@@ -2,42 +2,125 @@ package main
 
 import (
 	"bufio"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"text/tabwriter"
 
 	"github.com/alexbostock/alder/database"
 	"github.com/alexbostock/alder/schema"
+	"github.com/alexbostock/alder/sql"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		os.Stderr.WriteString("usage: alder schemaFileName\n")
+	dataDir := flag.String("data", "", "data directory in which to keep the database")
+	flag.Usage = func() {
+		os.Stderr.WriteString("usage: alder [-data dir] [schemaFileName]\n")
+	}
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	schemaFileName := os.Args[1]
-	schemaFile, err := ioutil.ReadFile(schemaFileName)
-	if err != nil {
-		os.Stderr.WriteString(err.Error() + "\n")
-		os.Exit(2)
+	// Without a schema file, tables are created by CREATE TABLE, or read from
+	// the catalog in the data directory
+	var s schema.Schema
+	if flag.NArg() == 1 {
+		schemaFile, err := ioutil.ReadFile(flag.Arg(0))
+		if err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(2)
+		}
+
+		s, err = schema.New(schemaFile)
+		if err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(2)
+		}
 	}
 
-	schema := schema.New(schemaFile)
-	db := database.New(4, schema)
+	var db *database.Db
+	if *dataDir != "" {
+		var err error
+		db, err = database.Open(*dataDir, 4, s)
+		if err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(2)
+		}
+	} else {
+		db = database.New(4, s)
+	}
+	session := db.NewSession()
 
 	r := bufio.NewReader(os.Stdin)
 	for {
 		line, err := r.ReadString(';')
 		if err != nil {
 			if err.Error() == "EOF" {
-				os.Exit(0)
+				break
 			} else {
 				panic(err)
 			}
 		}
 
-		db.Query(line[:len(line)-1])
+		runQuery(os.Stdout, session, line[:len(line)-1])
 	}
 
-	_ = schema
+	if err := db.Close(); err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(2)
+	}
+}
+
+// runQuery executes a query, and writes its result, or the error which caused
+// it to fail.
+func runQuery(w io.Writer, session *database.Session, query string) {
+	r, err := session.Query(query)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	printResult(w, r)
+}
+
+// printResult writes the records returned by a query as a table, or the number
+// of records written by the query.
+func printResult(w io.Writer, r *database.Result) {
+	if r.Columns == nil {
+		fmt.Fprintf(w, "%d rows affected\n", r.RowsAffected)
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	for _, c := range r.Columns {
+		fmt.Fprintf(tw, "%s\t", c.Name)
+	}
+	fmt.Fprintln(tw)
+
+	for _, row := range r.Rows {
+		for _, val := range row {
+			fmt.Fprintf(tw, "%s\t", formatVal(val))
+		}
+		fmt.Fprintln(tw)
+	}
+
+	tw.Flush()
+	fmt.Fprintf(w, "(%d rows)\n", len(r.Rows))
+}
+
+func formatVal(v sql.Val) string {
+	if v.Null {
+		return "NULL"
+	}
+	if v.IsNum {
+		return strconv.Itoa(v.Num)
+	}
+	return v.Str
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
 	"testing"
 
@@ -14,7 +15,10 @@ func TestQueries(t *testing.T) {
 		t.Error("Failed to load schema")
 	}
 
-	schema := schema.New(schemaFile)
+	schema, err := schema.New(schemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
 	db := database.New(4, schema)
 
 	queries := []string{
@@ -24,9 +28,73 @@ func TestQueries(t *testing.T) {
 		"select * from user",
 		"update user set address = 'redacted'",
 		"select * from user",
+		"update user set address = 'somewhere' where id = 1",
+		"select forename, address from user where address = 'redacted' and id > 0",
+		"insert into order (items, price, user_id) values ('apples', 100, 1), ('pears', 50, 2)",
+		"select surname, price from order join user on user.id = order.user_id",
+		"select surname, price from user left join order on order.user_id = user.id where forename = 'alex'",
+		"select * from order order by price desc, items",
+		"delete from user where surname = 'horne'",
+		"delete from user where id > 1",
+		"select * from user",
+		"delete from user",
+		"select * from user",
 	}
 
 	for _, query := range queries {
-		db.Query(query)
+		if _, err := db.Query(query); err != nil {
+			t.Errorf("%v: %v", query, err)
+		}
+	}
+}
+
+func TestPrintResult(t *testing.T) {
+	schemaFile, err := ioutil.ReadFile("./test.yaml")
+	if err != nil {
+		t.Error("Failed to load schema")
+	}
+
+	s, err := schema.New(schemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := database.New(4, s).NewSession()
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"insert into order (items, price, user_id) values ('apples', 100, 1), ('pears', 50, 2)", "2 rows affected\n"},
+		{"select items, price from order order by price", "items   price  \npears   50     \napples  100    \n(2 rows)\n"},
+		{"select items from order order by price desc limit 1", "items   \napples  \n(1 rows)\n"},
+		{"explain select items from order where id = 0", "plan                      \nProject items             \n  Get order WHERE id = 0  \n(2 rows)\n"},
+		{"analyze", "0 rows affected\n"},
+		{"explain select items from order where price > 60", "plan                               \nProject items  (estimate=1)        \n  Filter price > 60  (estimate=1)  \n    Scan order  (estimate=2)       \n(3 rows)\n"},
+		{"delete from order where price < 60", "1 rows affected\n"},
+		{"begin", "0 rows affected\n"},
+		{"insert into order (items, price, user_id) values ('pears', 50, 2)", "1 rows affected\n"},
+		{"rollback", "0 rows affected\n"},
+		{"select items from order", "items   \napples  \n(1 rows)\n"},
+		{"select user_id, count(*), sum(price) from order group by user_id", "user_id  count(*)  sum(price)  \n1        1         100         \n(1 rows)\n"},
+		{"commit", "No transaction is in progress\n"},
+		{"create table item (name string, id primary key)", "0 rows affected\n"},
+		{"insert into item (name) values ('fig')", "1 rows affected\n"},
+		{"alter table item add column price int", "0 rows affected\n"},
+		{"select * from item", "id  name  price  \n0   fig   NULL   \n(1 rows)\n"},
+		{"alter table item add column stock int not null", "0 rows affected\n"},
+		{"insert into item (name, price) values ('kiwi', 2)", "Constraint error on item.stock: cannot be NULL\n"},
+		{"select name, stock from item where price is null", "name  stock  \nfig   0      \n(1 rows)\n"},
+		{"drop table item", "0 rows affected\n"},
+		{"select * from item", "Semantic error at position 14 (item): unknown table\n"},
+		{"select * from orders", "Semantic error at position 14 (orders): unknown table\n"},
+		{"select * from order where price = 'ten'", "Type error at position 32: cannot compare int with string\n"},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		runQuery(&out, session, test.query)
+		if out.String() != test.expected {
+			t.Errorf("%v: expected output %q, got %q", test.query, test.expected, out.String())
+		}
 	}
 }
@@ -2,6 +2,7 @@ package schema
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/go-yaml/yaml"
 )
@@ -15,78 +16,260 @@ const (
 )
 
 type untypedField struct {
-	Name string `yaml:"name"`
-	Type string `yaml:"type"`
+	Name    string `yaml:"name"`
+	Type    string `yaml:"type"`
+	NotNull bool   `yaml:"notnull"`
 }
 
 type Field struct {
-	Name string
-	Type Datatype
+	Name    string
+	Type    Datatype
+	NotNull bool // Records must have a value for the field (primary keys always do)
 }
 
 type untypedTable struct {
 	Name       string         `yaml:"name"`
 	PrimaryKey string         `yaml:"key"`
 	Fields     []untypedField `yaml:"fields"`
+	Indexes    []untypedIndex `yaml:"indexes"`
+}
+
+type untypedIndex struct {
+	Name   string   `yaml:"name"`
+	Fields []string `yaml:"fields"`
 }
 
 type Table struct {
+	Name    string
+	Fields  []Field
+	Indexes []Index
+}
+
+// An Index is a secondary index of a table, on one or more of its fields other
+// than the primary key. Index names are unique in a schema.
+type Index struct {
 	Name   string
-	Fields []Field
+	Fields []string
+}
+
+// A tableEntry is a table in a schema file, which begins with "- table:",
+// followed by the table's definition.
+type tableEntry struct {
+	Heading      interface{} `yaml:"table"`
+	untypedTable `yaml:",inline"`
 }
 
 type untypedSchema struct {
-	Tables []untypedTable `yaml:"tables"`
+	Tables []tableEntry `yaml:"tables"`
 }
 
 type Schema struct {
 	Tables []Table
 }
 
-func (ut untypedTable) typeCheck() Table {
+// An Error reports an invalid schema file.
+type Error struct {
+	Table string // Table containing the error, if any
+	Field string // Field containing the error, if any
+	Msg   string
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Field != "":
+		return fmt.Sprintf("Schema error in %s.%s: %s", e.Table, e.Field, e.Msg)
+	case e.Table != "":
+		return fmt.Sprintf("Schema error in %s: %s", e.Table, e.Msg)
+	default:
+		return "Schema error: " + e.Msg
+	}
+}
+
+// ParseDatatype returns the type of fields named in schemas, int or string, and
+// false if the name is not a type.
+func ParseDatatype(name string) (Datatype, bool) {
+	switch name {
+	case "int":
+		return Int, true
+	case "string":
+		return String, true
+	default:
+		return 0, false
+	}
+}
+
+func (ut untypedTable) typeCheck() (Table, error) {
+	if ut.Name == "" {
+		return Table{}, &Error{"", "", "table has no name"}
+	}
+	if ut.PrimaryKey == "" {
+		return Table{}, &Error{ut.Name, "", "table has no primary key"}
+	}
+
 	tab := Table{
 		Name:   ut.Name,
 		Fields: []Field{Field{Name: ut.PrimaryKey, Type: PrimaryKey}},
 	}
+	seen := map[string]bool{ut.PrimaryKey: true}
 
 	for _, f := range ut.Fields {
-		var t Datatype
-		switch f.Type {
-		case "int":
-			t = Int
-		case "string":
-			t = String
-		default:
-			panic(errors.New("Unexpected field type"))
+		if seen[f.Name] {
+			return Table{}, &Error{ut.Name, f.Name, "field is defined more than once"}
+		}
+		seen[f.Name] = true
+
+		t, ok := ParseDatatype(f.Type)
+		if !ok {
+			return Table{}, &Error{ut.Name, f.Name, "unknown field type " + f.Type}
 		}
 
 		field := Field{
 			f.Name,
 			t,
+			f.NotNull,
 		}
 
 		tab.Fields = append(tab.Fields, field)
 	}
 
-	return tab
+	for _, ui := range ut.Indexes {
+		i := Index{ui.Name, ui.Fields}
+		if err := tab.CheckIndex(i); err != nil {
+			return Table{}, err
+		}
+		tab.Indexes = append(tab.Indexes, i)
+	}
+
+	return tab, nil
+}
+
+// CheckIndex returns an *Error if an index is not valid for the table: if it
+// has no name, or its fields are not distinct fields of the table other than
+// the primary key.
+func (t Table) CheckIndex(i Index) error {
+	if i.Name == "" {
+		return &Error{t.Name, "", "index has no name"}
+	}
+	if len(i.Fields) == 0 {
+		return &Error{t.Name, "", "index " + i.Name + " has no fields"}
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range i.Fields {
+		found := false
+		for _, f := range t.Fields {
+			if f.Name != name {
+				continue
+			}
+
+			found = true
+			if f.Type == PrimaryKey {
+				return &Error{t.Name, name, "primary key cannot be in index " + i.Name}
+			}
+		}
+
+		switch {
+		case !found:
+			return &Error{t.Name, name, "unknown field in index " + i.Name}
+		case seen[name]:
+			return &Error{t.Name, name, "field is in index " + i.Name + " more than once"}
+		}
+		seen[name] = true
+	}
+
+	return nil
 }
 
-func (us untypedSchema) typeCheck() Schema {
+func (us untypedSchema) typeCheck() (Schema, error) {
 	s := Schema{make([]Table, 0, len(us.Tables))}
+	seen := make(map[string]bool)
+	indexes := make(map[string]bool)
 
 	for _, t := range us.Tables {
-		s.Tables = append(s.Tables, t.typeCheck())
+		if seen[t.Name] {
+			return Schema{}, &Error{t.Name, "", "table is defined more than once"}
+		}
+		seen[t.Name] = true
+
+		tab, err := t.typeCheck()
+		if err != nil {
+			return Schema{}, err
+		}
+		for _, i := range tab.Indexes {
+			if indexes[i.Name] {
+				return Schema{}, &Error{t.Name, "", "index " + i.Name + " is defined more than once"}
+			}
+			indexes[i.Name] = true
+		}
+		s.Tables = append(s.Tables, tab)
 	}
 
-	return s
+	return s, nil
 }
 
-func New(file []byte) Schema {
+// New parses a YAML schema file, and returns an *Error if it does not describe
+// a valid schema.
+func New(file []byte) (Schema, error) {
 	untyped := untypedSchema{}
-	yaml.UnmarshalStrict(file, &untyped)
+	if err := yaml.UnmarshalStrict(file, &untyped); err != nil {
+		return Schema{}, &Error{"", "", err.Error()}
+	}
 	return untyped.typeCheck()
 }
 
+// HasTable returns true iff the schema has a table of the given name.
+func (s Schema) HasTable(name string) bool {
+	for _, table := range s.Tables {
+		if table.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasIndex returns true iff a table of the schema has an index of the given
+// name.
+func (s Schema) HasIndex(name string) bool {
+	for _, table := range s.Tables {
+		for _, i := range table.Indexes {
+			if i.Name == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// WithTable returns a copy of the schema with a table added, which replaces any
+// table of the same name.
+func (s Schema) WithTable(t Table) Schema {
+	tables := make([]Table, len(s.Tables), len(s.Tables)+1)
+	copy(tables, s.Tables)
+
+	for i, table := range tables {
+		if table.Name == t.Name {
+			tables[i] = t
+			return Schema{tables}
+		}
+	}
+
+	return Schema{append(tables, t)}
+}
+
+// WithoutTable returns a copy of the schema without the named table.
+func (s Schema) WithoutTable(name string) Schema {
+	tables := make([]Table, 0, len(s.Tables))
+	for _, table := range s.Tables {
+		if table.Name != name {
+			tables = append(tables, table)
+		}
+	}
+
+	return Schema{tables}
+}
+
 func (s Schema) GetTable(t string) Table {
 	for _, table := range s.Tables {
 		if table.Name == t {
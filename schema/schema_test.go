@@ -14,7 +14,10 @@ func TestSchemaParse(t *testing.T) {
 		t.Error(err.Error())
 	}
 
-	schema := New(schemaFile)
+	schema, err := New(schemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	expected := Schema{
 		Tables: []Table{
@@ -68,3 +71,62 @@ func TestSchemaParse(t *testing.T) {
 		t.Error("Schema parsed incorrectly from yaml.")
 	}
 }
+
+func TestSchemaNotNull(t *testing.T) {
+	s, err := New([]byte("tables:\n- name: a\n  key: id\n  fields:\n  - name: x\n    type: int\n    notnull: true\n  - name: y\n    type: string"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Field{{Name: "id", Type: PrimaryKey}, {Name: "x", Type: Int, NotNull: true}, {Name: "y", Type: String}}
+	if fields := s.GetTable("a").Fields; !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected %v, got %v", expected, fields)
+	}
+}
+
+func TestSchemaIndexes(t *testing.T) {
+	s, err := New([]byte("tables:\n- name: a\n  key: id\n  fields:\n  - name: x\n    type: int\n  - name: y\n    type: string\n  indexes:\n  - name: a_x\n    fields: [x]\n  - name: a_y_x\n    fields: [y, x]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Index{{Name: "a_x", Fields: []string{"x"}}, {Name: "a_y_x", Fields: []string{"y", "x"}}}
+	if indexes := s.GetTable("a").Indexes; !reflect.DeepEqual(indexes, expected) {
+		t.Errorf("Expected %v, got %v", expected, indexes)
+	}
+	if !s.HasIndex("a_y_x") || s.HasIndex("a") {
+		t.Error("Incorrect index names")
+	}
+}
+
+func TestSchemaErrors(t *testing.T) {
+	tests := []struct {
+		file  string
+		table string
+		field string
+	}{
+		{"tables: [", "", ""},
+		{"tables:\n- table:\n  name: a\n  key: id\n  colour: red", "", ""},
+		{"tables:\n- name: a\n  fields: []", "a", ""},
+		{"tables:\n- name: a\n  key: id\n  fields:\n  - name: x\n    type: float", "a", "x"},
+		{"tables:\n- name: a\n  key: id\n  fields:\n  - name: id\n    type: int", "a", "id"},
+		{"tables:\n- name: a\n  key: id\n- name: a\n  key: id", "a", ""},
+		{"tables:\n- name: a\n  key: id\n  indexes:\n  - fields: [id]", "a", ""},
+		{"tables:\n- name: a\n  key: id\n  indexes:\n  - name: a_id\n    fields: [id]", "a", "id"},
+		{"tables:\n- name: a\n  key: id\n  indexes:\n  - name: a_x\n    fields: [x]", "a", "x"},
+		{"tables:\n- name: a\n  key: id\n  fields:\n  - name: x\n    type: int\n  indexes:\n  - name: a_x\n    fields: [x, x]", "a", "x"},
+		{"tables:\n- name: a\n  key: id\n  fields:\n  - name: x\n    type: int\n  indexes:\n  - name: i\n    fields: [x]\n- name: b\n  key: id\n  fields:\n  - name: x\n    type: int\n  indexes:\n  - name: i\n    fields: [x]", "b", ""},
+	}
+
+	for _, test := range tests {
+		_, err := New([]byte(test.file))
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%q: expected *Error, got %v", test.file, err)
+			continue
+		}
+		if e.Table != test.table || e.Field != test.field {
+			t.Errorf("%q: error in %q.%q, expected %q.%q", test.file, e.Table, e.Field, test.table, test.field)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package sql
+
+import (
+	"fmt"
+
+	"github.com/alexbostock/alder/sql/lexer"
+)
+
+// A SyntaxError reports a query which cannot be parsed.
+type SyntaxError = lexer.SyntaxError
+
+// A SemanticError reports a query which refers to a table or field which does
+// not exist, or which uses a clause where it is not allowed.
+type SemanticError struct {
+	Pos   int    // Byte offset in the query of the offending clause
+	Ident string // Offending table or field name, if any
+	Msg   string
+}
+
+func (e *SemanticError) Error() string {
+	return describe("Semantic error", e.Pos, e.Ident, e.Msg)
+}
+
+// A TypeError reports a query which compares, assigns or combines values of
+// incompatible types.
+type TypeError struct {
+	Pos   int    // Byte offset in the query of the offending value or clause
+	Ident string // Name of the field whose type does not match, if any
+	Msg   string
+}
+
+func (e *TypeError) Error() string {
+	return describe("Type error", e.Pos, e.Ident, e.Msg)
+}
+
+// A BindError reports values which do not match the parameters of a prepared
+// statement.
+type BindError struct {
+	Param int // Number of the offending parameter, or 0 if the number of values is wrong
+	Msg   string
+}
+
+func (e *BindError) Error() string {
+	if e.Param == 0 {
+		return "Bind error: " + e.Msg
+	}
+	return fmt.Sprintf("Bind error for parameter $%d: %s", e.Param, e.Msg)
+}
+
+func describe(kind string, pos int, ident, msg string) string {
+	if ident == "" {
+		return fmt.Sprintf("%s at position %d: %s", kind, pos, msg)
+	}
+	return fmt.Sprintf("%s at position %d (%s): %s", kind, pos, ident, msg)
+}
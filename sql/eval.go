@@ -0,0 +1,202 @@
+package sql
+
+import (
+	"strings"
+
+	"github.com/alexbostock/alder/schema"
+)
+
+// Compare returns -1, 0 or 1 as v is less than, equal to or greater than w.
+// Ints are ordered numerically and strings lexicographically. Values of
+// different types should not be compared (Compile rejects such queries). NULL
+// is ordered before every other value, and equal to itself, so that records
+// can be sorted and compared for equality.
+func (v Val) Compare(w Val) int {
+	switch {
+	case v.Null && w.Null:
+		return 0
+	case v.Null:
+		return -1
+	case w.Null:
+		return 1
+	}
+
+	if v.IsNum {
+		switch {
+		case v.Num < w.Num:
+			return -1
+		case v.Num > w.Num:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	return strings.Compare(v.Str, w.Str)
+}
+
+// Flip returns the comparator c' such that a c b iff b c' a.
+func (c Comparator) Flip() Comparator {
+	switch c {
+	case LessThan:
+		return GreaterThan
+	case GreaterThan:
+		return LessThan
+	default:
+		return c
+	}
+}
+
+// Test returns true iff a c b. A comparison involving NULL is never satisfied,
+// but a NULL value IS NULL.
+func (c Comparator) Test(a, b Val) bool {
+	return c.Truth(a, b) == True
+}
+
+// Truth returns the truth of a c b, which is Unknown if a or b is NULL and c
+// compares them.
+func (c Comparator) Truth(a, b Val) Truth {
+	switch {
+	case c == IsNull:
+		return truth(a.Null)
+	case c == IsNotNull:
+		return truth(!a.Null)
+	case a.Null || b.Null:
+		return Unknown
+	case c == LessThan:
+		return truth(a.Compare(b) < 0)
+	case c == GreaterThan:
+		return truth(a.Compare(b) > 0)
+	default:
+		return truth(a.Compare(b) == 0)
+	}
+}
+
+func truth(b bool) Truth {
+	if b {
+		return True
+	}
+	return False
+}
+
+// Not returns the negation of a truth value, which is unknown if it is unknown.
+func (t Truth) Not() Truth {
+	return True - t
+}
+
+// And returns the conjunction of two truth values: false if either is false,
+// and otherwise unknown if either is unknown.
+func (t Truth) And(u Truth) Truth {
+	if u < t {
+		return u
+	}
+	return t
+}
+
+// value returns the value of an operand in the context of a given record. A
+// field for which the record has no value is NULL.
+func (o Operand) value(record map[string]Val) Val {
+	if o.Key == "" {
+		return o.Val
+	}
+
+	v, ok := record[o.Key]
+	if !ok {
+		return Val{Null: true}
+	}
+	return v
+}
+
+// Truth returns the truth of the filter for the given record.
+func (f Filter) Truth(record map[string]Val) Truth {
+	t := f.Comparator.Truth(f.Left.value(record), f.Right.value(record))
+	if f.Negated {
+		return t.Not()
+	}
+	return t
+}
+
+// Eval returns true iff the given record satisfies the filter. A comparison
+// involving NULL is never satisfied, and neither is its negation.
+func (f Filter) Eval(record map[string]Val) bool {
+	return f.Truth(record) == True
+}
+
+// Truth returns the conjunction of the truths of the filters in the clause for
+// the given record.
+func (w WhereClause) Truth(record map[string]Val) Truth {
+	t := True
+	for _, f := range w.Filters {
+		if t = t.And(f.Truth(record)); t == False {
+			break
+		}
+	}
+
+	return t
+}
+
+// Eval returns true iff the given record satisfies every filter in the clause:
+// records for which the clause is unknown are not selected.
+func (w WhereClause) Eval(record map[string]Val) bool {
+	return w.Truth(record) == True
+}
+
+// Apply returns a copy of a table with the alteration made to its fields.
+// Renamed fields are renamed in its indexes, and indexes of dropped fields are
+// dropped.
+func (a Alteration) Apply(t schema.Table) schema.Table {
+	fields := make([]schema.Field, 0, len(t.Fields)+1)
+	for _, f := range t.Fields {
+		switch {
+		case f.Name != a.Field.Name:
+			fields = append(fields, f)
+		case a.Type == RenameColumn:
+			f.Name = a.NewName
+			fields = append(fields, f)
+		}
+	}
+	if a.Type == AddColumn {
+		fields = append(fields, a.Field)
+	}
+
+	var indexes []schema.Index
+	for _, i := range t.Indexes {
+		names := make([]string, 0, len(i.Fields))
+		for _, name := range i.Fields {
+			switch {
+			case name != a.Field.Name:
+				names = append(names, name)
+			case a.Type == RenameColumn:
+				names = append(names, a.NewName)
+			}
+		}
+
+		if len(names) == len(i.Fields) {
+			indexes = append(indexes, schema.Index{Name: i.Name, Fields: names})
+		}
+	}
+
+	return schema.Table{Name: t.Name, Fields: fields, Indexes: indexes}
+}
+
+// Migrate changes a record written before the alteration into the form of a
+// record written after it.
+func (a Alteration) Migrate(record map[string]Val) {
+	switch a.Type {
+	case AddColumn:
+		switch {
+		case !a.Field.NotNull:
+		case a.Field.Type == schema.String:
+			record[a.Field.Name] = Val{}
+		default:
+			record[a.Field.Name] = Val{IsNum: true}
+		}
+	case DropColumn:
+		delete(record, a.Field.Name)
+	case RenameColumn:
+		if v, ok := record[a.Field.Name]; ok {
+			delete(record, a.Field.Name)
+			record[a.NewName] = v
+		}
+	}
+}
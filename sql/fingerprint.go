@@ -0,0 +1,78 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/alexbostock/alder/sql/lexer"
+)
+
+// Fingerprint normalises a query, so that queries which differ only in case,
+// spacing and literal values have the same fingerprint. Literals are replaced
+// by placeholders for parameters $1, $2 and so on, and their values are
+// returned in order. Queries which already have placeholders keep their
+// literals, as do AS OF clauses, which cannot have parameters. Fingerprint
+// returns a *SyntaxError if the query cannot be lexed.
+//
+// The fingerprint of a valid query is not always valid, as in WHERE 1 = 1,
+// where both sides of the comparison become parameters.
+func Fingerprint(query string) (string, []Val, error) {
+	var tokens []lexer.Token
+
+	l := lexer.New(query)
+	parameterised := false
+	for {
+		tok, err := l.Lex()
+		if err != nil {
+			return "", nil, err
+		}
+		if tok.Kind == lexer.Eof {
+			break
+		}
+
+		parameterised = parameterised || tok.Kind == lexer.Placeholder
+		tokens = append(tokens, tok)
+	}
+
+	var fingerprint strings.Builder
+	var literals []Val
+
+	for i, tok := range tokens {
+		if i > 0 {
+			fingerprint.WriteString(" ")
+		}
+
+		literal := !parameterised && (i == 0 || tokens[i-1].Kind != lexer.AsOf)
+
+		switch tok.Kind {
+		case lexer.Str:
+			fingerprint.WriteString(tok.Str)
+		case lexer.Num:
+			// Integers which are out of range are left for Compile to report
+			n, err := strconv.Atoi(tok.Str)
+			if literal && err == nil {
+				literals = append(literals, Val{IsNum: true, Num: n})
+				fingerprint.WriteString("$" + strconv.Itoa(len(literals)))
+			} else {
+				fingerprint.WriteString(tok.Str)
+			}
+		case lexer.StringLit:
+			if literal {
+				literals = append(literals, Val{Str: tok.Str})
+				fingerprint.WriteString("$" + strconv.Itoa(len(literals)))
+			} else {
+				fingerprint.WriteString("'" + tok.Str + "'")
+			}
+		case lexer.Placeholder:
+			if tok.Str == "" {
+				fingerprint.WriteString("?")
+			} else {
+				fingerprint.WriteString("$" + tok.Str)
+			}
+		default:
+			fingerprint.WriteString(tok.Kind.String())
+		}
+	}
+
+	return fingerprint.String(), literals, nil
+}
@@ -0,0 +1,41 @@
+package sql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		query       string
+		fingerprint string
+		literals    []Val
+	}{
+		{"select * from user", "SELECT * FROM user", nil},
+		{"SELECT  *\n FROM User", "SELECT * FROM user", nil},
+		{
+			"select items from order where price > 10 and items = 'Apples' order by price desc",
+			"SELECT items FROM order WHERE price > $1 AND items = $2 ORDER BY price DESC",
+			[]Val{{IsNum: true, Num: 10}, {Str: "apples"}},
+		},
+		{"select * from order where price > 10 as of 3", "SELECT * FROM order WHERE price > $1 AS OF 3", []Val{{IsNum: true, Num: 10}}},
+		{"select * from order where price > ? and id = 4", "SELECT * FROM order WHERE price > ? AND id = 4", nil},
+		{"select * from order where id = 99999999999999999999", "SELECT * FROM order WHERE id = 99999999999999999999", nil},
+	}
+
+	for _, test := range tests {
+		fingerprint, literals, err := Fingerprint(test.query)
+		if err != nil {
+			t.Errorf("%v: %v", test.query, err)
+			continue
+		}
+
+		if fingerprint != test.fingerprint || !reflect.DeepEqual(literals, test.literals) {
+			t.Errorf("%v: expected %q %v, got %q %v", test.query, test.fingerprint, test.literals, fingerprint, literals)
+		}
+	}
+
+	if _, _, err := Fingerprint("select * from user where id = !"); err == nil {
+		t.Error("Expected a syntax error")
+	}
+}
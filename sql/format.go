@@ -0,0 +1,78 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The String methods of compiled queries write them as SQL, as they are shown
+// by EXPLAIN.
+
+func (v Val) String() string {
+	switch {
+	case v.Param != 0:
+		return "$" + strconv.Itoa(v.Param)
+	case v.Null:
+		return "NULL"
+	case v.IsNum:
+		return strconv.Itoa(v.Num)
+	default:
+		return "'" + v.Str + "'"
+	}
+}
+
+func (o Operand) String() string {
+	if o.Key != "" {
+		return o.Key
+	}
+	return o.Val.String()
+}
+
+func (c Comparator) String() string {
+	switch c {
+	case LessThan:
+		return "<"
+	case GreaterThan:
+		return ">"
+	case EqualTo:
+		return "="
+	case IsNull:
+		return "IS NULL"
+	case IsNotNull:
+		return "IS NOT NULL"
+	default:
+		return "?"
+	}
+}
+
+func (f Filter) String() string {
+	s := f.Left.String() + " " + f.Comparator.String()
+	if f.Comparator != IsNull && f.Comparator != IsNotNull {
+		s += " " + f.Right.String()
+	}
+
+	if f.Negated {
+		return "NOT (" + s + ")"
+	}
+	return s
+}
+
+func (w WhereClause) String() string {
+	filters := make([]string, len(w.Filters))
+	for i, f := range w.Filters {
+		filters[i] = f.String()
+	}
+
+	return strings.Join(filters, " AND ")
+}
+
+func (k SortKey) String() string {
+	if k.Descending {
+		return k.Key + " DESC"
+	}
+	return k.Key
+}
+
+func (j Join) String() string {
+	return j.Table + " ON " + j.Left + " " + j.Comparator.String() + " " + j.Right
+}
@@ -1,7 +1,7 @@
 package lexer
 
 import (
-	"errors"
+	"fmt"
 	"regexp"
 	"strings"
 	"unicode"
@@ -16,6 +16,13 @@ const (
 	Where
 	And
 	Orderby
+	GroupBy
+	Having
+	Limit
+	Offset
+	Asc
+	Desc
+	AsOf
 	Inner
 	Outer
 	Left
@@ -23,6 +30,7 @@ const (
 	Join
 	On
 	Union
+	All
 	Intersect
 	Minus
 	Insert
@@ -31,6 +39,24 @@ const (
 	Update
 	Set
 	Del
+	Begin
+	Commit
+	Rollback
+	Create
+	Drop
+	Table
+	Index
+	PrimaryKey
+	Alter
+	Add
+	Column
+	Rename
+	To
+	Is
+	Not
+	Null
+	Explain
+	Analyze
 	Comma
 	Lparen
 	Rparen
@@ -41,95 +67,201 @@ const (
 	Str
 	Num
 	StringLit
+	Placeholder
 )
 
 type Token struct {
 	Kind TokenType
-	Str  string
+	Str  string // Text of identifiers and literals, or the number of a $n placeholder
+	Pos  int    // Byte offset of the token in the input
+}
+
+// keywords maps the text of each keyword and symbol to its token type.
+var keywords = map[string]TokenType{
+	"select":      Slct,
+	"from":        From,
+	"where":       Where,
+	"and":         And,
+	"order by":    Orderby,
+	"group by":    GroupBy,
+	"having":      Having,
+	"limit":       Limit,
+	"offset":      Offset,
+	"asc":         Asc,
+	"desc":        Desc,
+	"as of":       AsOf,
+	"inner":       Inner,
+	"outer":       Outer,
+	"left":        Left,
+	"right":       Right,
+	"join":        Join,
+	"on":          On,
+	"union":       Union,
+	"all":         All,
+	"intersect":   Intersect,
+	"minus":       Minus,
+	"insert":      Insert,
+	"into":        Into,
+	"values":      Values,
+	"update":      Update,
+	"set":         Set,
+	"delete":      Del,
+	"begin":       Begin,
+	"commit":      Commit,
+	"rollback":    Rollback,
+	"create":      Create,
+	"drop":        Drop,
+	"table":       Table,
+	"index":       Index,
+	"primary key": PrimaryKey,
+	"alter":       Alter,
+	"add":         Add,
+	"column":      Column,
+	"rename":      Rename,
+	"to":          To,
+	"is":          Is,
+	"not":         Not,
+	"null":        Null,
+	"explain":     Explain,
+	"analyze":     Analyze,
+	"(":           Lparen,
+	")":           Rparen,
+	",":           Comma,
+	"=":           Equal,
+	">":           Greater,
+	"<":           Less,
+	"*":           Star,
+	"?":           Placeholder,
+}
+
+func (t TokenType) String() string {
+	switch t {
+	case Eof:
+		return "end of query"
+	case Str:
+		return "identifier"
+	case Num:
+		return "number"
+	case StringLit:
+		return "string"
+	case Placeholder:
+		return "placeholder"
+	}
+
+	for str, tok := range keywords {
+		if tok == t {
+			return strings.ToUpper(str)
+		}
+	}
+
+	return "unknown token"
+}
+
+// A SyntaxError reports a query which cannot be lexed or parsed.
+type SyntaxError struct {
+	Pos  int    // Byte offset in the query at which the error was found
+	Near string // Text of the query at Pos
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("Syntax error at position %d near %q: %s", e.Pos, e.Near, e.Msg)
 }
 
 type Lexer struct {
+	input         string
 	str           string
-	dictionary    map[string]TokenType
 	strPattern    *regexp.Regexp
 	strLitPattern *regexp.Regexp
 	numPattern    *regexp.Regexp
+	paramPattern  *regexp.Regexp
 }
 
 func New(input string) *Lexer {
-	return &Lexer{str: strings.ToLower(input),
-		dictionary: map[string]TokenType{
-			"select":    Slct,
-			"from":      From,
-			"where":     Where,
-			"and":       And,
-			"order by":  Orderby,
-			"inner":     Inner,
-			"outer":     Outer,
-			"left":      Left,
-			"right":     Right,
-			"join":      Join,
-			"on":        On,
-			"union":     Union,
-			"intersect": Intersect,
-			"minus":     Minus,
-			"insert":    Insert,
-			"into":      Into,
-			"values":    Values,
-			"update":    Update,
-			"set":       Set,
-			"delete":    Del,
-			"(":         Lparen,
-			")":         Rparen,
-			",":         Comma,
-			"=":         Equal,
-			">":         Greater,
-			"<":         Less,
-			"*":         Star,
-		},
+	return &Lexer{
+		input:         strings.ToLower(input),
+		str:           strings.ToLower(input),
 		strPattern:    regexp.MustCompile("[a-zA-Z0-9_\\.]+"),
 		strLitPattern: regexp.MustCompile("'[^']*'"),
-		numPattern:    regexp.MustCompile("[0-9]+"),
+		numPattern:    regexp.MustCompile("[0-9]+\\b"),
+		paramPattern:  regexp.MustCompile("\\$[0-9]+\\b"),
 	}
 }
 
-func (l *Lexer) Lex() Token {
+// Lex returns the next token of the input, or a *SyntaxError if the input does
+// not begin with a valid token.
+func (l *Lexer) Lex() (Token, error) {
 	for {
-		unchanged := true
+		pos := len(l.input) - len(l.str)
 
 		if len(l.str) == 0 {
-			return Token{Eof, ""}
+			return Token{Eof, "", pos}, nil
 		}
 
 		if unicode.IsSpace(rune(l.str[0])) {
 			l.str = l.str[1:]
-			unchanged = false
+			continue
 		}
 
-		for str, tok := range l.dictionary {
-			if strings.HasPrefix(l.str, str) {
+		for str, tok := range keywords {
+			if strings.HasPrefix(l.str, str) && !l.continuesWord(str) {
 				l.str = l.str[len(str):]
-				return Token{tok, ""}
+				return Token{tok, "", pos}, nil
 			}
 		}
 
+		// Numbers must be tried before strPattern, which also matches digits
+		if match := l.numPattern.FindString(l.str); match != "" && strings.HasPrefix(l.str, match) {
+			l.str = l.str[len(match):]
+			return Token{Num, match, pos}, nil
+		}
+
 		if match := l.strPattern.FindString(l.str); match != "" && strings.HasPrefix(l.str, match) {
 			l.str = l.str[len(match):]
-			return Token{Str, strings.TrimSpace(match)}
+			return Token{Str, strings.TrimSpace(match), pos}, nil
 		}
 
-		if match := l.strLitPattern.FindString(l.str); match != "" && strings.HasPrefix(l.str, match) {
+		if match := l.paramPattern.FindString(l.str); match != "" && strings.HasPrefix(l.str, match) {
 			l.str = l.str[len(match):]
-			return Token{StringLit, match[1 : len(match)-1]}
+			return Token{Placeholder, match[1:], pos}, nil
 		}
 
-		if match := l.numPattern.FindString(l.str); match != "" && strings.HasPrefix(l.str, match) {
+		if match := l.strLitPattern.FindString(l.str); match != "" && strings.HasPrefix(l.str, match) {
 			l.str = l.str[len(match):]
-			return Token{Num, match}
+			return Token{StringLit, match[1 : len(match)-1], pos}, nil
 		}
 
-		if unchanged {
-			panic(errors.New("Lex error"))
+		if l.str[0] == '\'' {
+			return Token{}, l.Error(pos, "unterminated string")
 		}
+		return Token{}, l.Error(pos, "unexpected character")
+	}
+}
+
+// Error returns a *SyntaxError at the given position in the input.
+func (l *Lexer) Error(pos int, msg string) *SyntaxError {
+	near := l.input[pos:]
+	if i := strings.IndexFunc(near, unicode.IsSpace); i >= 0 {
+		near = near[:i]
+	}
+	if len(near) > 20 {
+		near = near[:20]
 	}
+
+	return &SyntaxError{pos, near, msg}
+}
+
+// continuesWord returns true if the input continues a keyword with further
+// characters of an identifier, as in "allowance", which should not be lexed as
+// the keyword "all".
+func (l *Lexer) continuesWord(keyword string) bool {
+	if len(l.str) == len(keyword) || !isWordChar(keyword[len(keyword)-1]) {
+		return false
+	}
+
+	return isWordChar(l.str[len(keyword)])
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '.' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
 }
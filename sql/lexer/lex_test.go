@@ -6,19 +6,202 @@ func TestLexer(t *testing.T) {
 	l := New("SELECT price FROM products WHERE name = 'apples and pears'")
 
 	tokens := []Token{
-		Token{Slct, ""},
-		Token{Str, "price"},
-		Token{From, ""},
-		Token{Str, "products"},
-		Token{Where, ""},
-		Token{Str, "name"},
-		Token{Equal, ""},
-		Token{StringLit, "apples and pears"},
-		Token{Eof, ""},
+		Token{Kind: Slct},
+		Token{Kind: Str, Str: "price"},
+		Token{Kind: From},
+		Token{Kind: Str, Str: "products"},
+		Token{Kind: Where},
+		Token{Kind: Str, Str: "name"},
+		Token{Kind: Equal},
+		Token{Kind: StringLit, Str: "apples and pears"},
+		Token{Kind: Eof},
 	}
 
+	expectTokens(t, l, tokens)
+}
+
+func TestLexNumbers(t *testing.T) {
+	l := New("UPDATE user SET price = 100 WHERE user_id = 3")
+
+	tokens := []Token{
+		Token{Kind: Update},
+		Token{Kind: Str, Str: "user"},
+		Token{Kind: Set},
+		Token{Kind: Str, Str: "price"},
+		Token{Kind: Equal},
+		Token{Kind: Num, Str: "100"},
+		Token{Kind: Where},
+		Token{Kind: Str, Str: "user_id"},
+		Token{Kind: Equal},
+		Token{Kind: Num, Str: "3"},
+		Token{Kind: Eof},
+	}
+
+	expectTokens(t, l, tokens)
+}
+
+func TestLexNull(t *testing.T) {
+	l := New("where notes is not null and isbn is null")
+
+	tokens := []Token{
+		Token{Kind: Where},
+		Token{Kind: Str, Str: "notes"},
+		Token{Kind: Is},
+		Token{Kind: Not},
+		Token{Kind: Null},
+		Token{Kind: And},
+		Token{Kind: Str, Str: "isbn"},
+		Token{Kind: Is},
+		Token{Kind: Null},
+		Token{Kind: Eof},
+	}
+
+	expectTokens(t, l, tokens)
+}
+
+func TestLexClauses(t *testing.T) {
+	l := New("explain analyze group by author having count(*) > 2 limit 5 offset 10")
+
+	tokens := []Token{
+		Token{Kind: Explain},
+		Token{Kind: Analyze},
+		Token{Kind: GroupBy},
+		Token{Kind: Str, Str: "author"},
+		Token{Kind: Having},
+		Token{Kind: Str, Str: "count"},
+		Token{Kind: Lparen},
+		Token{Kind: Star},
+		Token{Kind: Rparen},
+		Token{Kind: Greater},
+		Token{Kind: Num, Str: "2"},
+		Token{Kind: Limit},
+		Token{Kind: Num, Str: "5"},
+		Token{Kind: Offset},
+		Token{Kind: Num, Str: "10"},
+		Token{Kind: Eof},
+	}
+
+	expectTokens(t, l, tokens)
+}
+
+func TestLexCreateIndex(t *testing.T) {
+	l := New("create index order_user on order (user_id, price)")
+
+	tokens := []Token{
+		Token{Kind: Create},
+		Token{Kind: Index},
+		Token{Kind: Str, Str: "order_user"},
+		Token{Kind: On},
+		Token{Kind: Str, Str: "order"},
+		Token{Kind: Lparen},
+		Token{Kind: Str, Str: "user_id"},
+		Token{Kind: Comma},
+		Token{Kind: Str, Str: "price"},
+		Token{Kind: Rparen},
+		Token{Kind: Eof},
+	}
+
+	expectTokens(t, l, tokens)
+}
+
+func TestLexKeywordPrefix(t *testing.T) {
+	l := New("select allowance, order_id from settings union all select ids from items")
+
+	tokens := []Token{
+		Token{Kind: Slct},
+		Token{Kind: Str, Str: "allowance"},
+		Token{Kind: Comma},
+		Token{Kind: Str, Str: "order_id"},
+		Token{Kind: From},
+		Token{Kind: Str, Str: "settings"},
+		Token{Kind: Union},
+		Token{Kind: All},
+		Token{Kind: Slct},
+		Token{Kind: Str, Str: "ids"},
+		Token{Kind: From},
+		Token{Kind: Str, Str: "items"},
+		Token{Kind: Eof},
+	}
+
+	expectTokens(t, l, tokens)
+}
+
+func TestLexPlaceholders(t *testing.T) {
+	l := New("update order set price = ? where id = $12")
+
+	tokens := []Token{
+		Token{Kind: Update},
+		Token{Kind: Str, Str: "order"},
+		Token{Kind: Set},
+		Token{Kind: Str, Str: "price"},
+		Token{Kind: Equal},
+		Token{Kind: Placeholder},
+		Token{Kind: Where},
+		Token{Kind: Str, Str: "id"},
+		Token{Kind: Equal},
+		Token{Kind: Placeholder, Str: "12"},
+		Token{Kind: Eof},
+	}
+
+	expectTokens(t, l, tokens)
+}
+
+func TestLexPositions(t *testing.T) {
+	l := New("select  id from user where name = 'a b'")
+
+	for _, pos := range []int{0, 8, 11, 16, 21, 27, 32, 34, 39} {
+		tok, err := l.Lex()
+		if err != nil {
+			t.Error(err)
+		}
+		if tok.Pos != pos {
+			t.Errorf("Expected %v at position %v, got %v", tok, pos, tok.Pos)
+		}
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		pos   int
+		near  string
+	}{
+		{"select * from user where id = !3", 30, "!3"},
+		{"select * from user where name = 'alex", 32, "'alex"},
+		{"select ; from user", 7, ";"},
+		{"select * from user where id = $a", 30, "$a"},
+	}
+
+	for _, test := range tests {
+		l := New(test.input)
+
+		var err error
+		for err == nil {
+			var tok Token
+			tok, err = l.Lex()
+			if tok.Kind == Eof && err == nil {
+				break
+			}
+		}
+
+		e, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("%v: expected a syntax error, got %v", test.input, err)
+			continue
+		}
+		if e.Pos != test.pos || e.Near != test.near {
+			t.Errorf("%v: incorrect syntax error %v", test.input, e)
+		}
+	}
+}
+
+func expectTokens(t *testing.T, l *Lexer, tokens []Token) {
 	for _, token := range tokens {
-		if lexed := l.Lex(); lexed != token {
+		lexed, err := l.Lex()
+		if err != nil {
+			t.Error(err)
+		}
+		if lexed.Kind != token.Kind || lexed.Str != token.Str {
 			t.Errorf("Expected %v, got %v", token, lexed)
 		}
 	}
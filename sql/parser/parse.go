@@ -1,10 +1,9 @@
 package parser
 
 import (
-	"errors"
+	"strconv"
 
 	"github.com/alexbostock/alder/sql/lexer"
-	"github.com/davecgh/go-spew/spew"
 )
 
 type Nonterminal int
@@ -15,10 +14,31 @@ const (
 	InsertInto
 	UpdateSet
 	DeleteFrom
+	BeginTransaction
+	CommitTransaction
+	RollbackTransaction
+	CreateTable
+	CreateIndex
+	DropTable
+	AlterTable
+	Explain
+	ExplainAnalyze
+	AnalyzeTables
+	AddColumn
+	DropColumn
+	RenameColumn
+	FieldList
+	FieldDef
+	TypeName
+	PrimaryKeyType
+	NotNull
 	UnionOf
+	UnionAllOf
 	IntersectionOf
 	DifferenceOf
 	KeyList
+	SelectList
+	Aggregate
 	LiteralList
 	Key
 	Keys
@@ -28,31 +48,51 @@ const (
 	AssignmentList
 	Filters
 	WhereExpr
+	Negation
 	Smaller
 	Larger
 	Equals
+	IsNull
+	IsNotNull
 	InnerJoin
 	OuterJoin
 	LeftJoin
 	RightJoin
 	OrderBy
+	GroupBy
+	Having
+	Limit
+	Offset
+	SortKey
+	Ascending
+	Descending
+	AsOf
 	Literal
+	Placeholder
 	Table
 	Integer
 	StrVal
+	NullVal
 )
 
 type Node struct {
 	T    Nonterminal
 	Args []*Node
-	Val  string
+	Val  string // Identifier or literal, or the number of a Placeholder
+	Pos  int    // Byte offset in the query of the first token of the node
 }
 
 // A parser parses an SQL query, assumes the input does not end in a semicolon.
 // It should be instantiated using newParser.
+//
+// After the first syntax error, the parser behaves as if it has reached the
+// end of the input, so parsing finishes quickly and Parse returns the error.
 type Parser struct {
 	lookahead lexer.Token
 	l         *lexer.Lexer
+	err       *lexer.SyntaxError
+	anonymous int  // Number of ? placeholders parsed so far
+	numbered  bool // Whether a $n placeholder has been parsed
 }
 
 func New(input string) *Parser {
@@ -60,42 +100,137 @@ func New(input string) *Parser {
 		l: lexer.New(input),
 	}
 
-	p.lookahead = p.l.Lex()
+	p.next()
 
 	return p
 }
 
+// next reads the next token into lookahead.
+func (p *Parser) next() {
+	if p.err != nil {
+		return
+	}
+
+	tok, err := p.l.Lex()
+	if err != nil {
+		p.err = err.(*lexer.SyntaxError)
+		p.lookahead = lexer.Token{Kind: lexer.Eof, Pos: p.err.Pos}
+		return
+	}
+
+	p.lookahead = tok
+}
+
+// fail records a syntax error at the lookahead token, unless an error has
+// already been recorded.
+func (p *Parser) fail(msg string) {
+	if p.err == nil {
+		p.err = p.l.Error(p.lookahead.Pos, msg)
+		p.lookahead = lexer.Token{Kind: lexer.Eof, Pos: p.lookahead.Pos}
+	}
+}
+
 func (p *Parser) consume(t lexer.TokenType) string {
 	if p.lookahead.Kind == t {
 		s := p.lookahead.Str
-		p.lookahead = p.l.Lex()
+		p.next()
 
 		return s
 	} else {
-		spew.Dump(t)
-		spew.Dump(p.lookahead)
-		panic(errors.New("Parse error: unexpected token"))
+		p.fail("expected " + t.String() + " but found " + p.lookahead.Kind.String())
+		return ""
 	}
 }
 
-func (p *Parser) Parse() *Node {
+// Parse parses the whole input, and returns a *lexer.SyntaxError if it is not a
+// valid query.
+func (p *Parser) Parse() (*Node, error) {
+	var n *Node
+	if p.lookahead.Kind == lexer.Explain {
+		n = p.explain()
+	} else {
+		n = p.compound()
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	return n, nil
+}
+
+// explain parses EXPLAIN or EXPLAIN ANALYZE, followed by the query explained.
+func (p *Parser) explain() *Node {
+	pos := p.lookahead.Pos
+	p.consume(lexer.Explain)
+
+	n := &Node{Explain, nil, "", pos}
+	if p.lookahead.Kind == lexer.Analyze {
+		p.consume(lexer.Analyze)
+		n.T = ExplainAnalyze
+	}
+	n.Args = []*Node{p.compound()}
+
+	return n
+}
+
+// compound parses a query, or set operations combining queries, which are
+// applied from left to right. A set operation has a list of filters after its
+// two queries, of the clauses which apply to its result.
+func (p *Parser) compound() *Node {
 	n := p.query()
+	compound := false
 
 	for p.lookahead.Kind != lexer.Eof {
+		pos := p.lookahead.Pos
+
 		switch p.lookahead.Kind {
 		case lexer.Union:
 			p.consume(lexer.Union)
-			n = &Node{UnionOf, []*Node{n, p.query()}, ""}
+			if p.lookahead.Kind == lexer.All {
+				p.consume(lexer.All)
+				n = &Node{UnionAllOf, []*Node{n, p.query()}, "", pos}
+			} else {
+				n = &Node{UnionOf, []*Node{n, p.query()}, "", pos}
+			}
 		case lexer.Intersect:
 			p.consume(lexer.Intersect)
-			n = &Node{IntersectionOf, []*Node{n, p.query()}, ""}
+			n = &Node{IntersectionOf, []*Node{n, p.query()}, "", pos}
 		case lexer.Minus:
 			p.consume(lexer.Minus)
-			n = &Node{DifferenceOf, []*Node{n, p.query()}, ""}
+			n = &Node{DifferenceOf, []*Node{n, p.query()}, "", pos}
 		default:
-			panic(errors.New("Parse error: expected UNION, INTERSECT or MINUS"))
+			p.fail("expected UNION, INTERSECT or MINUS")
+		}
+		compound = true
+	}
+
+	if compound && p.err == nil {
+		n.Args = append(n.Args, resultFilters(n.Args[1]))
+	}
+
+	return n
+}
+
+// resultFilters removes the clauses which follow the last query of a set
+// operation, but apply to the result of the set operation, from the filters of
+// the query, and returns them. These are ORDER BY, LIMIT and OFFSET clauses.
+func resultFilters(last *Node) *Node {
+	n := &Node{Filters, make([]*Node, 0), "", last.Pos}
+	if last.T != SelectFrom {
+		return n
+	}
+
+	filters := last.Args[2]
+	kept := make([]*Node, 0, len(filters.Args))
+	for _, f := range filters.Args {
+		if f.T == OrderBy || f.T == Limit || f.T == Offset {
+			n.Args = append(n.Args, f)
+		} else {
+			kept = append(kept, f)
 		}
 	}
+	filters.Args = kept
 
 	return n
 }
@@ -110,22 +245,35 @@ func (p *Parser) query() *Node {
 		return p.updateSet()
 	case lexer.Del:
 		return p.del()
+	case lexer.Begin, lexer.Commit, lexer.Rollback:
+		return p.transaction()
+	case lexer.Create:
+		return p.create()
+	case lexer.Drop:
+		return p.dropTable()
+	case lexer.Alter:
+		return p.alterTable()
+	case lexer.Analyze:
+		return p.analyze()
 	default:
-		panic(errors.New("Parse error: expected SELECT, INSERT, UPDATE or DELETE"))
+		p.fail("expected SELECT, INSERT, UPDATE, DELETE, BEGIN, COMMIT, ROLLBACK, CREATE, DROP, ALTER or ANALYZE")
+		return &Node{SelectFrom, nil, "", p.lookahead.Pos}
 	}
 }
 
 func (p *Parser) selectFrom() *Node {
+	pos := p.lookahead.Pos
 	p.consume(lexer.Slct)
-	keys := p.keyList()
+	keys := p.selectList()
 	p.consume(lexer.From)
 	table := p.table()
 	filters := p.filters()
 
-	return &Node{SelectFrom, []*Node{keys, table, filters}, ""}
+	return &Node{SelectFrom, []*Node{keys, table, filters}, "", pos}
 }
 
 func (p *Parser) insertInto() *Node {
+	pos := p.lookahead.Pos
 	p.consume(lexer.Insert)
 	p.consume(lexer.Into)
 	table := p.table()
@@ -133,30 +281,182 @@ func (p *Parser) insertInto() *Node {
 	p.consume(lexer.Values)
 	valuesList := p.valuesList()
 
-	return &Node{InsertInto, []*Node{keys, table, valuesList}, ""}
+	return &Node{InsertInto, []*Node{keys, table, valuesList}, "", pos}
 }
 
 func (p *Parser) updateSet() *Node {
+	pos := p.lookahead.Pos
 	p.consume(lexer.Update)
 	table := p.table()
 	p.consume(lexer.Set)
 	assignments := p.assignmentList()
 	filters := p.filters()
 
-	return &Node{UpdateSet, []*Node{table, assignments, filters}, ""}
+	return &Node{UpdateSet, []*Node{table, assignments, filters}, "", pos}
 }
 
 func (p *Parser) del() *Node {
+	pos := p.lookahead.Pos
 	p.consume(lexer.Del)
 	p.consume(lexer.From)
 	table := p.table()
 	filters := p.filters()
 
-	return &Node{DeleteFrom, []*Node{table, filters}, ""}
+	return &Node{DeleteFrom, []*Node{table, filters}, "", pos}
+}
+
+var transactionStatements = map[lexer.TokenType]Nonterminal{
+	lexer.Begin:    BeginTransaction,
+	lexer.Commit:   CommitTransaction,
+	lexer.Rollback: RollbackTransaction,
+}
+
+func (p *Parser) transaction() *Node {
+	pos := p.lookahead.Pos
+	t := transactionStatements[p.lookahead.Kind]
+	p.consume(p.lookahead.Kind)
+
+	return &Node{t, nil, "", pos}
+}
+
+// create parses CREATE TABLE or CREATE INDEX.
+func (p *Parser) create() *Node {
+	pos := p.lookahead.Pos
+	p.consume(lexer.Create)
+
+	switch p.lookahead.Kind {
+	case lexer.Table:
+		return p.createTable(pos)
+	case lexer.Index:
+		return p.createIndex(pos)
+	default:
+		p.fail("expected TABLE or INDEX")
+		return &Node{CreateTable, nil, "", pos}
+	}
+}
+
+func (p *Parser) createTable(pos int) *Node {
+	p.consume(lexer.Table)
+	table := p.table()
+	p.consume(lexer.Lparen)
+	fields := p.fieldList()
+	p.consume(lexer.Rparen)
+
+	return &Node{CreateTable, []*Node{table, fields}, "", pos}
+}
+
+// createIndex parses the rest of CREATE INDEX: the name of the index, and the
+// table and fields it indexes.
+func (p *Parser) createIndex(pos int) *Node {
+	p.consume(lexer.Index)
+	namePos := p.lookahead.Pos
+	name := &Node{Key, nil, p.consume(lexer.Str), namePos}
+	p.consume(lexer.On)
+	table := p.table()
+	p.consume(lexer.Lparen)
+	fields := p.keyList()
+	p.consume(lexer.Rparen)
+
+	return &Node{CreateIndex, []*Node{name, table, fields}, "", pos}
+}
+
+func (p *Parser) dropTable() *Node {
+	pos := p.lookahead.Pos
+	p.consume(lexer.Drop)
+	p.consume(lexer.Table)
+	table := p.table()
+
+	return &Node{DropTable, []*Node{table}, "", pos}
+}
+
+// analyze parses ANALYZE, optionally followed by the table analyzed.
+func (p *Parser) analyze() *Node {
+	pos := p.lookahead.Pos
+	p.consume(lexer.Analyze)
+
+	n := &Node{AnalyzeTables, nil, "", pos}
+	if p.lookahead.Kind == lexer.Str {
+		n.Args = []*Node{p.table()}
+	}
+
+	return n
+}
+
+func (p *Parser) alterTable() *Node {
+	pos := p.lookahead.Pos
+	p.consume(lexer.Alter)
+	p.consume(lexer.Table)
+	table := p.table()
+
+	actionPos := p.lookahead.Pos
+	var action *Node
+	switch p.lookahead.Kind {
+	case lexer.Add:
+		p.consume(lexer.Add)
+		p.consume(lexer.Column)
+		action = &Node{AddColumn, []*Node{p.fieldDef()}, "", actionPos}
+	case lexer.Drop:
+		p.consume(lexer.Drop)
+		p.consume(lexer.Column)
+		action = &Node{DropColumn, []*Node{p.key()}, "", actionPos}
+	case lexer.Rename:
+		p.consume(lexer.Rename)
+		p.consume(lexer.Column)
+		from := p.key()
+		p.consume(lexer.To)
+		action = &Node{RenameColumn, []*Node{from, p.key()}, "", actionPos}
+	default:
+		p.fail("expected ADD COLUMN, DROP COLUMN or RENAME COLUMN")
+		action = &Node{DropColumn, []*Node{&Node{Key, nil, "", actionPos}}, "", actionPos}
+	}
+
+	return &Node{AlterTable, []*Node{table, action}, "", pos}
+}
+
+func (p *Parser) fieldList() *Node {
+	pos := p.lookahead.Pos
+	n := &Node{FieldList, make([]*Node, 0, 1), "", pos}
+	n.Args = append(n.Args, p.fieldDef())
+
+	for p.lookahead.Kind == lexer.Comma {
+		p.consume(lexer.Comma)
+		n.Args = append(n.Args, p.fieldDef())
+	}
+
+	return n
+}
+
+// fieldDef parses the definition of a field in CREATE TABLE: its name, and
+// either the name of its type, optionally followed by NOT NULL, or PRIMARY KEY.
+func (p *Parser) fieldDef() *Node {
+	pos := p.lookahead.Pos
+	name := p.consume(lexer.Str)
+
+	typePos := p.lookahead.Pos
+	if p.lookahead.Kind == lexer.PrimaryKey {
+		p.consume(lexer.PrimaryKey)
+		t := &Node{PrimaryKeyType, nil, "", typePos}
+		return &Node{FieldDef, []*Node{&Node{Key, nil, name, pos}, t}, "", pos}
+	}
+
+	n := &Node{FieldDef, []*Node{
+		&Node{Key, nil, name, pos},
+		&Node{TypeName, nil, p.consume(lexer.Str), typePos},
+	}, "", pos}
+
+	if p.lookahead.Kind == lexer.Not {
+		notPos := p.lookahead.Pos
+		p.consume(lexer.Not)
+		p.consume(lexer.Null)
+		n.Args = append(n.Args, &Node{NotNull, nil, "", notPos})
+	}
+
+	return n
 }
 
 func (p *Parser) keyList() *Node {
-	n := &Node{KeyList, make([]*Node, 0, 1), ""}
+	pos := p.lookahead.Pos
+	n := &Node{KeyList, make([]*Node, 0, 1), "", pos}
 	n.Args = append(n.Args, p.key())
 
 	for p.lookahead.Kind == lexer.Comma {
@@ -167,8 +467,38 @@ func (p *Parser) keyList() *Node {
 	return n
 }
 
+// selectList parses the fields selected by a query, which may be aggregates.
+func (p *Parser) selectList() *Node {
+	pos := p.lookahead.Pos
+	n := &Node{SelectList, make([]*Node, 0, 1), "", pos}
+	n.Args = append(n.Args, p.field())
+
+	for p.lookahead.Kind == lexer.Comma {
+		p.consume(lexer.Comma)
+		n.Args = append(n.Args, p.field())
+	}
+
+	return n
+}
+
+// field parses a key, or an aggregate function of a key or *, such as
+// SUM(price) or COUNT(*).
+func (p *Parser) field() *Node {
+	k := p.key()
+	if k.Val == "*" || p.lookahead.Kind != lexer.Lparen {
+		return k
+	}
+
+	p.consume(lexer.Lparen)
+	arg := p.key()
+	p.consume(lexer.Rparen)
+
+	return &Node{Aggregate, []*Node{arg}, k.Val, k.Pos}
+}
+
 func (p *Parser) literalList() *Node {
-	n := &Node{LiteralList, make([]*Node, 0, 1), ""}
+	pos := p.lookahead.Pos
+	n := &Node{LiteralList, make([]*Node, 0, 1), "", pos}
 	n.Args = append(n.Args, p.value())
 
 	for p.lookahead.Kind == lexer.Comma {
@@ -180,23 +510,26 @@ func (p *Parser) literalList() *Node {
 }
 
 func (p *Parser) keys() *Node {
+	pos := p.lookahead.Pos
 	p.consume(lexer.Lparen)
 	kl := p.keyList()
 	p.consume(lexer.Rparen)
 
-	return &Node{Keys, []*Node{kl}, ""}
+	return &Node{Keys, []*Node{kl}, "", pos}
 }
 
 func (p *Parser) values() *Node {
+	pos := p.lookahead.Pos
 	p.consume(lexer.Lparen)
 	ll := p.literalList()
 	p.consume(lexer.Rparen)
 
-	return &Node{Literals, []*Node{ll}, ""}
+	return &Node{Literals, []*Node{ll}, "", pos}
 }
 
 func (p *Parser) valuesList() *Node {
-	n := &Node{ValueList, make([]*Node, 0, 1), ""}
+	pos := p.lookahead.Pos
+	n := &Node{ValueList, make([]*Node, 0, 1), "", pos}
 	n.Args = append(n.Args, p.values())
 
 	for p.lookahead.Kind == lexer.Comma {
@@ -208,15 +541,17 @@ func (p *Parser) valuesList() *Node {
 }
 
 func (p *Parser) assignment() *Node {
+	pos := p.lookahead.Pos
 	key := p.key()
 	p.consume(lexer.Equal)
 	val := p.value()
 
-	return &Node{Assignment, []*Node{key, val}, ""}
+	return &Node{Assignment, []*Node{key, val}, "", pos}
 }
 
 func (p *Parser) assignmentList() *Node {
-	n := &Node{AssignmentList, make([]*Node, 0, 1), ""}
+	pos := p.lookahead.Pos
+	n := &Node{AssignmentList, make([]*Node, 0, 1), "", pos}
 	n.Args = append(n.Args, p.assignment())
 
 	for p.lookahead.Kind == lexer.Comma {
@@ -228,7 +563,8 @@ func (p *Parser) assignmentList() *Node {
 }
 
 func (p *Parser) filters() *Node {
-	n := &Node{Filters, make([]*Node, 0), ""}
+	pos := p.lookahead.Pos
+	n := &Node{Filters, make([]*Node, 0), "", pos}
 	for {
 		switch p.lookahead.Kind {
 		case lexer.Where:
@@ -236,60 +572,194 @@ func (p *Parser) filters() *Node {
 			for p.lookahead.Kind == lexer.And {
 				n.Args = append(n.Args, p.and())
 			}
+		case lexer.GroupBy:
+			n.Args = append(n.Args, p.groupBy())
+		case lexer.Having:
+			n.Args = append(n.Args, p.having())
 		case lexer.Orderby:
 			n.Args = append(n.Args, p.order())
+		case lexer.Limit:
+			n.Args = append(n.Args, p.limit(lexer.Limit, Limit))
+		case lexer.Offset:
+			n.Args = append(n.Args, p.limit(lexer.Offset, Offset))
+		case lexer.AsOf:
+			n.Args = append(n.Args, p.asOf())
 		case lexer.Inner, lexer.Outer, lexer.Left, lexer.Right, lexer.Join:
 			n.Args = append(n.Args, p.join())
 		case lexer.Eof, lexer.Union, lexer.Intersect, lexer.Minus:
 			return n
 		default:
-			panic(errors.New("Parse error: expected WHERE, ORDER or [INNER|OUTER|LEFT|RIGHT] JOIN"))
+			p.fail("expected WHERE, GROUP BY, HAVING, ORDER BY, LIMIT, OFFSET, AS OF or [INNER|OUTER|LEFT|RIGHT] JOIN")
 		}
 	}
 }
 
 func (p *Parser) where() *Node {
+	pos := p.lookahead.Pos
 	p.consume(lexer.Where)
-	a := p.value()
-	comp := p.comparator()
-	b := p.value()
 
-	return &Node{WhereExpr, []*Node{a, comp, b}, ""}
+	return p.condition(pos)
 }
 
 func (p *Parser) and() *Node {
+	pos := p.lookahead.Pos
 	p.consume(lexer.And)
+
+	return p.condition(pos)
+}
+
+// condition parses a comparison of two values, or a test of whether a value
+// IS NULL or IS NOT NULL, which has only one. Either may be negated by NOT, and
+// enclosed in parentheses after it.
+func (p *Parser) condition(pos int) *Node {
+	if p.lookahead.Kind == lexer.Not {
+		notPos := p.lookahead.Pos
+		p.consume(lexer.Not)
+
+		if p.lookahead.Kind != lexer.Lparen {
+			return &Node{Negation, []*Node{p.condition(notPos)}, "", pos}
+		}
+
+		p.consume(lexer.Lparen)
+		n := &Node{Negation, []*Node{p.condition(notPos)}, "", pos}
+		p.consume(lexer.Rparen)
+
+		return n
+	}
+
 	a := p.value()
+
+	if p.lookahead.Kind == lexer.Is {
+		testPos := p.lookahead.Pos
+		p.consume(lexer.Is)
+		test := &Node{IsNull, nil, "", testPos}
+		if p.lookahead.Kind == lexer.Not {
+			p.consume(lexer.Not)
+			test.T = IsNotNull
+		}
+		p.consume(lexer.Null)
+
+		return &Node{WhereExpr, []*Node{a, test}, "", pos}
+	}
+
 	comp := p.comparator()
 	b := p.value()
 
-	return &Node{WhereExpr, []*Node{a, comp, b}, ""}
+	return &Node{WhereExpr, []*Node{a, comp, b}, "", pos}
 }
 
 func (p *Parser) comparator() *Node {
+	pos := p.lookahead.Pos
 	switch p.lookahead.Kind {
 	case lexer.Less:
 		p.consume(lexer.Less)
-		return &Node{Smaller, nil, ""}
+		return &Node{Smaller, nil, "", pos}
 	case lexer.Greater:
 		p.consume(lexer.Greater)
-		return &Node{Larger, nil, ""}
+		return &Node{Larger, nil, "", pos}
 	case lexer.Equal:
 		p.consume(lexer.Equal)
-		return &Node{Equals, nil, ""}
+		return &Node{Equals, nil, "", pos}
 	default:
-		panic(errors.New("Parse error: expected <, > or ="))
+		p.fail("expected <, > or =")
+		return &Node{Equals, nil, "", pos}
 	}
 }
+
 func (p *Parser) order() *Node {
+	pos := p.lookahead.Pos
 	p.consume(lexer.Orderby)
-	k := p.key()
+	n := &Node{OrderBy, make([]*Node, 0, 1), "", pos}
+	n.Args = append(n.Args, p.sortKey())
+
+	for p.lookahead.Kind == lexer.Comma {
+		p.consume(lexer.Comma)
+		n.Args = append(n.Args, p.sortKey())
+	}
+
+	return n
+}
 
-	return &Node{OrderBy, []*Node{k}, ""}
+// limit parses a LIMIT or OFFSET clause, whose count is a number, NULL or a
+// placeholder.
+func (p *Parser) limit(kind lexer.TokenType, t Nonterminal) *Node {
+	pos := p.lookahead.Pos
+	p.consume(kind)
+
+	var v *Node
+	switch p.lookahead.Kind {
+	case lexer.Num, lexer.Null, lexer.Placeholder:
+		v = p.value()
+	default:
+		p.fail("expected a number, NULL or placeholder")
+	}
+
+	return &Node{t, []*Node{v}, "", pos}
+}
+
+func (p *Parser) groupBy() *Node {
+	pos := p.lookahead.Pos
+	p.consume(lexer.GroupBy)
+	n := &Node{GroupBy, make([]*Node, 0, 1), "", pos}
+	n.Args = append(n.Args, p.key())
+
+	for p.lookahead.Kind == lexer.Comma {
+		p.consume(lexer.Comma)
+		n.Args = append(n.Args, p.key())
+	}
+
+	return n
+}
+
+// having parses a HAVING clause: a conjunction of conditions on groups.
+func (p *Parser) having() *Node {
+	pos := p.lookahead.Pos
+	p.consume(lexer.Having)
+	n := &Node{Having, []*Node{p.condition(pos)}, "", pos}
+
+	for p.lookahead.Kind == lexer.And {
+		andPos := p.lookahead.Pos
+		p.consume(lexer.And)
+		n.Args = append(n.Args, p.condition(andPos))
+	}
+
+	return n
+}
+
+func (p *Parser) sortKey() *Node {
+	pos := p.lookahead.Pos
+	k := p.field()
+
+	switch p.lookahead.Kind {
+	case lexer.Asc:
+		p.consume(lexer.Asc)
+		return &Node{SortKey, []*Node{k, &Node{Ascending, nil, "", pos}}, "", pos}
+	case lexer.Desc:
+		p.consume(lexer.Desc)
+		return &Node{SortKey, []*Node{k, &Node{Descending, nil, "", pos}}, "", pos}
+	default:
+		return &Node{SortKey, []*Node{k, &Node{Ascending, nil, "", pos}}, "", pos}
+	}
+}
+
+func (p *Parser) asOf() *Node {
+	pos := p.lookahead.Pos
+	p.consume(lexer.AsOf)
+
+	var v *Node
+	switch p.lookahead.Kind {
+	case lexer.Num, lexer.StringLit:
+		v = p.value()
+	default:
+		p.fail("expected a transaction number or 'timestamp'")
+	}
+
+	return &Node{AsOf, []*Node{v}, "", pos}
 }
 
 func (p *Parser) join() *Node {
-	n := &Node{}
+	pos := p.lookahead.Pos
+	n := &Node{Pos: pos}
 
 	switch p.lookahead.Kind {
 	case lexer.Inner:
@@ -307,7 +777,7 @@ func (p *Parser) join() *Node {
 	case lexer.Join:
 		n.T = InnerJoin
 	default:
-		panic(errors.New("Parse error: expected a JOIN statement"))
+		p.fail("expected a JOIN statement")
 	}
 
 	p.consume(lexer.Join)
@@ -324,6 +794,7 @@ func (p *Parser) join() *Node {
 }
 
 func (p *Parser) key() *Node {
+	pos := p.lookahead.Pos
 	var s string
 	if p.lookahead.Kind == lexer.Str {
 		s = p.consume(lexer.Str)
@@ -332,29 +803,67 @@ func (p *Parser) key() *Node {
 		p.consume(lexer.Star)
 	}
 
-	return &Node{Key, nil, s}
+	return &Node{Key, nil, s, pos}
 }
 
 func (p *Parser) table() *Node {
+	pos := p.lookahead.Pos
 	s := p.consume(lexer.Str)
 
-	return &Node{Table, nil, s}
+	return &Node{Table, nil, s, pos}
 }
 
 func (p *Parser) value() *Node {
+	pos := p.lookahead.Pos
 	switch p.lookahead.Kind {
 	case lexer.Str:
-		return p.key()
+		return p.field()
+	case lexer.Placeholder:
+		return p.placeholder()
 	case lexer.Num:
 		return &Node{Literal, []*Node{
-			&Node{Integer, nil, p.consume(lexer.Num)},
-		}, ""}
+			&Node{Integer, nil, p.consume(lexer.Num), pos},
+		}, "", pos}
 	case lexer.StringLit:
 		s := p.consume(lexer.StringLit)
 		return &Node{Literal, []*Node{
-			&Node{StrVal, nil, s},
-		}, ""}
+			&Node{StrVal, nil, s, pos},
+		}, "", pos}
+	case lexer.Null:
+		p.consume(lexer.Null)
+		return &Node{Literal, []*Node{
+			&Node{NullVal, nil, "", pos},
+		}, "", pos}
 	default:
-		panic(errors.New("Parse error: expected a key, \"string\" or number"))
+		p.fail("expected a key, 'string', number, NULL or placeholder")
+		return &Node{Literal, []*Node{&Node{Integer, nil, "0", pos}}, "", pos}
 	}
 }
+
+// placeholder parses a parameter placeholder, numbering it. The placeholders
+// in a query are either all ?, numbered from 1 in order, or all $n.
+func (p *Parser) placeholder() *Node {
+	pos := p.lookahead.Pos
+
+	var n int
+	if p.lookahead.Str == "" {
+		if p.numbered {
+			p.fail("cannot mix ? and $n placeholders")
+		}
+		p.anonymous++
+		n = p.anonymous
+	} else {
+		if p.anonymous > 0 {
+			p.fail("cannot mix ? and $n placeholders")
+		}
+		p.numbered = true
+		n, _ = strconv.Atoi(p.lookahead.Str)
+		if n == 0 {
+			p.fail("placeholders are numbered from $1")
+		}
+	}
+
+	p.consume(lexer.Placeholder)
+
+	return &Node{Placeholder, nil, strconv.Itoa(n), pos}
+}
@@ -3,6 +3,7 @@ package parser
 import (
 	"testing"
 
+	"github.com/alexbostock/alder/sql/lexer"
 	"github.com/davecgh/go-spew/spew"
 )
 
@@ -11,10 +12,100 @@ func TestParser(t *testing.T) {
 		"SELECT price FROM order WHERE user_id = 1",
 		"select surname, price from order join user on user.id = order.user_id intersect select surname from user where forename = 'Alex' and surname = 'Bostock'",
 		"INSERT INTO user (forename, surname) VALUES ('Alex', 'Bostock')",
+		"SELECT * FROM order WHERE price > 10 ORDER BY user_id DESC, price, items ASC",
+		"SELECT forename FROM user UNION ALL SELECT surname FROM user MINUS SELECT items FROM order",
+		"SELECT * FROM order WHERE price > 10 AS OF 3",
+		"SELECT * FROM order AS OF '2026-10-18T10:00:00Z'",
+		"UPDATE order SET price = ? WHERE id = ? AND price < ?",
+		"INSERT INTO order (items, price) VALUES ($2, $1), ($3, $1)",
+		"CREATE TABLE item (name string, id PRIMARY KEY, price int)",
+		"DROP TABLE item",
+		"CREATE INDEX order_user ON order (user_id)",
+		"CREATE INDEX order_user_price ON order (user_id, price)",
+		"ALTER TABLE item ADD COLUMN stock int",
+		"ALTER TABLE item DROP COLUMN price",
+		"ALTER TABLE item RENAME COLUMN name TO label",
+		"ALTER TABLE item ADD COLUMN stock int NOT NULL",
+		"CREATE TABLE item (id PRIMARY KEY, name string NOT NULL, note string)",
+		"SELECT * FROM order WHERE items IS NULL AND price IS NOT NULL AND user_id = NULL",
+		"SELECT * FROM order WHERE NOT (price = NULL) AND NOT items IS NULL",
+		"INSERT INTO order (items, price) VALUES (NULL, 3)",
+		"UPDATE order SET items = NULL",
+		"SELECT user_id, COUNT(*), SUM(price) FROM order WHERE price > 10 GROUP BY user_id HAVING COUNT(items) > 1 AND MAX(price) < 100 ORDER BY AVG(price) DESC",
+		"SELECT surname, forename, MIN(order.price) FROM user JOIN order ON user.id = order.user_id GROUP BY surname, forename",
+		"SELECT * FROM order ORDER BY price DESC LIMIT 10 OFFSET 20",
+		"SELECT * FROM order OFFSET ? LIMIT ?",
+		"ANALYZE",
+		"ANALYZE order",
+		"EXPLAIN SELECT * FROM order WHERE id = 3",
+		"EXPLAIN ANALYZE SELECT items FROM order UNION SELECT surname FROM user",
+		"SELECT forename FROM user UNION SELECT surname FROM user WHERE id > 1 ORDER BY forename DESC",
+		"SELECT forename FROM user INTERSECT SELECT surname FROM user LIMIT 2 OFFSET ?",
+		"BEGIN",
+		"COMMIT",
+		"ROLLBACK",
 	}
 
 	for _, q := range queries {
 		l := New(q)
-		spew.Dump(l.Parse())
+		n, err := l.Parse()
+		if err != nil {
+			t.Errorf("%v: %v", q, err)
+		}
+		spew.Dump(n)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+		near  string
+	}{
+		{"SELECT price order WHERE user_id = 1", 13, "order"},
+		{"SELECT price FROM order WHERE user_id 1", 38, "1"},
+		{"SELECT price FROM order WHERE", 29, ""},
+		{"INSERT INTO user (forename VALUES ('Alex')", 27, "values"},
+		{"SELECT price FROM order UNION", 29, ""},
+		{"TRUNCATE user", 0, "truncate"},
+		{"DROP user", 5, "user"},
+		{"CREATE TABLE item (id PRIMARY KEY, name)", 39, ")"},
+		{"CREATE item (id PRIMARY KEY)", 7, "item"},
+		{"CREATE INDEX order_user order (user_id)", 24, "order"},
+		{"CREATE INDEX order_user ON order ()", 34, ")"},
+		{"ALTER TABLE item price int", 17, "price"},
+		{"SELECT * FROM order WHERE items IS 3", 35, "3"},
+		{"CREATE TABLE item (id PRIMARY KEY NOT NULL)", 34, "not"},
+		{"ALTER TABLE item RENAME COLUMN name label", 36, "label"},
+		{"BEGIN TRANSACTION", 6, "transaction"},
+		{"SELECT * FROM order AS OF price", 26, "price"},
+		{"SELECT price FROM order WHERE user_id = #", 40, "#"},
+		{"SELECT price FROM order WHERE user_id = ? AND price > $1", 54, "$1"},
+		{"SELECT price FROM order WHERE user_id = $0", 40, "$0"},
+		{"SELECT price FROM ?", 18, "?"},
+		{"SELECT count(price FROM order", 19, "from"},
+		{"SELECT price FROM order GROUP BY", 32, ""},
+		{"SELECT price FROM order HAVING price", 36, ""},
+		{"SELECT * FROM order LIMIT price", 26, "price"},
+		{"SELECT * FROM order OFFSET", 26, ""},
+		{"EXPLAIN ANALYZE", 15, ""},
+		{"ANALYZE order user", 14, "user"},
+		{"SELECT * FROM order UNION EXPLAIN SELECT * FROM user", 26, "explain"},
+	}
+
+	for _, test := range tests {
+		n, err := New(test.query).Parse()
+		if n != nil {
+			t.Errorf("%v: expected no parse tree", test.query)
+		}
+
+		e, ok := err.(*lexer.SyntaxError)
+		if !ok {
+			t.Errorf("%v: expected a syntax error, got %v", test.query, err)
+			continue
+		}
+		if e.Pos != test.pos || e.Near != test.near {
+			t.Errorf("%v: incorrect syntax error %v", test.query, e)
+		}
 	}
 }
@@ -0,0 +1,229 @@
+package sql
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/alexbostock/alder/schema"
+	"github.com/alexbostock/alder/sql/parser"
+)
+
+// A Statement is a compiled query whose values may include parameters, given by
+// placeholders in the query: either ?, numbered in order, or $1, $2 and so on.
+// A Statement can be executed many times, with different values bound to its
+// parameters.
+type Statement struct {
+	Query  Query             // Compiled query, whose Vals may refer to parameters
+	Params []schema.Datatype // Type of each parameter ($1 first), Int or String
+}
+
+// Prepare compiles a query which may have placeholders for parameters. Each
+// parameter is given the type of the field to which it is assigned or with
+// which it is compared. Prepare returns the same errors as Compile, a
+// *SemanticError if a parameter number is skipped, and a *TypeError if a
+// parameter is used with different types or its type cannot be inferred.
+func Prepare(s schema.Schema, query string) (*Statement, error) {
+	schemaMap := make(map[string]map[string]schema.Datatype) // table -> key -> type
+
+	for _, tab := range s.Tables {
+		schemaMap[tab.Name] = make(map[string]schema.Datatype)
+
+		for _, field := range tab.Fields {
+			schemaMap[tab.Name][field.Name] = field.Type
+		}
+	}
+
+	tree, err := parser.New(query).Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := check(schemaMap, s, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	// Index names are not in schemaMap
+	if ci, ok := q.(*CreateIndexQuery); ok && s.HasIndex(ci.Index.Name) {
+		return nil, &SemanticError{tree.Args[0].Pos, ci.Index.Name, "index already exists"}
+	}
+
+	params, err := checkParams(tree, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Statement{q, params}, nil
+}
+
+// checkParams returns the types of the parameters of a compiled query, given
+// its parse tree. Parameters must be numbered from 1 without gaps.
+func checkParams(tree *parser.Node, q Query) ([]schema.Datatype, error) {
+	positions := make(map[int]int) // Number -> position of first placeholder
+	placeholders(tree, positions)
+
+	last := 0
+	for n := range positions {
+		if n > last {
+			last = n
+		}
+	}
+	for n := 1; n < last; n++ {
+		if _, ok := positions[n]; !ok {
+			return nil, &SemanticError{positions[last], "", fmt.Sprintf("parameter $%d is used, but not $%d", last, n)}
+		}
+	}
+
+	types := make([]schema.Datatype, last)
+	seen := make([]bool, last)
+	var err error
+
+	mapVals(q, func(v Val) Val {
+		if v.Param == 0 || err != nil {
+			return v
+		}
+
+		t := schema.String
+		if v.IsNum {
+			t = schema.Int
+		}
+
+		i := v.Param - 1
+		if seen[i] && types[i] != t {
+			err = &TypeError{positions[v.Param], "", fmt.Sprintf("parameter $%d is used as both int and string", v.Param)}
+		}
+		types[i], seen[i] = t, true
+
+		return v
+	})
+
+	return types, err
+}
+
+// placeholders records the position of the first placeholder for each
+// parameter in a parse tree.
+func placeholders(n *parser.Node, positions map[int]int) {
+	if n == nil {
+		return
+	}
+
+	if n.T == parser.Placeholder {
+		num, _ := strconv.Atoi(n.Val)
+		if pos, ok := positions[num]; !ok || n.Pos < pos {
+			positions[num] = n.Pos
+		}
+	}
+
+	for _, arg := range n.Args {
+		placeholders(arg, positions)
+	}
+}
+
+// Check returns a *BindError if the number or types of the given values do not
+// match the statement's parameters. Any parameter may be NULL.
+func (st *Statement) Check(args []Val) error {
+	if len(args) != len(st.Params) {
+		return &BindError{0, fmt.Sprintf("expected %d parameters, got %d", len(st.Params), len(args))}
+	}
+
+	for i, t := range st.Params {
+		switch {
+		case args[i].Null:
+		case t == schema.Int && !args[i].IsNum:
+			return &BindError{i + 1, "expected int"}
+		case t == schema.String && args[i].IsNum:
+			return &BindError{i + 1, "expected string"}
+		}
+	}
+
+	return nil
+}
+
+// Bind returns the statement's query with the given values bound to its
+// parameters, in order. It returns the error from Check if the values do not
+// match the parameters.
+func (st *Statement) Bind(args []Val) (Query, error) {
+	if err := st.Check(args); err != nil {
+		return nil, err
+	}
+
+	if len(args) == 0 {
+		return st.Query, nil
+	}
+
+	return mapVals(st.Query, func(v Val) Val {
+		if v.Param == 0 {
+			return v
+		}
+
+		bound := args[v.Param-1]
+		bound.Param = 0
+		return bound
+	}), nil
+}
+
+// mapVals returns a copy of a query in which each literal value v is replaced
+// by f(v). Parts of the query without values are shared with the original.
+func mapVals(q Query, f func(Val) Val) Query {
+	switch query := q.(type) {
+	case *SelectQuery:
+		mapped := *query
+		mapped.Where = query.Where.mapVals(f)
+		mapped.Having = query.Having.mapVals(f)
+		mapped.Limit = f(query.Limit)
+		mapped.Offset = f(query.Offset)
+		return &mapped
+	case *CompoundQuery:
+		mapped := *query
+		mapped.Left = mapVals(query.Left, f)
+		mapped.Right = mapVals(query.Right, f)
+		mapped.Limit = f(query.Limit)
+		mapped.Offset = f(query.Offset)
+		return &mapped
+	case *ExplainQuery:
+		return &ExplainQuery{mapVals(query.Query, f), query.Analyze}
+	case *InsertQuery:
+		mapped := *query
+		mapped.Values = make([][]Val, len(query.Values))
+		for i, values := range query.Values {
+			mapped.Values[i] = make([]Val, len(values))
+			for j, v := range values {
+				mapped.Values[i][j] = f(v)
+			}
+		}
+		return &mapped
+	case *UpdateQuery:
+		mapped := *query
+		mapped.Values = make(map[string]Val, len(query.Values))
+		for key, v := range query.Values {
+			mapped.Values[key] = f(v)
+		}
+		mapped.Where = query.Where.mapVals(f)
+		return &mapped
+	case *DeleteQuery:
+		mapped := *query
+		mapped.Where = query.Where.mapVals(f)
+		return &mapped
+	default:
+		return q
+	}
+}
+
+func (w WhereClause) mapVals(f func(Val) Val) WhereClause {
+	if len(w.Filters) == 0 {
+		return w
+	}
+
+	filters := make([]Filter, len(w.Filters))
+	for i, filter := range w.Filters {
+		if filter.Left.Key == "" {
+			filter.Left.Val = f(filter.Left.Val)
+		}
+		if filter.Right.Key == "" {
+			filter.Right.Val = f(filter.Right.Val)
+		}
+		filters[i] = filter
+	}
+
+	return WhereClause{filters}
+}
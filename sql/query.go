@@ -1,27 +1,192 @@
 package sql
 
-import "github.com/alexbostock/alder/sql/parser"
+import (
+	"time"
+
+	"github.com/alexbostock/alder/schema"
+)
 
 // A Query is a semantic representation of a type-safe query. It should be
 // instantiated by Compile.
 type Query interface{}
 
+// A TransactionStatement starts or ends a transaction.
+type TransactionStatement int
+
+const (
+	Begin    TransactionStatement = iota // Start a transaction
+	Commit                               // Make the changes of the current transaction permanent
+	Rollback                             // Discard the changes of the current transaction
+)
+
+// A TransactionQuery is a BEGIN, COMMIT or ROLLBACK statement.
+type TransactionQuery struct {
+	Statement TransactionStatement
+}
+
+// A CreateTableQuery creates a table. Its primary key is its first field.
+type CreateTableQuery struct {
+	Table schema.Table
+}
+
+// A CreateIndexQuery creates a secondary index of a table's records.
+type CreateIndexQuery struct {
+	Table string
+	Index schema.Index
+}
+
+// A DropTableQuery deletes a table and all of its records.
+type DropTableQuery struct {
+	Table string
+}
+
+// An AlterationType is a kind of change to the fields of a table.
+type AlterationType int
+
+const (
+	AddColumn    AlterationType = iota // Add a field, which records written before have as NULL, or as its type's zero value if it is NOT NULL
+	DropColumn                         // Remove a field, which must not be the primary key
+	RenameColumn                       // Change the name of a field
+)
+
+// An Alteration is a change to the fields of a table.
+type Alteration struct {
+	Type    AlterationType
+	Field   schema.Field // Field added, dropped or renamed (by its old name)
+	NewName string       // New name of a renamed field
+}
+
+// An AlterTableQuery changes the fields of a table. Its records are not
+// rewritten, but migrated as they are read.
+type AlterTableQuery struct {
+	Table      string
+	Alteration Alteration
+}
+
+// An ExplainQuery describes how a SELECT or compound query would be executed.
+// If Analyze is true, the query is also executed, to report what each step of
+// its execution did.
+type ExplainQuery struct {
+	Query   Query
+	Analyze bool
+}
+
+// An AnalyzeQuery collects the statistics of a table, or of every table if
+// Table is "", by which the database plans queries.
+type AnalyzeQuery struct {
+	Table string
+}
+
+// A SetOperation combines the results of two queries.
+type SetOperation int
+
+const (
+	Union        SetOperation = iota // Distinct records in either result
+	UnionAll                         // All records in either result, keeping duplicates
+	Intersection                     // Distinct records in both results
+	Difference                       // Distinct records in the left result but not the right
+)
+
+// A CompoundQuery applies a set operation to the results of two queries, each
+// either a SelectQuery or a CompoundQuery. The queries must select the same
+// number of fields, with matching types. Fields are matched by position, and
+// results use the field names of the left query.
 type CompoundQuery struct {
-	query1    SelectQuery
-	operation parser.Nonterminal
-	query2    Query
+	Left      Query
+	Operation SetOperation
+	Right     Query
+	OrderBy   []SortKey // Sorts the result, by the field names of the left query
+
+	// Bound the records of the result, as for a SelectQuery
+	Limit  Val
+	Offset Val
 }
 
 type SelectQuery struct {
 	Keys    []string // keys == nil => select * (universal set of keys)
 	Table   string
-	Filters []Filter
+	Joins   []Join // If there are joins, all keys are qualified (as in user.id)
+	Where   WhereClause
+	OrderBy []SortKey // Records are sorted by the first key, then the second, and so on
+	AsOf    *AsOf     // Past state of the database to read, or nil to read the current state
+
+	// The records returned are those left after skipping Offset of them, up to
+	// Limit. Negative counts are treated as 0 for Offset and as no limit for
+	// Limit, as is NULL.
+	Limit  Val
+	Offset Val
+
+	// A query with aggregates, GROUP BY or HAVING returns a record for each
+	// group of the records satisfying Where, which has the group's values of
+	// the GROUP BY keys, and its aggregates. Keys, Having and OrderBy refer to
+	// these records.
+	GroupBy    []string
+	Aggregates []Aggregate // Including those used only by HAVING or ORDER BY
+	Having     WhereClause
+	Grouped    bool
+}
+
+// An AggregateFunction computes a value from the values of a field in a group
+// of records. NULL values are ignored.
+type AggregateFunction int
+
+const (
+	Count AggregateFunction = iota // Number of records (of COUNT(*)) or of values
+	Sum
+	Avg // Mean of the values, rounded towards zero
+	Min
+	Max
+)
+
+// An Aggregate is an aggregate function of a field, or of * for COUNT(*). The
+// aggregates of a group with no values are NULL, except COUNT, which is 0.
+type Aggregate struct {
+	Function AggregateFunction
+	Key      string          // Field aggregated, or "*"
+	Name     string          // Name of the aggregate's field in results, such as sum(price)
+	Type     schema.Datatype // Type of the aggregate's values, Int or String
+}
+
+// An AsOf identifies a past state of the database, either by the sequence
+// number of the last transaction committed before it, or by time.
+type AsOf struct {
+	Txid int
+	Time time.Time // If not zero, Txid is ignored
+}
+
+// A SortKey is a field by which the results of a query are ordered.
+type SortKey struct {
+	Key        string
+	Descending bool
+}
+
+// A JoinType determines which records are returned by a join.
+type JoinType int
+
+const (
+	InnerJoin JoinType = iota // Only pairs of records which satisfy the condition
+	LeftJoin                  // Also records on the left which match no record on the right
+	RightJoin                 // Also records on the right which match no record on the left
+	OuterJoin                 // Also records on either side which match no other record
+)
+
+// A Join combines the records already selected by a query with records of
+// another table. Left is a field of a table earlier in the query, and Right is
+// a field of the joined table.
+type Join struct {
+	Type       JoinType
+	Table      string
+	Left       string
+	Comparator Comparator
+	Right      string
 }
 
 type Val struct {
 	IsNum bool // true iff the value is an int (so false => value is a string)
 	Num   int
 	Str   string
+	Param int  // Number of the parameter whose value this is, or 0 for a literal
+	Null  bool // true iff the value is NULL, in which case the others are ignored
 }
 
 type InsertQuery struct {
@@ -41,10 +206,45 @@ type DeleteQuery struct {
 	Where WhereClause
 }
 
+// A Comparator is the relation tested by a Filter.
+type Comparator int
+
+const (
+	LessThan Comparator = iota
+	GreaterThan
+	EqualTo
+	IsNull    // The left operand is NULL (the right is ignored)
+	IsNotNull // The left operand is not NULL (the right is ignored)
+)
+
+// An Operand is one side of a Filter: either a field of the record being
+// tested or a literal value.
+type Operand struct {
+	Key string // Name of a field, or "" if the operand is the literal Val
+	Val Val
+}
+
+// A Filter is a single type-checked comparison, such as price > 100, or its
+// negation, such as NOT price > 100.
 type Filter struct {
-	// TODO: implement this
+	Left       Operand
+	Comparator Comparator
+	Right      Operand
+	Negated    bool
 }
 
+// A Truth is a value of SQL's three-valued logic, in which a comparison with
+// NULL is neither true nor false, but unknown.
+type Truth int
+
+const (
+	False Truth = iota
+	Unknown
+	True
+)
+
+// A WhereClause is a conjunction of filters. The zero value matches every
+// record.
 type WhereClause struct {
-	// TODO: implement this
+	Filters []Filter
 }
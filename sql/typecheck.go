@@ -1,265 +1,1340 @@
 package sql
 
 import (
-	"errors"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alexbostock/alder/schema"
 	"github.com/alexbostock/alder/sql/parser"
 )
 
 // Compile, given an SQL query as a string and a database schema, compiles the
-// query to a Query object, which can be executed.
-func Compile(s schema.Schema, query string) Query {
-	schemaMap := make(map[string]map[string]schema.Datatype) // table -> key -> type
+// query to a Query object, which can be executed. It returns a *SyntaxError if
+// the query cannot be parsed, a *SemanticError if it refers to tables or fields
+// which do not exist, and a *TypeError if its values have the wrong types.
+// Queries with placeholders must be compiled by Prepare, and Compile returns a
+// *BindError for them.
+func Compile(s schema.Schema, query string) (Query, error) {
+	st, err := Prepare(s, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return st.Bind(nil)
+}
+
+// check compiles a parse tree. The tables of the schema are described by both
+// s, by name, and tables, in which their fields are in order.
+func check(s map[string]map[string]schema.Datatype, tables schema.Schema, query *parser.Node) (Query, error) {
+	switch query.T {
+	case parser.SelectFrom:
+		return checkSelect(s, query)
+	case parser.InsertInto:
+		return checkInsert(s, query)
+	case parser.UpdateSet:
+		return checkUpdate(s, query)
+	case parser.DeleteFrom:
+		return checkDelete(s, query)
+	case parser.BeginTransaction:
+		return &TransactionQuery{Begin}, nil
+	case parser.CommitTransaction:
+		return &TransactionQuery{Commit}, nil
+	case parser.RollbackTransaction:
+		return &TransactionQuery{Rollback}, nil
+	case parser.CreateTable:
+		return checkCreateTable(s, query)
+	case parser.CreateIndex:
+		return checkCreateIndex(s, query)
+	case parser.DropTable:
+		table, err := checkTable(s, query.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return &DropTableQuery{table}, nil
+	case parser.AlterTable:
+		return checkAlterTable(s, query)
+	case parser.Explain, parser.ExplainAnalyze:
+		q, err := check(s, tables, query.Args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		switch q.(type) {
+		case *SelectQuery, *CompoundQuery:
+			return &ExplainQuery{q, query.T == parser.ExplainAnalyze}, nil
+		default:
+			return nil, &SemanticError{query.Args[0].Pos, "", "only SELECT queries can be explained"}
+		}
+	case parser.AnalyzeTables:
+		if len(query.Args) == 0 {
+			return &AnalyzeQuery{}, nil
+		}
+		table, err := checkTable(s, query.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return &AnalyzeQuery{table}, nil
+	case parser.UnionOf, parser.UnionAllOf, parser.IntersectionOf, parser.DifferenceOf:
+		for _, operand := range query.Args[:2] {
+			if err := checkSetOperand(operand); err != nil {
+				return nil, err
+			}
+		}
+
+		left, err := check(s, tables, query.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		right, err := check(s, tables, query.Args[1])
+		if err != nil {
+			return nil, err
+		}
 
-	for _, tab := range s.Tables {
-		schemaMap[tab.Name] = make(map[string]schema.Datatype)
+		cq := &CompoundQuery{
+			Left:      left,
+			Operation: setOperations[query.T],
+			Right:     right,
+			Limit:     Val{Null: true},
+			Offset:    Val{Null: true},
+		}
 
-		for _, field := range tab.Fields {
-			schemaMap[tab.Name][field.Name] = field.Type
+		if err := checkCompoundTypes(s, tables, cq, query.Pos); err != nil {
+			return nil, err
 		}
+		if len(query.Args) > 2 {
+			if cq.OrderBy, err = checkCompoundOrderBy(tables, cq, query.Args[2]); err != nil {
+				return nil, err
+			}
+			if cq.Limit, err = checkLimit(query.Args[2], parser.Limit, "LIMIT"); err != nil {
+				return nil, err
+			}
+			if cq.Offset, err = checkLimit(query.Args[2], parser.Offset, "OFFSET"); err != nil {
+				return nil, err
+			}
+		}
+
+		return cq, nil
+	default:
+		return nil, invalidTree(query)
 	}
+}
 
-	parser := parser.New(query)
+// invalidTree returns the error for a parse tree which the parser should never
+// have produced.
+func invalidTree(n *parser.Node) error {
+	return &SemanticError{n.Pos, "", "invalid parse tree"}
+}
 
-	q := check(schemaMap, parser.Parse())
-	return q
+var setOperations = map[parser.Nonterminal]SetOperation{
+	parser.UnionOf:        Union,
+	parser.UnionAllOf:     UnionAll,
+	parser.IntersectionOf: Intersection,
+	parser.DifferenceOf:   Difference,
 }
 
-func check(s map[string]map[string]schema.Datatype, query *parser.Node) Query {
-	switch query.T {
-	case parser.SelectFrom:
-		sq := &SelectQuery{
-			Keys:    checkKeyList(s, query.Args[0]),
-			Table:   checkTable(s, query.Args[1]),
-			Filters: checkFilters(s, query.Args[2]),
+func checkSelect(s map[string]map[string]schema.Datatype, query *parser.Node) (Query, error) {
+	table, err := checkTable(s, query.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	joins, err := checkJoins(s, table, query.Args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	sc := scope{table}
+	for _, j := range joins {
+		sc = append(sc, j.Table)
+	}
+
+	g := &grouping{}
+	keys, err := checkFields(s, sc, query.Args[0], g)
+	if err != nil {
+		return nil, err
+	}
+	where, err := checkWhereClause(s, sc, query.Args[2])
+	if err != nil {
+		return nil, err
+	}
+	groupBy, err := checkGroupBy(s, sc, query.Args[2])
+	if err != nil {
+		return nil, err
+	}
+	having, hasHaving, err := checkHaving(s, sc, query.Args[2], g)
+	if err != nil {
+		return nil, err
+	}
+	orderBy, err := checkOrderBy(s, sc, query.Args[2], g)
+	if err != nil {
+		return nil, err
+	}
+	asOf, err := checkAsOf(query.Args[2])
+	if err != nil {
+		return nil, err
+	}
+	limit, err := checkLimit(query.Args[2], parser.Limit, "LIMIT")
+	if err != nil {
+		return nil, err
+	}
+	offset, err := checkLimit(query.Args[2], parser.Offset, "OFFSET")
+	if err != nil {
+		return nil, err
+	}
+
+	grouped := groupBy != nil || hasHaving || len(g.aggregates) > 0
+	if grouped {
+		if err := g.check(groupBy); err != nil {
+			return nil, err
 		}
+	}
 
-		err := checkSelectTypes(s, sq)
-		if err != nil {
-			panic(err)
+	return &SelectQuery{
+		Keys:       keys,
+		Table:      table,
+		Joins:      joins,
+		Where:      where,
+		OrderBy:    orderBy,
+		AsOf:       asOf,
+		Limit:      limit,
+		Offset:     offset,
+		GroupBy:    groupBy,
+		Aggregates: g.aggregates,
+		Having:     having,
+		Grouped:    grouped,
+	}, nil
+}
+
+func checkInsert(s map[string]map[string]schema.Datatype, query *parser.Node) (Query, error) {
+	table, err := checkTable(s, query.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	keys, err := checkInsertKeys(s, table, query.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	values, err := checkValuesList(s, table, keys, query.Args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	return &InsertQuery{
+		Keys:   keys,
+		Values: values,
+		Table:  table,
+	}, nil
+}
+
+func checkUpdate(s map[string]map[string]schema.Datatype, query *parser.Node) (Query, error) {
+	table, err := checkTable(s, query.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOnlyWhere(query.Args[2], "UPDATE"); err != nil {
+		return nil, err
+	}
+	values, err := checkAssignments(s, table, query.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	where, err := checkWhereClause(s, scope{table}, query.Args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	return &UpdateQuery{
+		Values: values,
+		Table:  table,
+		Where:  where,
+	}, nil
+}
+
+func checkDelete(s map[string]map[string]schema.Datatype, query *parser.Node) (Query, error) {
+	table, err := checkTable(s, query.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOnlyWhere(query.Args[1], "DELETE"); err != nil {
+		return nil, err
+	}
+	where, err := checkWhereClause(s, scope{table}, query.Args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeleteQuery{
+		Table: table,
+		Where: where,
+	}, nil
+}
+
+// checkCreateTable compiles a CREATE TABLE query, which must name a new table,
+// with distinct fields of which exactly one is the primary key. The primary key
+// is moved to the start of the fields, as in schemas read from files.
+func checkCreateTable(s map[string]map[string]schema.Datatype, query *parser.Node) (Query, error) {
+	t := query.Args[0]
+	if _, ok := s[t.Val]; ok {
+		return nil, &SemanticError{t.Pos, t.Val, "table already exists"}
+	}
+
+	table := schema.Table{Name: t.Val}
+	seen := make(map[string]bool)
+	primaryKeys := 0
+
+	for _, def := range query.Args[1].Args {
+		name, typeName := def.Args[0], def.Args[1]
+		if seen[name.Val] {
+			return nil, &SemanticError{name.Pos, name.Val, "field is defined more than once"}
 		}
+		seen[name.Val] = true
 
-		return sq
-	case parser.InsertInto:
-		is := &InsertQuery{
-			Keys:   checkKeyList(s, query.Args[0]),
-			Values: checkValuesList(s, query.Args[2]),
-			Table:  checkTable(s, query.Args[1]),
+		if typeName.T == parser.PrimaryKeyType {
+			if primaryKeys++; primaryKeys > 1 {
+				return nil, &SemanticError{typeName.Pos, name.Val, "table has more than one primary key"}
+			}
+			table.Fields = append([]schema.Field{{Name: name.Val, Type: schema.PrimaryKey}}, table.Fields...)
+			continue
+		}
+
+		datatype, ok := schema.ParseDatatype(typeName.Val)
+		if !ok {
+			return nil, &TypeError{typeName.Pos, name.Val, "unknown type " + typeName.Val}
 		}
+		notNull := len(def.Args) > 2 && def.Args[2].T == parser.NotNull
+		table.Fields = append(table.Fields, schema.Field{Name: name.Val, Type: datatype, NotNull: notNull})
+	}
+
+	if primaryKeys == 0 {
+		return nil, &SemanticError{t.Pos, t.Val, "table has no primary key"}
+	}
+
+	return &CreateTableQuery{table}, nil
+}
+
+// checkCreateIndex compiles a CREATE INDEX query, which must index distinct
+// fields of the table other than its primary key. Prepare checks that the name
+// of the index is new.
+func checkCreateIndex(s map[string]map[string]schema.Datatype, query *parser.Node) (Query, error) {
+	table, err := checkTable(s, query.Args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	index := schema.Index{Name: query.Args[0].Val}
+	seen := make(map[string]bool)
+
+	for _, field := range query.Args[2].Args {
+		datatype, ok := s[table][field.Val]
+		switch {
+		case !ok:
+			return nil, &SemanticError{field.Pos, field.Val, "unknown field"}
+		case datatype == schema.PrimaryKey:
+			return nil, &SemanticError{field.Pos, field.Val, "primary key cannot be indexed"}
+		case seen[field.Val]:
+			return nil, &SemanticError{field.Pos, field.Val, "field is indexed more than once"}
+		}
+
+		seen[field.Val] = true
+		index.Fields = append(index.Fields, field.Val)
+	}
+
+	return &CreateIndexQuery{table, index}, nil
+}
+
+// checkAlterTable compiles an ALTER TABLE query. A field may be added with a
+// new name, and an existing field may be renamed to a new name. The primary key
+// cannot be dropped, and no field may be added as a primary key.
+func checkAlterTable(s map[string]map[string]schema.Datatype, query *parser.Node) (Query, error) {
+	table, err := checkTable(s, query.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	fields := s[table]
+
+	action := query.Args[1]
+	field := action.Args[0]
+	if field.T == parser.FieldDef {
+		field = field.Args[0]
+	}
 
-		err := checkInsertTypes(s, is)
+	datatype, exists := fields[field.Val]
+	if action.T == parser.AddColumn && exists {
+		return nil, &SemanticError{field.Pos, field.Val, "field already exists"}
+	} else if action.T != parser.AddColumn && !exists {
+		return nil, &SemanticError{field.Pos, field.Val, "unknown field"}
+	}
+
+	a := Alteration{Field: schema.Field{Name: field.Val, Type: datatype}}
+
+	switch action.T {
+	case parser.AddColumn:
+		a.Type = AddColumn
+		typeName := action.Args[0].Args[1]
+		if typeName.T == parser.PrimaryKeyType {
+			return nil, &SemanticError{typeName.Pos, field.Val, "table already has a primary key"}
+		}
+		if a.Field.Type, exists = schema.ParseDatatype(typeName.Val); !exists {
+			return nil, &TypeError{typeName.Pos, field.Val, "unknown type " + typeName.Val}
+		}
+		a.Field.NotNull = len(action.Args[0].Args) > 2
+	case parser.DropColumn:
+		a.Type = DropColumn
+		if datatype == schema.PrimaryKey {
+			return nil, &SemanticError{field.Pos, field.Val, "cannot drop the primary key"}
+		}
+	case parser.RenameColumn:
+		a.Type = RenameColumn
+		newName := action.Args[1]
+		if _, ok := fields[newName.Val]; ok {
+			return nil, &SemanticError{newName.Pos, newName.Val, "field already exists"}
+		}
+		a.NewName = newName.Val
+	}
+
+	return &AlterTableQuery{table, a}, nil
+}
+
+// checkOnlyWhere checks that a list of filters has no joins, GROUP BY, HAVING,
+// ORDER BY, LIMIT, OFFSET or AS OF clauses, which only SELECT queries may have.
+func checkOnlyWhere(filters *parser.Node, kind string) error {
+	for _, f := range filters.Args {
+		if _, ok := joinTypes[f.T]; ok {
+			return &SemanticError{f.Pos, "", "JOIN cannot be used in " + kind + " queries"}
+		}
+		if f.T == parser.GroupBy {
+			return &SemanticError{f.Pos, "", "GROUP BY cannot be used in " + kind + " queries"}
+		}
+		if f.T == parser.Having {
+			return &SemanticError{f.Pos, "", "HAVING cannot be used in " + kind + " queries"}
+		}
+		if f.T == parser.OrderBy {
+			return &SemanticError{f.Pos, "", "ORDER BY cannot be used in " + kind + " queries"}
+		}
+		if f.T == parser.Limit || f.T == parser.Offset {
+			return &SemanticError{f.Pos, "", "LIMIT and OFFSET cannot be used in " + kind + " queries"}
+		}
+		if f.T == parser.AsOf {
+			return &SemanticError{f.Pos, "", "AS OF cannot be used in " + kind + " queries"}
+		}
+	}
+
+	return nil
+}
+
+// checkAsOf compiles the AS OF clause in a list of filters, if there is one.
+// Times are given in RFC 3339 format.
+func checkAsOf(filters *parser.Node) (*AsOf, error) {
+	var asOf *AsOf
+
+	for _, f := range filters.Args {
+		if f.T != parser.AsOf {
+			continue
+		}
+		if asOf != nil {
+			return nil, &SemanticError{f.Pos, "", "query has more than one AS OF clause"}
+		}
+
+		v, err := checkValue(f.Args[0])
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
-		return is
-	case parser.UpdateSet:
-		us := &UpdateQuery{
-			Values: checkAssignments(query.Args[1]),
-			Table:  checkTable(s, query.Args[0]),
-			Where:  checkWhereClause(s, query.Args[2]),
+		if v.IsNum {
+			asOf = &AsOf{Txid: v.Num}
+			continue
 		}
 
-		err := checkUpdateTypes(s, us)
+		// The lexer lowercases the query, but times must have an upper case T
+		t, err := time.Parse(time.RFC3339Nano, strings.ToUpper(v.Str))
 		if err != nil {
-			panic(err)
+			return nil, &TypeError{f.Args[0].Pos, "", "invalid time " + v.Str}
 		}
+		asOf = &AsOf{Time: t}
+	}
 
-		return us
-	case parser.DeleteFrom:
-		ds := &DeleteQuery{
-			Table: checkTable(s, query.Args[0]),
-			Where: checkWhereClause(s, query.Args[1].Args[0]),
-		}
-
-		// TODO: type-check where clause of ds
-
-		return ds
-	case parser.UnionOf:
-		fallthrough
-	case parser.IntersectionOf:
-		fallthrough
-	case parser.DifferenceOf:
-		return &CompoundQuery{
-			query1:    check(s, query.Args[0]).(SelectQuery),
-			operation: query.T,
-			query2:    check(s, query.Args[1]),
-		}
-	case parser.LiteralList, parser.Key, parser.Keys, parser.Literals,
-		parser.ValueList, parser.Assignment, parser.AssignmentList,
-		parser.Filters, parser.WhereExpr, parser.InnerJoin,
-		parser.OuterJoin, parser.LeftJoin, parser.RightJoin,
-		parser.OrderBy, parser.Literal, parser.Table:
-		panic(errors.New("Invalid parse tree"))
-	default:
-		panic(errors.New("Semantic error: unexpected node type"))
+	return asOf, nil
+}
+
+// checkLimit compiles the LIMIT or OFFSET clause in a list of filters, whose
+// nonterminal and keyword are given. Its count is an int or a parameter, which
+// is NULL if there is no clause.
+func checkLimit(filters *parser.Node, t parser.Nonterminal, keyword string) (Val, error) {
+	count := Val{Null: true}
+	found := false
+
+	for _, f := range filters.Args {
+		if f.T != t {
+			continue
+		}
+		if found {
+			return Val{}, &SemanticError{f.Pos, "", "query has more than one " + keyword + " clause"}
+		}
+		found = true
+
+		v := f.Args[0]
+		if v.T == parser.Placeholder {
+			count = checkParam(v, schema.Int)
+			continue
+		}
+
+		var err error
+		if count, err = checkValue(v); err != nil {
+			return Val{}, err
+		}
 	}
 
-	return SelectQuery{}
+	return count, nil
 }
 
-func checkKeyList(s map[string]map[string]schema.Datatype, kl *parser.Node) []string {
+// keyNodes returns the Key nodes of a key list, or of a parenthesised key list.
+func keyNodes(kl *parser.Node) ([]*parser.Node, error) {
 	if kl.T == parser.Keys {
 		if len(kl.Args) != 1 {
-			panic(errors.New("Invalid parse tree"))
+			return nil, invalidTree(kl)
 		}
 
 		kl = kl.Args[0]
 	}
 
 	if kl.T != parser.KeyList {
-		panic(errors.New("Error: unexpected node type"))
+		return nil, invalidTree(kl)
 	}
 
-	ks := make([]string, 0, len(kl.Args))
-
 	for _, k := range kl.Args {
 		if k.T != parser.Key {
-			panic(errors.New("Error: unexpected node type"))
+			return nil, invalidTree(k)
 		}
+	}
 
-		validKey := false
-		for _, tab := range s {
-			if k.Val == "*" {
-				return ks // * means all keys, represented by nil
+	return kl.Args, nil
+}
+
+// A scope is the list of tables whose fields a query may refer to. Queries on
+// a single table refer to fields by name, but queries with joins refer to all
+// fields by qualified name (as in user.id).
+type scope []string
+
+// resolve returns the name by which a query refers to a field, and the field's
+// type. The given key may be qualified with a table name, and must be if more
+// than one table in scope has a field of that name. pos is the position of the
+// key in the query, for error reporting.
+func (sc scope) resolve(s map[string]map[string]schema.Datatype, key string, pos int) (string, schema.Datatype, error) {
+	var table, field string
+
+	if i := strings.Index(key, "."); i >= 0 {
+		table, field = key[:i], key[i+1:]
+
+		inScope := false
+		for _, t := range sc {
+			inScope = inScope || t == table
+		}
+		if !inScope {
+			return "", 0, &SemanticError{pos, key, "table " + table + " is not in scope"}
+		}
+		if _, ok := s[table][field]; !ok {
+			return "", 0, &SemanticError{pos, key, "unknown field"}
+		}
+	} else {
+		field = key
+		for _, t := range sc {
+			if _, ok := s[t][field]; ok {
+				if table != "" {
+					return "", 0, &SemanticError{pos, key, "ambiguous field"}
+				}
+				table = t
 			}
-			if _, ok := tab[k.Val]; ok {
-				ks = append(ks, k.Val)
-				validKey = true
-				break
+		}
+		if table == "" {
+			return "", 0, &SemanticError{pos, key, "unknown field"}
+		}
+	}
+
+	if len(sc) == 1 {
+		return field, s[table][field], nil
+	}
+	return table + "." + field, s[table][field], nil
+}
+
+// checkFields compiles the select list of a SELECT query, of keys and
+// aggregates, which are recorded in g. * means all keys, which is represented
+// by nil.
+func checkFields(s map[string]map[string]schema.Datatype, sc scope, sl *parser.Node, g *grouping) ([]string, error) {
+	if sl.T != parser.SelectList {
+		return nil, invalidTree(sl)
+	}
+
+	fields := make([]string, len(sl.Args))
+	for i, k := range sl.Args {
+		if k.T == parser.Aggregate {
+			a, err := g.aggregate(s, sc, k)
+			if err != nil {
+				return nil, err
 			}
+			fields[i] = a.Name
+			continue
 		}
-		if !validKey {
-			panic(errors.New("Invalid key " + k.Val))
+
+		if k.Val == "*" {
+			g.star = k
+			return nil, nil
 		}
+
+		var err error
+		fields[i], _, err = sc.resolve(s, k.Val, k.Pos)
+		if err != nil {
+			return nil, err
+		}
+		g.use(fields[i], k)
 	}
 
-	return ks
+	return fields, nil
 }
 
-func checkTable(s map[string]map[string]schema.Datatype, t *parser.Node) string {
-	if t.T != parser.Table {
-		panic(errors.New("Error: unexpected node type"))
+// A grouping collects the aggregates of a SELECT query, and the keys used
+// outside aggregates by its select list, HAVING and ORDER BY clauses, which
+// must be GROUP BY keys if the query is grouped.
+type grouping struct {
+	aggregates []Aggregate
+	keys       []string       // Resolved keys used
+	nodes      []*parser.Node // Node of each key used, for error reporting
+	star       *parser.Node   // Node of SELECT *, or nil
+}
+
+var aggregateFunctions = map[string]AggregateFunction{
+	"count": Count,
+	"sum":   Sum,
+	"avg":   Avg,
+	"min":   Min,
+	"max":   Max,
+}
+
+// aggregate compiles an aggregate function of a key or *. SUM and AVG can only
+// be applied to ints, and only COUNT to *. The same aggregate used more than
+// once is computed once.
+func (g *grouping) aggregate(s map[string]map[string]schema.Datatype, sc scope, n *parser.Node) (Aggregate, error) {
+	f, ok := aggregateFunctions[n.Val]
+	if !ok {
+		return Aggregate{}, &SemanticError{n.Pos, n.Val, "unknown aggregate function"}
 	}
 
-	if _, ok := s[t.Val]; ok {
-		return t.Val
+	a := Aggregate{Function: f, Key: "*", Type: schema.Int}
+	arg := n.Args[0]
+	if arg.Val == "*" {
+		if f != Count {
+			return Aggregate{}, &SemanticError{arg.Pos, "", "only COUNT can be applied to *"}
+		}
 	} else {
-		// TODO: invalid query should not result in panic
-		panic(errors.New("Invalid table name"))
+		key, t, err := sc.resolve(s, arg.Val, arg.Pos)
+		if err != nil {
+			return Aggregate{}, err
+		}
+		a.Key = key
+
+		switch {
+		case (f == Sum || f == Avg) && comparableType(t) != schema.Int:
+			return Aggregate{}, &TypeError{arg.Pos, key, "cannot apply " + strings.ToUpper(n.Val) + " to string"}
+		case f == Min || f == Max:
+			a.Type = comparableType(t)
+		}
+	}
+	a.Name = n.Val + "(" + a.Key + ")"
+
+	for _, b := range g.aggregates {
+		if b.Name == a.Name {
+			return b, nil
+		}
 	}
+	g.aggregates = append(g.aggregates, a)
+
+	return a, nil
+}
+
+// use records that a query uses a key outside an aggregate.
+func (g *grouping) use(key string, n *parser.Node) {
+	g.keys = append(g.keys, key)
+	g.nodes = append(g.nodes, n)
 }
 
-func checkFilters(s map[string]map[string]schema.Datatype, filters *parser.Node) []Filter {
-	// TODO
+// check returns a *SemanticError if a grouped query selects *, or uses a key
+// which is not one of the GROUP BY keys outside an aggregate.
+func (g *grouping) check(groupBy []string) error {
+	if g.star != nil {
+		return &SemanticError{g.star.Pos, "", "SELECT * cannot be used with GROUP BY or aggregates"}
+	}
+
+	for i, key := range g.keys {
+		found := false
+		for _, k := range groupBy {
+			found = found || k == key
+		}
+		if !found {
+			return &SemanticError{g.nodes[i].Pos, g.nodes[i].Val, "field must be in GROUP BY or aggregated"}
+		}
+	}
+
 	return nil
 }
 
-func checkValuesList(s map[string]map[string]schema.Datatype, valuesList *parser.Node) [][]Val {
+// checkGroupBy compiles the GROUP BY clause in a list of filters, if any, into
+// a list of distinct keys.
+func checkGroupBy(s map[string]map[string]schema.Datatype, sc scope, filters *parser.Node) ([]string, error) {
+	var keys []string
+
+	for _, f := range filters.Args {
+		if f.T != parser.GroupBy {
+			continue
+		}
+		if keys != nil {
+			return nil, &SemanticError{f.Pos, "", "query has more than one GROUP BY clause"}
+		}
+
+		for _, k := range f.Args {
+			if k.Val == "*" {
+				return nil, &SemanticError{k.Pos, "", "cannot GROUP BY *"}
+			}
+
+			key, _, err := sc.resolve(s, k.Val, k.Pos)
+			if err != nil {
+				return nil, err
+			}
+			for _, other := range keys {
+				if other == key {
+					return nil, &SemanticError{k.Pos, k.Val, "field is grouped by more than once"}
+				}
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// checkHaving compiles the HAVING clause in a list of filters, whose operands
+// are aggregates or keys, and returns true if there is one.
+func checkHaving(s map[string]map[string]schema.Datatype, sc scope, filters *parser.Node, g *grouping) (WhereClause, bool, error) {
+	var having WhereClause
+	found := false
+
+	for _, f := range filters.Args {
+		if f.T != parser.Having {
+			continue
+		}
+		if found {
+			return WhereClause{}, false, &SemanticError{f.Pos, "", "query has more than one HAVING clause"}
+		}
+		found = true
+
+		for _, cond := range f.Args {
+			filter, err := checkFilter(s, sc, cond, g)
+			if err != nil {
+				return WhereClause{}, false, err
+			}
+			having.Filters = append(having.Filters, filter)
+		}
+	}
+
+	return having, found, nil
+}
+
+// checkInsertKeys compiles the key list of an INSERT query, which must name
+// distinct fields of the table other than its primary key.
+func checkInsertKeys(s map[string]map[string]schema.Datatype, table string, kl *parser.Node) ([]string, error) {
+	keys, err := keyNodes(kl)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]string, len(keys))
+	seen := make(map[string]bool)
+	for i, k := range keys {
+		if k.Val == "*" {
+			return nil, &SemanticError{k.Pos, "", "INSERT must list the keys to insert"}
+		}
+
+		field, t, err := scope{table}.resolve(s, k.Val, k.Pos)
+		if err != nil {
+			return nil, err
+		}
+		if t == schema.PrimaryKey {
+			return nil, &SemanticError{k.Pos, k.Val, "primary key values cannot be inserted directly"}
+		}
+		if seen[field] {
+			return nil, &SemanticError{k.Pos, k.Val, "field is listed more than once"}
+		}
+
+		seen[field] = true
+		fields[i] = field
+	}
+
+	return fields, nil
+}
+
+var joinTypes = map[parser.Nonterminal]JoinType{
+	parser.InnerJoin: InnerJoin,
+	parser.LeftJoin:  LeftJoin,
+	parser.RightJoin: RightJoin,
+	parser.OuterJoin: OuterJoin,
+}
+
+// checkJoins compiles the joins in a list of filters. Each join condition must
+// compare a field of the joined table with a field of a table already in
+// scope, of the same type.
+func checkJoins(s map[string]map[string]schema.Datatype, table string, filters *parser.Node) ([]Join, error) {
+	var joins []Join
+	sc := scope{table}
+
+	for _, f := range filters.Args {
+		t, ok := joinTypes[f.T]
+		if !ok {
+			continue
+		}
+
+		joined, err := checkTable(s, f.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		c, err := checkComparator(f.Args[2])
+		if err != nil {
+			return nil, err
+		}
+
+		j := Join{
+			Type:       t,
+			Table:      joined,
+			Comparator: c,
+		}
+
+		for _, t := range sc {
+			if t == j.Table {
+				return nil, &SemanticError{f.Args[0].Pos, t, "table cannot be joined to itself"}
+			}
+		}
+
+		prev := sc
+		sc = append(sc, j.Table)
+
+		a, aType, err := sc.resolve(s, f.Args[1].Val, f.Args[1].Pos)
+		if err != nil {
+			return nil, err
+		}
+		b, bType, err := sc.resolve(s, f.Args[3].Val, f.Args[3].Pos)
+		if err != nil {
+			return nil, err
+		}
+
+		// Rewrite the condition so that the field of the joined table is on the right
+		aJoined := strings.HasPrefix(a, j.Table+".")
+		bJoined := strings.HasPrefix(b, j.Table+".")
+		switch {
+		case bJoined && !aJoined:
+			j.Left, j.Right = a, b
+		case aJoined && !bJoined:
+			j.Left, j.Right = b, a
+			j.Comparator = j.Comparator.Flip()
+		default:
+			return nil, &SemanticError{f.Args[1].Pos, "", "JOIN condition must compare a field of " + j.Table + " with a field of " + strings.Join(prev, ", ")}
+		}
+
+		if comparableType(aType) != comparableType(bType) {
+			return nil, &TypeError{f.Args[2].Pos, "", "cannot join on fields of different types"}
+		}
+
+		joins = append(joins, j)
+	}
+
+	return joins, nil
+}
+
+// checkOrderBy compiles the ORDER BY clause in a list of filters, if any. Its
+// keys and aggregates are recorded in g.
+func checkOrderBy(s map[string]map[string]schema.Datatype, sc scope, filters *parser.Node, g *grouping) ([]SortKey, error) {
+	var keys []SortKey
+
+	for _, f := range filters.Args {
+		if f.T != parser.OrderBy {
+			continue
+		}
+		if keys != nil {
+			return nil, &SemanticError{f.Pos, "", "query has more than one ORDER BY clause"}
+		}
+
+		keys = make([]SortKey, len(f.Args))
+		for i, k := range f.Args {
+			key := k.Args[0]
+			if key.T == parser.Aggregate {
+				a, err := g.aggregate(s, sc, key)
+				if err != nil {
+					return nil, err
+				}
+				keys[i].Key = a.Name
+			} else if key.Val == "*" {
+				return nil, &SemanticError{key.Pos, "", "cannot ORDER BY *"}
+			} else {
+				var err error
+				keys[i].Key, _, err = sc.resolve(s, key.Val, key.Pos)
+				if err != nil {
+					return nil, err
+				}
+				g.use(keys[i].Key, key)
+			}
+			keys[i].Descending = k.Args[1].T == parser.Descending
+		}
+	}
+
+	return keys, nil
+}
+
+func checkComparator(c *parser.Node) (Comparator, error) {
+	switch c.T {
+	case parser.Smaller:
+		return LessThan, nil
+	case parser.Larger:
+		return GreaterThan, nil
+	case parser.Equals:
+		return EqualTo, nil
+	default:
+		return 0, invalidTree(c)
+	}
+}
+
+func checkTable(s map[string]map[string]schema.Datatype, t *parser.Node) (string, error) {
+	if t.T != parser.Table {
+		return "", invalidTree(t)
+	}
+
+	if _, ok := s[t.Val]; !ok {
+		return "", &SemanticError{t.Pos, t.Val, "unknown table"}
+	}
+
+	return t.Val, nil
+}
+
+// checkValuesList compiles the rows of values of an INSERT query. Each row must
+// have a value of the right type for each key.
+func checkValuesList(s map[string]map[string]schema.Datatype, table string, keys []string, valuesList *parser.Node) ([][]Val, error) {
 	valsList := make([][]Val, len(valuesList.Args))
 
-	for i, vs := range valuesList.Args[0].Args {
+	for i, literals := range valuesList.Args {
+		vs := literals.Args[0]
+		if len(vs.Args) != len(keys) {
+			return nil, &SemanticError{literals.Pos, "", "number of values does not match number of keys"}
+		}
+
 		valsList[i] = make([]Val, len(vs.Args))
 		for j, v := range vs.Args {
-			valsList[i][j] = checkValue(v)
+			val, err := checkAssignedValue(s[table][keys[j]], keys[j], v)
+			if err != nil {
+				return nil, err
+			}
+			valsList[i][j] = val
 		}
 	}
 
-	return valsList
+	return valsList, nil
 }
 
-func checkAssignments(assignments *parser.Node) map[string]Val {
+func checkAssignments(s map[string]map[string]schema.Datatype, table string, assignments *parser.Node) (map[string]Val, error) {
 	result := make(map[string]Val)
 
 	for _, assignment := range assignments.Args {
-		key := assignment.Args[0].Val
-		value := checkValue(assignment.Args[1])
+		k := assignment.Args[0]
+		if k.Val == "*" {
+			return nil, &SemanticError{k.Pos, "", "cannot assign to *"}
+		}
+
+		key, t, err := scope{table}.resolve(s, k.Val, k.Pos)
+		if err != nil {
+			return nil, err
+		}
+		if t == schema.PrimaryKey {
+			return nil, &SemanticError{k.Pos, k.Val, "primary key cannot be updated"}
+		}
+
+		value, err := checkAssignedValue(t, key, assignment.Args[1])
+		if err != nil {
+			return nil, err
+		}
 		result[key] = value
 	}
 
-	return result
+	return result, nil
+}
+
+// checkAssignedValue compiles a value which is to be stored in a field of type
+// t, which must be NULL, a literal of that type or a parameter. Whether the
+// field may be NULL is checked when the value is stored.
+func checkAssignedValue(t schema.Datatype, key string, v *parser.Node) (Val, error) {
+	if v.T == parser.Placeholder {
+		return checkParam(v, t), nil
+	}
+	if v.T != parser.Literal {
+		return Val{}, &SemanticError{v.Pos, v.Val, "expected a literal value"}
+	}
+
+	val, err := checkValue(v)
+	if err != nil {
+		return Val{}, err
+	}
+
+	switch {
+	case val.Null:
+	case t == schema.Int && !val.IsNum:
+		return Val{}, &TypeError{v.Pos, key, "expected int"}
+	case t == schema.String && val.IsNum:
+		return Val{}, &TypeError{v.Pos, key, "expected string"}
+	}
+
+	return val, nil
+}
+
+// checkWhereClause compiles the WHERE conditions in a list of filters into a
+// conjunction of type-checked comparisons on fields of tables in scope.
+func checkWhereClause(s map[string]map[string]schema.Datatype, sc scope, filters *parser.Node) (WhereClause, error) {
+	if filters.T != parser.Filters {
+		return WhereClause{}, invalidTree(filters)
+	}
+
+	where := WhereClause{}
+
+	for _, f := range filters.Args {
+		// Joins and ORDER BY are checked by checkJoins and checkOrderBy
+		if f.T != parser.WhereExpr && f.T != parser.Negation {
+			continue
+		}
+
+		filter, err := checkFilter(s, sc, f, nil)
+		if err != nil {
+			return WhereClause{}, err
+		}
+		where.Filters = append(where.Filters, filter)
+	}
+
+	return where, nil
+}
+
+// checkFilter compiles a comparison, in which the operands must have the same
+// type unless one is NULL, or a test of whether an operand IS NULL, or the
+// negation of either. Operands may be aggregates only in a HAVING clause, for
+// which g is not nil.
+func checkFilter(s map[string]map[string]schema.Datatype, sc scope, expr *parser.Node, g *grouping) (Filter, error) {
+	if expr.T == parser.Negation {
+		f, err := checkFilter(s, sc, expr.Args[0], g)
+		f.Negated = !f.Negated
+		return f, err
+	}
+	if len(expr.Args) == 2 {
+		return checkNullTest(s, sc, expr, g)
+	}
+
+	left, leftType, err := checkOperand(s, sc, expr.Args[0], g)
+	if err != nil {
+		return Filter{}, err
+	}
+	right, rightType, err := checkOperand(s, sc, expr.Args[2], g)
+	if err != nil {
+		return Filter{}, err
+	}
+	c, err := checkComparator(expr.Args[1])
+	if err != nil {
+		return Filter{}, err
+	}
+
+	// A parameter has the type of the operand with which it is compared
+	leftParam := expr.Args[0].T == parser.Placeholder
+	rightParam := expr.Args[2].T == parser.Placeholder
+	null := (expr.Args[0].T == parser.Literal && left.Val.Null) || (expr.Args[2].T == parser.Literal && right.Val.Null)
+	switch {
+	case leftParam && rightParam:
+		return Filter{}, &TypeError{expr.Args[1].Pos, "", "cannot compare two parameters"}
+	case null && (leftParam || rightParam):
+		return Filter{}, &TypeError{expr.Args[1].Pos, "", "cannot compare a parameter with NULL"}
+	case leftParam:
+		left.Val, leftType = checkParam(expr.Args[0], rightType), rightType
+	case rightParam:
+		right.Val, rightType = checkParam(expr.Args[2], leftType), leftType
+	}
+
+	if leftType != rightType && !null {
+		return Filter{}, &TypeError{expr.Args[1].Pos, "", "cannot compare int with string"}
+	}
+
+	return Filter{left, c, right, false}, nil
 }
 
-func checkWhereClause(s map[string]map[string]schema.Datatype, where *parser.Node) WhereClause {
-	// TODO
-	return WhereClause{}
+// checkNullTest compiles an IS NULL or IS NOT NULL test of a field or literal.
+// The type of a parameter could not be inferred, so it cannot be tested.
+func checkNullTest(s map[string]map[string]schema.Datatype, sc scope, expr *parser.Node, g *grouping) (Filter, error) {
+	if expr.Args[0].T == parser.Placeholder {
+		return Filter{}, &TypeError{expr.Args[1].Pos, "", "cannot test whether a parameter is NULL"}
+	}
+
+	operand, _, err := checkOperand(s, sc, expr.Args[0], g)
+	if err != nil {
+		return Filter{}, err
+	}
+
+	if expr.Args[1].T == parser.IsNotNull {
+		return Filter{Left: operand, Comparator: IsNotNull}, nil
+	}
+	return Filter{Left: operand, Comparator: IsNull}, nil
+}
+
+// checkOperand returns an operand and its type, which is Int or String (primary
+// keys are treated as ints). The type of a parameter depends on the other
+// operand, so is set by checkFilter.
+func checkOperand(s map[string]map[string]schema.Datatype, sc scope, o *parser.Node, g *grouping) (Operand, schema.Datatype, error) {
+	if o.T == parser.Placeholder {
+		return Operand{}, 0, nil
+	}
+	if o.T == parser.Aggregate {
+		if g == nil {
+			return Operand{}, 0, &SemanticError{o.Pos, o.Val, "aggregates can only be used in the select list, HAVING and ORDER BY"}
+		}
+
+		a, err := g.aggregate(s, sc, o)
+		if err != nil {
+			return Operand{}, 0, err
+		}
+		return Operand{Key: a.Name}, a.Type, nil
+	}
+	if o.T == parser.Key {
+		if o.Val == "*" {
+			return Operand{}, 0, &SemanticError{o.Pos, "", "cannot compare *"}
+		}
+
+		key, t, err := sc.resolve(s, o.Val, o.Pos)
+		if err != nil {
+			return Operand{}, 0, err
+		}
+		if g != nil {
+			g.use(key, o)
+		}
+		return Operand{Key: key}, comparableType(t), nil
+	}
+
+	v, err := checkValue(o)
+	if err != nil {
+		return Operand{}, 0, err
+	}
+	if v.IsNum {
+		return Operand{Val: v}, schema.Int, nil
+	}
+	return Operand{Val: v}, schema.String, nil
+}
+
+// comparableType returns the type with which values of type t may be compared.
+func comparableType(t schema.Datatype) schema.Datatype {
+	if t == schema.PrimaryKey {
+		return schema.Int
+	}
+	return t
 }
 
-func checkValue(v *parser.Node) Val {
+// checkParam compiles a placeholder for a parameter of type t, which is Int or
+// String.
+func checkParam(v *parser.Node, t schema.Datatype) Val {
+	n, _ := strconv.Atoi(v.Val)
+	return Val{comparableType(t) == schema.Int, 0, "", n, false}
+}
+
+func checkValue(v *parser.Node) (Val, error) {
 	v = v.Args[0]
-	if v.T == parser.StrVal {
-		return Val{false, 0, v.Val}
+	if v.T == parser.NullVal {
+		return Val{false, 0, "", 0, true}, nil
+	} else if v.T == parser.StrVal {
+		return Val{false, 0, v.Val, 0, false}, nil
 	} else {
 		i, err := strconv.Atoi(v.Val)
 		if err != nil {
-			panic(errors.New("Expected integer literal"))
+			return Val{}, &TypeError{v.Pos, "", "integer literal " + v.Val + " is out of range"}
 		}
 
-		return Val{true, i, ""}
+		return Val{true, i, "", 0, false}, nil
 	}
 }
 
-func checkSelectTypes(s map[string]map[string]schema.Datatype, sq *SelectQuery) error {
-	// TODO: better error messages
+// checkCompoundTypes checks that both sides of a set operation are queries
+// returning records with the same number of fields, with matching types.
+func checkCompoundTypes(s map[string]map[string]schema.Datatype, tables schema.Schema, cq *CompoundQuery, pos int) error {
+	left, err := resultTypes(s, tables, cq.Left, pos)
+	if err != nil {
+		return err
+	}
+	right, err := resultTypes(s, tables, cq.Right, pos)
+	if err != nil {
+		return err
+	}
 
-	// TODO: add support for joins
+	if len(left) != len(right) {
+		return &TypeError{pos, "", "set operation on queries with different numbers of fields"}
+	}
 
-	for _, key := range sq.Keys {
-		if _, ok := s[sq.Table][key]; !ok {
-			return errors.New("Invalid key")
+	for i := range left {
+		if left[i] != right[i] {
+			return &TypeError{pos, "", "set operation on queries with incompatible field types"}
 		}
 	}
 
-	// TODO: type-check filters
-
 	return nil
 }
 
-func checkInsertTypes(s map[string]map[string]schema.Datatype, iq *InsertQuery) error {
-	if iq.Keys == nil {
-		return errors.New("Insert query must not have no keys or *")
-	}
-	for _, key := range iq.Keys {
-		t, ok := s[iq.Table][key]
-		if !ok {
-			return errors.New("Invalid key")
+// resultTypes returns the types of the fields in each record returned by a
+// query, in order. Primary keys are treated as ints. SELECT * returns the
+// fields of each table in the order of the schema.
+func resultTypes(s map[string]map[string]schema.Datatype, tables schema.Schema, q Query, pos int) ([]schema.Datatype, error) {
+	switch query := q.(type) {
+	case *SelectQuery:
+		sc := scope{query.Table}
+		for _, j := range query.Joins {
+			sc = append(sc, j.Table)
 		}
 
-		for i, valList := range iq.Values {
-			switch t {
-			case schema.Int:
-				if !valList[i].IsNum {
-					return errors.New("Invalid type: expected int")
+		if len(query.Keys) == 0 {
+			var types []schema.Datatype
+			for _, table := range sc {
+				for _, field := range tables.GetTable(table).Fields {
+					types = append(types, comparableType(field.Type))
 				}
-			case schema.String:
-				if valList[i].IsNum {
-					return errors.New("Invalid type: expected string")
+			}
+			return types, nil
+		}
+
+		types := make([]schema.Datatype, len(query.Keys))
+	keys:
+		for i, key := range query.Keys {
+			for _, a := range query.Aggregates {
+				if a.Name == key {
+					types[i] = a.Type
+					continue keys
 				}
-			case schema.PrimaryKey:
-				return errors.New("Invalid type: primary key values cannot be inserted directly")
-			default:
-				return errors.New("Unexpected field type, insert failed")
 			}
+
+			_, t, err := sc.resolve(s, key, pos)
+			if err != nil {
+				return nil, err
+			}
+			types[i] = comparableType(t)
+		}
+		return types, nil
+	case *CompoundQuery:
+		return resultTypes(s, tables, query.Left, pos)
+	default:
+		return nil, &SemanticError{pos, "", "set operations can only be applied to SELECT queries"}
+	}
+}
+
+// checkSetOperand checks that a query combined by a set operation has no ORDER
+// BY, LIMIT or OFFSET clauses, which may only follow the last query, and then
+// apply to the result of the set operation.
+func checkSetOperand(q *parser.Node) error {
+	if q.T != parser.SelectFrom {
+		return nil
+	}
+
+	for _, f := range q.Args[2].Args {
+		if f.T == parser.OrderBy {
+			return &SemanticError{f.Pos, "", "ORDER BY must follow the last query of a set operation"}
+		}
+		if f.T == parser.Limit || f.T == parser.Offset {
+			return &SemanticError{f.Pos, "", "LIMIT and OFFSET must follow the last query of a set operation"}
 		}
 	}
 
 	return nil
 }
 
-func checkUpdateTypes(s map[string]map[string]schema.Datatype, uq *UpdateQuery) error {
-	for key, val := range uq.Values {
-		if s[uq.Table][key] == schema.Int && !val.IsNum {
-			return errors.New("Invalid type: expected int")
-		} else if s[uq.Table][key] == schema.String && val.IsNum {
-			return errors.New("Invalid type: expected string")
-		} else if s[uq.Table][key] == schema.PrimaryKey {
-			return errors.New("Primary key cannot be updated")
+// checkCompoundOrderBy compiles the ORDER BY clause of a set operation, if any.
+// Its keys are the fields of the result, named as in the left query. A field
+// of a query with joins may be named without its table if that is unambiguous,
+// and an aggregate is named by its function and key, as in count(id).
+func checkCompoundOrderBy(tables schema.Schema, cq *CompoundQuery, filters *parser.Node) ([]SortKey, error) {
+	names := resultNames(tables, cq)
+	var keys []SortKey
+
+	for _, f := range filters.Args {
+		if f.T != parser.OrderBy {
+			continue
+		}
+		if keys != nil {
+			return nil, &SemanticError{f.Pos, "", "query has more than one ORDER BY clause"}
+		}
+
+		keys = make([]SortKey, len(f.Args))
+		for i, k := range f.Args {
+			key := k.Args[0]
+			name := key.Val
+			if key.T == parser.Aggregate {
+				name = key.Val + "(" + key.Args[0].Val + ")"
+			} else if key.Val == "*" {
+				return nil, &SemanticError{key.Pos, "", "cannot ORDER BY *"}
+			}
+
+			var err error
+			if keys[i].Key, err = resolveResultField(names, name, key.Pos); err != nil {
+				return nil, err
+			}
+			keys[i].Descending = k.Args[1].T == parser.Descending
 		}
 	}
 
-	// TODO: type-check where clause
+	return keys, nil
+}
 
-	return nil
+// resolveResultField returns the name of the field of a result, which has
+// fields of the given names, to which a key refers, either by its name, or by
+// its name without its table.
+func resolveResultField(names []string, key string, pos int) (string, error) {
+	for _, name := range names {
+		if name == key {
+			return name, nil
+		}
+	}
+
+	field := ""
+	for _, name := range names {
+		if strings.HasSuffix(name, "."+key) {
+			if field != "" {
+				return "", &SemanticError{pos, key, "ambiguous field"}
+			}
+			field = name
+		}
+	}
+	if field == "" {
+		return "", &SemanticError{pos, key, "unknown field"}
+	}
+
+	return field, nil
+}
+
+// resultNames returns the names of the fields in each record returned by a
+// SELECT or compound query, in order, as resultTypes returns their types.
+func resultNames(tables schema.Schema, q Query) []string {
+	switch query := q.(type) {
+	case *SelectQuery:
+		if len(query.Keys) > 0 {
+			return query.Keys
+		}
+
+		sc := scope{query.Table}
+		for _, j := range query.Joins {
+			sc = append(sc, j.Table)
+		}
+
+		var names []string
+		for _, table := range sc {
+			for _, field := range tables.GetTable(table).Fields {
+				if len(sc) > 1 {
+					names = append(names, table+"."+field.Name)
+				} else {
+					names = append(names, field.Name)
+				}
+			}
+		}
+		return names
+	case *CompoundQuery:
+		return resultNames(tables, query.Left)
+	default:
+		return nil
+	}
 }
@@ -0,0 +1,332 @@
+package sql
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/alexbostock/alder/schema"
+)
+
+func testSchema(t *testing.T) schema.Schema {
+	schemaFile, err := ioutil.ReadFile("../test.yaml")
+	if err != nil {
+		t.Fatal("Failed to load schema")
+	}
+	s, err := schema.New(schemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestCompileErrors(t *testing.T) {
+	s := testSchema(t)
+
+	tests := []struct {
+		query string
+		kind  string
+		pos   int
+		ident string
+	}{
+		{"select * from user where", "syntax", 24, ""},
+		{"select * from users", "semantic", 14, "users"},
+		{"select name from user", "semantic", 7, "name"},
+		{"select id from user join order on user.id = order.user_id", "semantic", 7, "id"},
+		{"select * from user where order.id = 1", "semantic", 25, "order.id"},
+		{"update user set id = 3", "semantic", 16, "id"},
+		{"delete from user order by id", "semantic", 17, ""},
+		{"update user set forename = 'a' as of 3", "semantic", 31, ""},
+		{"select * from user as of 'yesterday'", "type", 25, ""},
+		{"insert into user (forename, forename) values ('a', 'b')", "semantic", 28, "forename"},
+		{"insert into user (forename, surname) values ('a')", "semantic", 44, ""},
+		{"insert into order (items, price) values ('apples', 'ten')", "type", 51, "price"},
+		{"update order set items = 5", "type", 25, "items"},
+		{"select * from user where forename > 3", "type", 34, ""},
+		{"select * from user join order on user.forename = order.price", "type", 47, ""},
+		{"select forename from user union select price from order", "type", 26, ""},
+		{"select * from user union select * from order", "type", 19, ""},
+		{"select forename from user order by forename union select surname from user", "semantic", 26, ""},
+		{"select forename from user union select surname from user order by surname", "semantic", 66, "surname"},
+		{"select forename from user limit 1 union select surname from user", "semantic", 26, ""},
+		{"select forename from user union select surname from user limit 1 offset 1 offset 2", "semantic", 74, ""},
+		{"select * from user join order on user.id = order.user_id union select * from user join order on user.id = order.user_id order by id", "semantic", 129, "id"},
+		{"select * from order where price > $2", "semantic", 34, ""},
+		{"create table user (id primary key)", "semantic", 13, "user"},
+		{"create table item (name string)", "semantic", 13, "item"},
+		{"create table item (id primary key, key primary key)", "semantic", 39, "key"},
+		{"create table item (id primary key, name str)", "type", 40, "name"},
+		{"create table item (id primary key, id int)", "semantic", 35, "id"},
+		{"drop table items", "semantic", 11, "items"},
+		{"create index a on orders (price)", "semantic", 18, "orders"},
+		{"create index a on order (cost)", "semantic", 25, "cost"},
+		{"create index a on order (id)", "semantic", 25, "id"},
+		{"create index a on order (price, user_id, price)", "semantic", 41, "price"},
+		{"alter table users drop column id", "semantic", 12, "users"},
+		{"select * from order where ? is null", "type", 28, ""},
+		{"select * from order where price = null and ? = null", "type", 45, ""},
+		{"select * from order where nothing is null", "semantic", 26, "nothing"},
+		{"alter table user add column forename string", "semantic", 28, "forename"},
+		{"alter table user add column key primary key", "semantic", 32, "key"},
+		{"alter table user add column age float", "type", 32, "age"},
+		{"alter table user drop column id", "semantic", 29, "id"},
+		{"alter table user drop column age", "semantic", 29, "age"},
+		{"alter table user rename column forename to surname", "semantic", 43, "surname"},
+		{"select * from order where $1 = $2", "type", 29, ""},
+		{"select * from order where price > $1 and items = $1", "type", 34, ""},
+		{"select sum(items) from order", "type", 11, "items"},
+		{"select items, count(*) from order", "semantic", 7, "items"},
+		{"select * from order where count(*) > 1", "semantic", 26, "count"},
+		{"select * from order group by user_id", "semantic", 7, ""},
+		{"select avg(*) from order", "semantic", 11, ""},
+		{"select total(price) from order", "semantic", 7, "total"},
+		{"select user_id from order group by user_id having price > 1", "semantic", 50, "price"},
+		{"select user_id from order group by user_id order by price", "semantic", 52, "price"},
+		{"select count(*) from order group by *", "semantic", 36, ""},
+		{"select count(*) from order group by price, price", "semantic", 43, "price"},
+		{"select max(items) from order having max(items) > 3", "type", 47, ""},
+		{"delete from order group by user_id", "semantic", 18, ""},
+		{"update order set price = 1 having count(*) > 1", "semantic", 27, ""},
+		{"select * from order limit 1 limit 2", "semantic", 28, ""},
+		{"select * from order offset 1 offset ?", "semantic", 29, ""},
+		{"delete from order limit 1", "semantic", 18, ""},
+		{"explain delete from order", "semantic", 8, ""},
+		{"analyze orders", "semantic", 8, "orders"},
+		{"explain analyze select * from orders", "semantic", 30, "orders"},
+	}
+
+	for _, test := range tests {
+		_, err := Prepare(s, test.query)
+
+		var kind string
+		var pos int
+		var ident string
+		switch e := err.(type) {
+		case *SyntaxError:
+			kind, pos = "syntax", e.Pos
+		case *SemanticError:
+			kind, pos, ident = "semantic", e.Pos, e.Ident
+		case *TypeError:
+			kind, pos, ident = "type", e.Pos, e.Ident
+		default:
+			t.Errorf("%v: unexpected error %v", test.query, err)
+			continue
+		}
+
+		if kind != test.kind || pos != test.pos || ident != test.ident {
+			t.Errorf("%v: got %v error at %v (%q), expected %v error at %v (%q)",
+				test.query, kind, pos, ident, test.kind, test.pos, test.ident)
+		}
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	s := testSchema(t)
+
+	st, err := Prepare(s, "update order set items = ? where price > ? and id < ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []schema.Datatype{schema.String, schema.Int, schema.Int}; !reflect.DeepEqual(st.Params, expected) {
+		t.Errorf("Expected parameter types %v, got %v", expected, st.Params)
+	}
+
+	q, err := st.Bind([]Val{{Str: "pears"}, {IsNum: true, Num: 10}, {IsNum: true, Num: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &UpdateQuery{
+		Values: map[string]Val{"items": {Str: "pears"}},
+		Table:  "order",
+		Where: WhereClause{[]Filter{
+			{Operand{Key: "price"}, GreaterThan, Operand{Val: Val{IsNum: true, Num: 10}}, false},
+			{Operand{Key: "id"}, LessThan, Operand{Val: Val{IsNum: true, Num: 5}}, false},
+		}},
+	}
+	if !reflect.DeepEqual(q, expected) {
+		t.Errorf("Expected %v, got %v", expected, q)
+	}
+
+	// Binding must not change the statement
+	if st.Query.(*UpdateQuery).Values["items"].Param != 1 {
+		t.Error("Binding changed the prepared query")
+	}
+
+	bindErrors := []struct {
+		args  []Val
+		param int
+	}{
+		{[]Val{{Str: "pears"}, {IsNum: true, Num: 10}}, 0},
+		{[]Val{{Str: "pears"}, {Str: "10"}, {IsNum: true, Num: 5}}, 2},
+	}
+
+	for _, test := range bindErrors {
+		_, err := st.Bind(test.args)
+		if e, ok := err.(*BindError); !ok || e.Param != test.param {
+			t.Errorf("%v: expected a bind error for parameter %v, got %v", test.args, test.param, err)
+		}
+	}
+
+	if _, err := Compile(s, "select * from order where id = $1"); err == nil {
+		t.Error("Expected Compile to reject a query with parameters")
+	}
+}
+
+func TestCreateTable(t *testing.T) {
+	q, err := Compile(testSchema(t), "create table item (name string, id primary key, price int)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &CreateTableQuery{schema.Table{
+		Name: "item",
+		Fields: []schema.Field{
+			{Name: "id", Type: schema.PrimaryKey},
+			{Name: "name", Type: schema.String},
+			{Name: "price", Type: schema.Int},
+		},
+	}}
+	if !reflect.DeepEqual(q, expected) {
+		t.Errorf("Expected %v, got %v", expected, q)
+	}
+}
+
+func TestCreateIndex(t *testing.T) {
+	s := testSchema(t)
+
+	q, err := Compile(s, "create index order_user on order (user_id, price)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &CreateIndexQuery{"order", schema.Index{Name: "order_user", Fields: []string{"user_id", "price"}}}
+	if !reflect.DeepEqual(q, expected) {
+		t.Errorf("Expected %v, got %v", expected, q)
+	}
+
+	// Index names are unique across tables
+	table := s.GetTable("user")
+	table.Indexes = []schema.Index{expected.Index}
+	_, err = Compile(s.WithTable(table), "create index order_user on order (price)")
+	if e, ok := err.(*SemanticError); !ok || e.Pos != 13 || e.Ident != "order_user" {
+		t.Errorf("Expected a semantic error at 13, got %v", err)
+	}
+}
+
+func TestAlterTable(t *testing.T) {
+	s := testSchema(t)
+
+	user := s.GetTable("user")
+	user.Indexes = []schema.Index{{Name: "name", Fields: []string{"surname", "forename"}}, {Name: "home", Fields: []string{"address"}}}
+	s = s.WithTable(user)
+
+	tests := []struct {
+		query   string
+		fields  []string
+		indexes []schema.Index
+	}{
+		{"alter table user add column age int", []string{"id", "forename", "surname", "address", "age"}, user.Indexes},
+		{"alter table user drop column forename", []string{"id", "surname", "address"}, user.Indexes[1:]},
+		{"alter table user rename column id to user_id", []string{"user_id", "forename", "surname", "address"}, user.Indexes},
+		{"alter table user rename column surname to family_name", []string{"id", "forename", "family_name", "address"}, []schema.Index{
+			{Name: "name", Fields: []string{"family_name", "forename"}},
+			user.Indexes[1],
+		}},
+	}
+
+	for _, test := range tests {
+		q, err := Compile(s, test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		alter := q.(*AlterTableQuery)
+		altered := alter.Alteration.Apply(s.GetTable(alter.Table))
+		var fields []string
+		for _, f := range altered.Fields {
+			fields = append(fields, f.Name)
+		}
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%v: expected fields %v, got %v", test.query, test.fields, fields)
+		}
+		if !reflect.DeepEqual(altered.Indexes, test.indexes) {
+			t.Errorf("%v: expected indexes %v, got %v", test.query, test.indexes, altered.Indexes)
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	s := testSchema(t)
+
+	st, err := Prepare(s, "select items from order where items = ? limit ? offset 20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []schema.Datatype{schema.String, schema.Int}; !reflect.DeepEqual(st.Params, expected) {
+		t.Errorf("Expected parameter types %v, got %v", expected, st.Params)
+	}
+
+	q, err := st.Bind([]Val{{Str: "pears"}, {IsNum: true, Num: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := q.(*SelectQuery)
+	if query.Limit != (Val{IsNum: true, Num: 10}) || query.Offset != (Val{IsNum: true, Num: 20}) {
+		t.Errorf("Expected LIMIT 10 OFFSET 20, got %v and %v", query.Limit, query.Offset)
+	}
+
+	// Without a clause, or with LIMIT NULL, there is no limit
+	for _, query := range []string{"select * from order", "select * from order limit null"} {
+		q, err := Compile(s, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !q.(*SelectQuery).Limit.Null {
+			t.Errorf("%v: expected no limit, got %v", query, q.(*SelectQuery).Limit)
+		}
+	}
+}
+
+func TestThreeValuedLogic(t *testing.T) {
+	s := testSchema(t)
+	record := map[string]Val{"items": {Str: "apples"}, "price": {IsNum: true, Num: 100}}
+
+	tests := []struct {
+		where string
+		truth Truth
+	}{
+		{"items = 'apples'", True},
+		{"user_id = 1", Unknown},
+		{"user_id is null", True},
+		{"user_id is not null", False},
+		{"price is not null and user_id = 1", Unknown},
+		{"price < 50 and user_id = 1", False},
+		{"user_id = 1 and price < 50", False},
+		{"items = null", Unknown},
+		{"null is null and price = 100", True},
+		{"not (user_id = null)", Unknown},
+		{"not (items = 'apples')", False},
+		{"not price < 50", True},
+		{"not user_id is null", False},
+		{"not not items = null", Unknown},
+		{"not (price < 50) and not (user_id = 1)", Unknown},
+	}
+
+	for _, test := range tests {
+		q, err := Compile(s, "select * from order where "+test.where)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		where := q.(*SelectQuery).Where
+		if truth := where.Truth(record); truth != test.truth {
+			t.Errorf("%v: expected %v, got %v", test.where, test.truth, truth)
+		}
+		if where.Eval(record) != (test.truth == True) {
+			t.Errorf("%v: records are selected only if the clause is true", test.where)
+		}
+	}
+}
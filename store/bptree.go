@@ -26,6 +26,21 @@ func (t *bptree) GetAllWhere(pred func(int, []byte) bool) map[int][]byte {
 	return t.root.getAllWhere(pred)
 }
 
+// Scan calls f on each key-value pair with a key in the given range, in
+// ascending key order, stopping early if f returns false.
+func (t *bptree) Scan(minKey, maxKey int, f func(int, []byte) bool) {
+	for leaf := t.root.findLeaf(minKey); leaf != nil; leaf = leaf.nextLeaf {
+		for i, key := range leaf.keys {
+			if key > maxKey {
+				return
+			}
+			if key >= minKey && !f(key, leaf.children[i]) {
+				return
+			}
+		}
+	}
+}
+
 // Insert adds a new key-value pair to the tree.
 func (t *bptree) Insert(key int, val []byte) bool {
 	newKey, newChild, err := t.root.insert(key, val, t.b)
@@ -67,7 +82,16 @@ func (t *bptree) UpdateAllWhere(pred func(int, []byte) bool, f func([]byte) []by
 // Delete deletes the record associated with a given key, if such a record exists.
 // It returns true if a record was deleted.
 func (t *bptree) Delete(key int) bool {
-	return t.root.del(key, t.b, nil, nil)
+	ok := t.root.del(key, t.b, nil, nil)
+
+	// If merging has left the root with a single child, that child becomes the
+	// new root
+	if root, isNonLeaf := t.root.(*nonleafnode); isNonLeaf && len(root.children) == 1 {
+		t.root = root.children[0]
+		t.root.setParent(nil)
+	}
+
+	return ok
 }
 
 // NewBPTree instantitates a B+ tree, with a given branching factor.
@@ -90,6 +114,7 @@ type treenode interface {
 	update(key int, f func([]byte) []byte) bool
 	updateRange(minKey, maxKey int, f func([]byte) []byte)
 	updateAllWhere(pred func(int, []byte) bool, f func([]byte) []byte)
+	findLeaf(key int) *leafnode
 	getParent() *nonleafnode
 	setParent(p *nonleafnode)
 	firstKey() int
@@ -151,6 +176,21 @@ func (n *leafnode) get(key int) []byte {
 	return nil
 }
 
+// findLeaf returns the leaf in which a record with the given key would be
+// stored.
+func (n *nonleafnode) findLeaf(key int) *leafnode {
+	for i, k := range n.keys {
+		if k > key {
+			return n.children[i].findLeaf(key)
+		}
+	}
+	return n.children[len(n.keys)].findLeaf(key)
+}
+
+func (n *leafnode) findLeaf(key int) *leafnode {
+	return n
+}
+
 func (n *nonleafnode) getRange(minKey, maxKey int) map[int][]byte {
 	for i, k := range n.keys {
 		if k > minKey {
@@ -492,27 +532,13 @@ redistribute:
 	// If redistribution is not possible, merge
 	if leftSib != nil {
 		leftSib.concat(n)
-
-		for i, k := range n.parent.keys {
-			if k == n.firstKey() {
-				n.parent.keys = append(n.parent.keys[:i], n.parent.keys[i+1:]...)
-				n.parent.children = append(n.parent.children[:i+1], n.parent.children[i+2:]...)
-				break
-			}
-		}
+		n.parent.removeChild(n)
 
 		return true
 	}
 	if rightSib != nil {
 		n.concat(rightSib)
-
-		for i, k := range n.parent.keys {
-			if k == rightSib.firstKey() {
-				n.parent.keys = append(n.parent.keys[:i], n.parent.keys[i+1:]...)
-				n.parent.children = append(n.parent.children[:i+1], n.parent.children[i+2:]...)
-				break
-			}
-		}
+		n.parent.removeChild(rightSib)
 
 		return true
 	}
@@ -580,27 +606,13 @@ present:
 	// If redistribution is not possible, merge
 	if leftSib != nil {
 		leftSib.concat(n)
-
-		for i, k := range n.parent.keys {
-			if k == n.firstKey() || k == key {
-				n.parent.keys = append(n.parent.keys[:i], n.parent.keys[i+1:]...)
-				n.parent.children = append(n.parent.children[:i+1], n.parent.children[i+2:]...)
-				break
-			}
-		}
+		n.parent.removeChild(n)
 
 		return true
 	}
 	if rightSib != nil {
 		n.concat(rightSib)
-
-		for i, k := range n.parent.keys {
-			if k == rightSib.firstKey() {
-				n.parent.keys = append(n.parent.keys[:i], n.parent.keys[i+1:]...)
-				n.parent.children = append(n.parent.children[:i+1], n.parent.children[i+2:]...)
-				break
-			}
-		}
+		n.parent.removeChild(rightSib)
 
 		return true
 	}
@@ -703,6 +715,18 @@ func (l *nonleafnode) concat(t treenode) {
 	}
 }
 
+// removeChild removes a child which has been merged into its left sibling,
+// along with the key separating the two.
+func (n *nonleafnode) removeChild(c treenode) {
+	for i, child := range n.children {
+		if child == c {
+			n.children = append(n.children[:i], n.children[i+1:]...)
+			n.keys = append(n.keys[:i-1], n.keys[i:]...)
+			return
+		}
+	}
+}
+
 func (n *nonleafnode) updateKeys() {
 	for i, c := range n.children[1:] {
 		n.keys[i] = c.firstKey()
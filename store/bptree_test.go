@@ -81,6 +81,29 @@ func TestBPTree(t *testing.T) {
 	}
 }
 
+func TestDeleteAll(t *testing.T) {
+	store := NewBPTree(4)
+
+	for i := 0; i < 100; i++ {
+		store.Insert(i, []byte{byte(i)})
+	}
+
+	for _, i := range rand.Perm(100) {
+		if !store.Delete(i) {
+			t.Errorf("Delete failed: %v", i)
+		}
+
+		errs := store.root.(testableNode).verifyInvariants(store.b)
+		for _, err := range errs {
+			t.Error(err)
+		}
+	}
+
+	if len(store.GetAllWhere(func(int, []byte) bool { return true })) != 0 {
+		t.Error("Records remain after deleting all keys")
+	}
+}
+
 func TestRange(t *testing.T) {
 	store := NewBPTree(4)
 
@@ -123,6 +146,41 @@ func TestRange(t *testing.T) {
 	}
 }
 
+func TestScan(t *testing.T) {
+	store := NewBPTree(4)
+
+	for _, i := range rand.Perm(100) {
+		store.Insert(i, []byte{byte(i)})
+	}
+
+	var keys []int
+	store.Scan(5, 23, func(key int, val []byte) bool {
+		if !bytes.Equal(val, []byte{byte(key)}) {
+			t.Errorf("Incorrect value for key %v", key)
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 23-5+1 {
+		t.Errorf("Incorrect range scanned %v", keys)
+	}
+	for i, key := range keys {
+		if key != i+5 {
+			t.Errorf("Keys scanned out of order %v", keys)
+			break
+		}
+	}
+
+	count := 0
+	store.Scan(math.MinInt32, math.MaxInt32, func(key int, val []byte) bool {
+		count++
+		return key < 49
+	})
+	if count != 50 {
+		t.Errorf("Scan should stop when f returns false, but visited %v records", count)
+	}
+}
+
 func TestAllWhere(t *testing.T) {
 	store := NewBPTree(4)
 
@@ -0,0 +1,193 @@
+package store
+
+// An Overlay is a Store which buffers changes to another Store. Reads see the
+// base store with the buffered changes applied, and the base store is only
+// changed when the overlay is committed.
+type Overlay struct {
+	base    Store
+	b       int          // Branching factor of written
+	written Store        // Records inserted or updated through the overlay
+	deleted map[int]bool // Keys of base records deleted through the overlay
+}
+
+// NewOverlay returns an overlay with no changes to the given store.
+func NewOverlay(base Store, branchingFactor int) *Overlay {
+	return &Overlay{
+		base:    base,
+		b:       branchingFactor,
+		written: NewBPTree(branchingFactor),
+		deleted: make(map[int]bool),
+	}
+}
+
+// Commit applies the buffered changes to the base store, and clears them.
+func (o *Overlay) Commit() {
+	o.Changes(func(key int, val []byte) {
+		switch {
+		case val == nil:
+			o.base.Delete(key)
+		case !o.base.Update(key, func([]byte) []byte { return val }):
+			o.base.Insert(key, val)
+		}
+	})
+
+	o.written = NewBPTree(o.b)
+	o.deleted = make(map[int]bool)
+}
+
+// Changes calls f on the key and new value of each record changed through the
+// overlay, with a nil value for records which have been deleted.
+func (o *Overlay) Changes(f func(key int, val []byte)) {
+	for key := range o.deleted {
+		if o.written.Get(key) == nil {
+			f(key, nil)
+		}
+	}
+
+	o.written.Scan(minInt, maxInt, func(key int, val []byte) bool {
+		f(key, val)
+		return true
+	})
+}
+
+// Get returns a record, or nil if there is none with the given key.
+func (o *Overlay) Get(key int) []byte {
+	if val := o.written.Get(key); val != nil {
+		return val
+	}
+	if o.deleted[key] {
+		return nil
+	}
+
+	return o.base.Get(key)
+}
+
+// Insert adds a record, or returns false if one with the given key exists.
+func (o *Overlay) Insert(key int, val []byte) bool {
+	if o.Get(key) != nil {
+		return false
+	}
+
+	o.set(key, val)
+	return true
+}
+
+// Update applies f to an existing record, or returns false if there is none
+// with the given key.
+func (o *Overlay) Update(key int, f func([]byte) []byte) bool {
+	val := o.Get(key)
+	if val == nil {
+		return false
+	}
+
+	o.set(key, f(val))
+	return true
+}
+
+// Delete removes a record, or returns false if there is none with the given
+// key.
+func (o *Overlay) Delete(key int) bool {
+	if o.Get(key) == nil {
+		return false
+	}
+
+	o.written.Delete(key)
+	o.deleted[key] = true
+	return true
+}
+
+func (o *Overlay) set(key int, val []byte) {
+	if !o.written.Update(key, func([]byte) []byte { return val }) {
+		o.written.Insert(key, val)
+	}
+}
+
+// GetRange returns all records with keys in the inclusive range.
+func (o *Overlay) GetRange(minKey, maxKey int) map[int][]byte {
+	result := make(map[int][]byte)
+	o.Scan(minKey, maxKey, func(key int, val []byte) bool {
+		result[key] = val
+		return true
+	})
+
+	return result
+}
+
+// GetAllWhere returns all records for which pred is true.
+func (o *Overlay) GetAllWhere(pred func(int, []byte) bool) map[int][]byte {
+	result := make(map[int][]byte)
+	o.Scan(minInt, maxInt, func(key int, val []byte) bool {
+		if pred(key, val) {
+			result[key] = val
+		}
+		return true
+	})
+
+	return result
+}
+
+// Scan calls f on each record with a key in the inclusive range, in key order,
+// until f returns false. Buffered records are merged into a scan of the base
+// store.
+func (o *Overlay) Scan(minKey, maxKey int, f func(int, []byte) bool) {
+	var keys []int
+	var vals [][]byte
+	o.written.Scan(minKey, maxKey, func(key int, val []byte) bool {
+		keys = append(keys, key)
+		vals = append(vals, val)
+		return true
+	})
+
+	i := 0
+	stopped := false
+	o.base.Scan(minKey, maxKey, func(key int, val []byte) bool {
+		for ; i < len(keys) && keys[i] < key; i++ {
+			if !f(keys[i], vals[i]) {
+				stopped = true
+				return false
+			}
+		}
+
+		switch {
+		case i < len(keys) && keys[i] == key:
+			// The record has been updated
+			i++
+			if !f(key, vals[i-1]) {
+				stopped = true
+				return false
+			}
+		case !o.deleted[key]:
+			if !f(key, val) {
+				stopped = true
+				return false
+			}
+		}
+
+		return true
+	})
+
+	for ; !stopped && i < len(keys); i++ {
+		if !f(keys[i], vals[i]) {
+			return
+		}
+	}
+}
+
+// UpdateRange applies f to all records with keys in the inclusive range.
+func (o *Overlay) UpdateRange(minKey, maxKey int, f func([]byte) []byte) {
+	for key := range o.GetRange(minKey, maxKey) {
+		o.Update(key, f)
+	}
+}
+
+// UpdateAllWhere applies f to all records for which pred is true.
+func (o *Overlay) UpdateAllWhere(pred func(int, []byte) bool, f func([]byte) []byte) {
+	for key := range o.GetAllWhere(pred) {
+		o.Update(key, f)
+	}
+}
+
+const (
+	maxInt = int(^uint(0) >> 1)
+	minInt = -maxInt - 1
+)
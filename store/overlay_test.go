@@ -0,0 +1,69 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	base := NewBPTree(4)
+	for i := 0; i < 20; i++ {
+		base.Insert(i, []byte{byte(i)})
+	}
+
+	o := NewOverlay(base, 4)
+	o.Insert(25, []byte{25})
+	o.Delete(3)
+	o.Delete(4)
+	o.Insert(4, []byte{40})
+	o.Update(5, func([]byte) []byte { return []byte{50} })
+	o.Insert(-1, []byte{99})
+	o.Insert(26, []byte{26})
+	o.Delete(26)
+
+	if o.Insert(6, []byte{0}) || o.Update(3, func(v []byte) []byte { return v }) || o.Delete(3) {
+		t.Error("Overlay allowed a change to a missing or existing record")
+	}
+
+	expected := map[int][]byte{-1: {99}, 4: {40}, 5: {50}, 25: {25}}
+	for i := 0; i < 20; i++ {
+		if i != 3 && i != 4 && i != 5 {
+			expected[i] = []byte{byte(i)}
+		}
+	}
+
+	var prev int
+	got := make(map[int][]byte)
+	o.Scan(-10, 30, func(key int, val []byte) bool {
+		if len(got) > 0 && key <= prev {
+			t.Errorf("Scan out of order: %v after %v", key, prev)
+		}
+		prev = key
+		got[key] = val
+		return true
+	})
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Incorrect scan of overlay %v", got)
+	}
+
+	if base.Get(3) == nil || base.Get(25) != nil || base.Get(5)[0] != 5 {
+		t.Error("Overlay changed its base store before commit")
+	}
+
+	count := 0
+	o.Scan(-10, 30, func(int, []byte) bool {
+		count++
+		return count < 3
+	})
+	if count != 3 {
+		t.Errorf("Scan did not stop early, visited %v records", count)
+	}
+
+	o.Commit()
+	if !reflect.DeepEqual(base.GetRange(-10, 30), expected) {
+		t.Errorf("Incorrect base store after commit %v", base.GetRange(-10, 30))
+	}
+	if len(o.GetRange(-10, 30)) != len(expected) {
+		t.Error("Overlay should read its base store after commit")
+	}
+}
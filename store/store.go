@@ -10,6 +10,7 @@ type Store interface {
 	Delete(key int) bool                                               // Delete an existing record and return true if successful
 	GetRange(minKey, maxKey int) map[int][]byte                        // Returns all key-value pairs with keys in inclusive range [minKey,maxKey]
 	GetAllWhere(pred func(int, []byte) bool) map[int][]byte            // Returns all key-values pairs for which pred is true
+	Scan(minKey, maxKey int, f func(int, []byte) bool)                 // Call f on each key-value pair in the inclusive range, in key order, until f returns false
 	UpdateRange(minKey, maxKey int, f func([]byte) []byte)             // Update all records in the given inclusive range
 	UpdateAllWhere(pred func(int, []byte) bool, f func([]byte) []byte) // Update all records for which pred is true
 }